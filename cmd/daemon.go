@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/pkg"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run the tunnel daemon",
+	Long: `Run a background daemon owning port forwarding tunnels, controlled with the tunnel command over a local Unix
+domain socket.  The tunnels keep running when the terminal which started them is closed.`,
+}
+
+var daemonRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run the tunnel daemon",
+	Long: `Run the tunnel daemon in the foreground until it is stopped or interrupted, or in the background with --detach.
+The AWS configuration and credentials of the daemon are used by all the tunnels.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// the detached daemon initializes the client itself
+		if !config.Flags().DaemonDetach {
+			pkg.InitializeClient()
+		}
+		if err := pkg.RunDaemon(); err != nil {
+			zap.S().Fatal(err)
+		}
+	},
+}
+
+var daemonStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the tunnel daemon and all its tunnels",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := pkg.StopDaemon(); err != nil {
+			zap.S().Fatal(err)
+		}
+	},
+}
+
+func init() {
+	daemonRunCmd.Flags().BoolVar(&config.Flags().DaemonDetach, "detach", false, "Run the daemon in the background")
+	daemonCmd.AddCommand(daemonRunCmd, daemonStopCmd)
+	rootCmd.AddCommand(daemonCmd)
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"github.com/alexbacchin/ssm-session-client/pkg"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+	"github.com/spf13/cobra"
+)
+
+var replayOpts ssmclient.ReplayOptions
+var replayDump bool
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [file]",
+	Short: "Replay a recorded shell session",
+	Long: `Replay a shell session recorded in asciicast v2 format (see the --record flag of the shell command).
+While playing: space pauses/resumes, left/right arrows seek 5 seconds, '.' steps through a paused replay, and q quits.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pkg.StartReplay(args[0], replayOpts, replayDump)
+	},
+}
+
+func init() {
+	replayCmd.Flags().Float64Var(&replayOpts.Speed, "speed", 1, "Playback speed multiplier")
+	replayCmd.Flags().DurationVar(&replayOpts.IdleTimeLimit, "idle-time-limit", 0, "Shorten pauses in the recording to at most this duration (0 keeps the original timing)")
+	replayCmd.Flags().BoolVar(&replayDump, "dump", false, "Print the recorded output as plain text, without terminal escape sequences")
+	rootCmd.AddCommand(replayCmd)
+}
@@ -4,8 +4,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/daemon"
+	"github.com/alexbacchin/ssm-session-client/datachannel"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -43,6 +46,19 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&config.Flags().ProxyURL, "proxy-url", "", "proxy server to use for the connections")
 	rootCmd.PersistentFlags().BoolVar(&config.Flags().UseSSMSessionPlugin, "ssm-session-plugin", true, "Use AWS SSH Session Plugin to establish SSH session with advanced features, like encryption, compression, and session recording")
 	rootCmd.PersistentFlags().StringVar(&config.Flags().LogLevel, "log-level", "info", "Set the log level (debug, info, warn, error, fatal, panic)")
+	rootCmd.PersistentFlags().IntVar(&config.Flags().ReconnectAttempts, "reconnect-attempts", 0, "Number of attempts to resume the session if the connection is lost (0 disables reconnect)")
+	rootCmd.PersistentFlags().DurationVar(&config.Flags().ReconnectBackoff, "reconnect-backoff", time.Second, "Initial delay between reconnect attempts, doubled after each failed attempt")
+	rootCmd.PersistentFlags().DurationVar(&config.Flags().KeepAliveInterval, "keepalive-interval", 0, "Interval between websocket keepalive pings (0 disables keepalive)")
+	rootCmd.PersistentFlags().DurationVar(&config.Flags().KeepAliveTimeout, "keepalive-timeout", 30*time.Second, "Time to wait for a keepalive reply before the connection is considered lost")
+	rootCmd.PersistentFlags().StringVar(&config.Flags().CABundle, "ca-bundle", "", "PEM file of additional CA certificates to trust for all connections")
+	rootCmd.PersistentFlags().StringVar(&config.Flags().TLSMinVersion, "tls-min-version", "", "Minimum TLS version for all connections (1.0, 1.1, 1.2, 1.3)")
+	rootCmd.PersistentFlags().StringVar(&config.Flags().ClientCert, "client-cert", "", "PEM file of the TLS client certificate for all connections")
+	rootCmd.PersistentFlags().StringVar(&config.Flags().ClientKey, "client-key", "", "PEM file of the TLS client certificate private key")
+	rootCmd.PersistentFlags().StringVar(&config.Flags().TraceFile, "trace-file", "", "Append a JSON lines trace of all session protocol messages to this file")
+	rootCmd.PersistentFlags().IntVar(&config.Flags().TracePayloadLimit, "trace-payload-limit", datachannel.DefaultTracePayloadLimit, "Maximum number of payload bytes written per traced message (negative omits all payloads)")
+	rootCmd.PersistentFlags().BoolVar(&config.Flags().TraceIncludeData, "trace-include-data", false, "Include the session data (terminal and port data, and stderr output) in the protocol trace, instead of redacting it")
+	rootCmd.PersistentFlags().StringVar(&config.Flags().MetricsListen, "metrics-listen", "", "Serve session metrics in Prometheus text format at /metrics on this address (like 127.0.0.1:9464)")
+	rootCmd.PersistentFlags().StringVar(&config.Flags().DaemonSocket, "daemon-socket", "", "Control socket of the tunnel daemon (default "+daemon.DefaultSocketPath()+")")
 
 	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 	viper.BindPFlag("aws-profile", rootCmd.PersistentFlags().Lookup("aws-profile"))
@@ -55,6 +71,19 @@ func init() {
 	viper.BindPFlag("sso-login", rootCmd.PersistentFlags().Lookup("sso-login"))
 	viper.BindPFlag("proxy-url", rootCmd.PersistentFlags().Lookup("proxy-url"))
 	viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("reconnect-attempts", rootCmd.PersistentFlags().Lookup("reconnect-attempts"))
+	viper.BindPFlag("reconnect-backoff", rootCmd.PersistentFlags().Lookup("reconnect-backoff"))
+	viper.BindPFlag("keepalive-interval", rootCmd.PersistentFlags().Lookup("keepalive-interval"))
+	viper.BindPFlag("keepalive-timeout", rootCmd.PersistentFlags().Lookup("keepalive-timeout"))
+	viper.BindPFlag("ca-bundle", rootCmd.PersistentFlags().Lookup("ca-bundle"))
+	viper.BindPFlag("tls-min-version", rootCmd.PersistentFlags().Lookup("tls-min-version"))
+	viper.BindPFlag("client-cert", rootCmd.PersistentFlags().Lookup("client-cert"))
+	viper.BindPFlag("client-key", rootCmd.PersistentFlags().Lookup("client-key"))
+	viper.BindPFlag("trace-file", rootCmd.PersistentFlags().Lookup("trace-file"))
+	viper.BindPFlag("trace-payload-limit", rootCmd.PersistentFlags().Lookup("trace-payload-limit"))
+	viper.BindPFlag("trace-include-data", rootCmd.PersistentFlags().Lookup("trace-include-data"))
+	viper.BindPFlag("metrics-listen", rootCmd.PersistentFlags().Lookup("metrics-listen"))
+	viper.BindPFlag("daemon-socket", rootCmd.PersistentFlags().Lookup("daemon-socket"))
 
 }
 
@@ -69,6 +98,19 @@ func preRun(ccmd *cobra.Command, args []string) {
 		zap.S().Fatalf("Unable to read Viper options into configuration: %v", err)
 	}
 
+	if config.Flags().TraceFile != "" && config.Flags().UseSSMSessionPlugin {
+		zap.S().Info("the protocol trace is only written by the native session client, use --ssm-session-plugin=false")
+	}
+
+	if config.Flags().MetricsListen != "" && config.Flags().UseSSMSessionPlugin {
+		zap.S().Info("session metrics are only collected by the native session client, use --ssm-session-plugin=false")
+	}
+}
+
+// addSessionDocumentFlags adds the flags selecting the session document and its parameters to the command.
+func addSessionDocumentFlags(ccmd *cobra.Command, usage string) {
+	ccmd.Flags().StringVar(&config.Flags().DocumentName, "document-name", "", usage)
+	ccmd.Flags().StringArrayVar(&config.Flags().Parameters, "parameter", nil, "Session document parameter as key=value, repeat the flag for each parameter or value")
 }
 
 // / initConfig reads in config file and ENV variables if set.
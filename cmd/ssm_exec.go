@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/pkg"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var ssmExecCmd = &cobra.Command{
+	Use:   "exec [target] -- [command]",
+	Short: "Run a command using SSM Session",
+	Long: `Run a single non-interactive command via AWS SSM Session Manager, and exit with the exit code of the command.
+The output of the command is written to stdout, and its error output to stderr when the SSM agent reports it
+separately.  Standard input is only sent to the command with --stdin.
+
+A single argument after -- is run as a shell command line, for example 'cat > /tmp/config.json'.  Several
+arguments are quoted for a POSIX shell, so each reaches the command unchanged.`,
+	Args: cobra.MatchAll(cobra.MinimumNArgs(2), cobra.OnlyValidArgs),
+	Run: func(cmd *cobra.Command, args []string) {
+		pkg.InitializeClient()
+		code, err := pkg.StartSSMExec(args[0], args[1:])
+		if errors.Is(err, ssmclient.ErrNoExitCode) {
+			// the outcome of the command is unknown, which must not pass for success
+			fmt.Fprintln(os.Stderr, "warning:", err)
+			os.Exit(255)
+		}
+		if err != nil {
+			zap.S().Fatal(err)
+		}
+		os.Exit(code)
+	},
+}
+
+func init() {
+	addSessionDocumentFlags(ssmExecCmd, "SSM session document used to run the command, which must accept a command parameter (default "+ssmclient.DefaultExecDocument+")")
+	ssmExecCmd.Flags().BoolVar(&config.Flags().ExecStdin, "stdin", false, "Send standard input to the command")
+	rootCmd.AddCommand(ssmExecCmd)
+}
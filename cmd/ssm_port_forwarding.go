@@ -9,10 +9,11 @@ import (
 )
 
 var portForwardingCmd = &cobra.Command{
-	Use:   "port-forwarding [target:destination port] [source port]",
+	Use:   "port-forwarding [target:[remote host:]destination port] [source port]",
 	Short: "Start a Port Forwarding Shell Session",
-	Long:  `Start a Port Forwarding via AWS SSM Session Manager`,
-	Args:  cobra.MatchAll(cobra.MinimumNArgs(1), cobra.OnlyValidArgs),
+	Long: `Start a Port Forwarding via AWS SSM Session Manager.  With a remote host, connections are forwarded through
+the target to the remote host, such as an RDS or ElastiCache endpoint.`,
+	Args: cobra.MatchAll(cobra.MinimumNArgs(1), cobra.OnlyValidArgs),
 	Run: func(cmd *cobra.Command, args []string) {
 		var err error
 		sourcePort, err := strconv.Atoi(args[1])
@@ -26,5 +27,6 @@ var portForwardingCmd = &cobra.Command{
 }
 
 func init() {
+	addSessionDocumentFlags(portForwardingCmd, "SSM session document used for the port forwarding (default AWS-StartPortForwardingSession)")
 	rootCmd.AddCommand(portForwardingCmd)
 }
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"github.com/alexbacchin/ssm-session-client/config"
 	"github.com/alexbacchin/ssm-session-client/pkg"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
 	"github.com/spf13/cobra"
 )
 
@@ -17,5 +19,8 @@ var ssmShellCmd = &cobra.Command{
 }
 
 func init() {
+	ssmShellCmd.Flags().StringVar(&config.Flags().RecordFile, "record", "", "Record the shell session to this file in asciicast v2 format")
+	ssmShellCmd.Flags().BoolVar(&config.Flags().RecordInput, "record-input", false, "Include the keyboard input in the session recording")
+	addSessionDocumentFlags(ssmShellCmd, "SSM session document used for the shell (default "+ssmclient.DefaultShellDocument+")")
 	rootCmd.AddCommand(ssmShellCmd)
 }
@@ -18,5 +18,6 @@ var ssmSshCmd = &cobra.Command{
 }
 
 func init() {
+	addSessionDocumentFlags(ssmSshCmd, "SSM session document used for the SSH connection (default AWS-StartSSHSession)")
 	rootCmd.AddCommand(ssmSshCmd)
 }
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/alexbacchin/ssm-session-client/pkg"
+	"github.com/spf13/cobra"
+)
+
+var traceDecodeOpts pkg.TraceDecodeOptions
+
+var traceCmd = &cobra.Command{
+	Use:   "trace",
+	Short: "Work with session protocol traces",
+	Long:  `Work with the session protocol traces written by the --trace-file flag.`,
+}
+
+var traceDecodeCmd = &cobra.Command{
+	Use:   "decode [file]",
+	Short: "Print the messages of a protocol trace",
+	Long: `Print the messages of a protocol trace written by the --trace-file flag, optionally filtered by session,
+direction, message type or payload type.  Use "-" to read the trace from standard input.
+With --json the matching records are written as a new trace, which combined with --no-payload is suitable to share
+without exposing any session data.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pkg.StartTraceDecode(args[0], traceDecodeOpts)
+	},
+}
+
+func init() {
+	traceDecodeCmd.Flags().StringVar(&traceDecodeOpts.Filter.SessionID, "session", "", "Only print the messages of this session ID")
+	traceDecodeCmd.Flags().StringVar(&traceDecodeOpts.Filter.Direction, "direction", "", "Only print inbound (in) or outbound (out) messages")
+	traceDecodeCmd.Flags().StringVar(&traceDecodeOpts.Filter.MessageType, "message-type", "", "Only print messages of this type (like acknowledge or output_stream_data)")
+	traceDecodeCmd.Flags().StringVar(&traceDecodeOpts.Filter.PayloadType, "payload-type", "", "Only print messages with this payload type name or number (like handshake_request)")
+	traceDecodeCmd.Flags().BoolVar(&traceDecodeOpts.JSON, "json", false, "Write the matching records as JSON lines")
+	traceDecodeCmd.Flags().BoolVar(&traceDecodeOpts.NoPayload, "no-payload", false, "Remove all message payloads from the output")
+	traceCmd.AddCommand(traceDecodeCmd)
+	rootCmd.AddCommand(traceCmd)
+}
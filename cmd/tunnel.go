@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/pkg"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var tunnelCmd = &cobra.Command{
+	Use:   "tunnel",
+	Short: "Control the tunnels of the tunnel daemon",
+}
+
+var tunnelStartCmd = &cobra.Command{
+	Use:   "start [name] [target:[remote host:]destination port] [source port]",
+	Short: "Start a tunnel in the daemon",
+	Long: `Start a port forwarding tunnel in the daemon.  With only a name, the tunnel is the one with that name in the
+tunnels section of the configuration file.  If a source port is not provided, a random port is used.`,
+	Args: cobra.RangeArgs(1, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		var target string
+		var sourcePort int
+		if len(args) > 1 {
+			target = args[1]
+		}
+		if len(args) > 2 {
+			var err error
+			if sourcePort, err = strconv.Atoi(args[2]); err != nil {
+				fmt.Println("Invalid source port:", args[2])
+				return
+			}
+		}
+
+		if err := pkg.StartTunnel(args[0], target, sourcePort); err != nil {
+			zap.S().Fatal(err)
+		}
+	},
+}
+
+var tunnelStopCmd = &cobra.Command{
+	Use:   "stop [name]",
+	Short: "Stop a tunnel of the daemon",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := pkg.StopTunnel(args[0]); err != nil {
+			zap.S().Fatal(err)
+		}
+	},
+}
+
+var tunnelListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the tunnels of the daemon",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := pkg.ListTunnels(); err != nil {
+			zap.S().Fatal(err)
+		}
+	},
+}
+
+var tunnelLogsCmd = &cobra.Command{
+	Use:   "logs [name]",
+	Short: "Print the log of a tunnel of the daemon",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := pkg.TunnelLogs(args[0]); err != nil {
+			zap.S().Fatal(err)
+		}
+	},
+}
+
+func init() {
+	tunnelStartCmd.Flags().StringVar(&config.Flags().TunnelBindAddress, "bind-address", "", "Local address the tunnel listens on (default localhost)")
+	tunnelLogsCmd.Flags().IntVar(&config.Flags().TunnelLogLines, "lines", 100, "Number of log entries to print, all the retained entries if 0")
+	tunnelCmd.AddCommand(tunnelStartCmd, tunnelStopCmd, tunnelListCmd, tunnelLogsCmd)
+	rootCmd.AddCommand(tunnelCmd)
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"github.com/alexbacchin/ssm-session-client/pkg"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var tunnelsCmd = &cobra.Command{
+	Use:   "tunnels",
+	Short: "Manage the port forwarding tunnels of the configuration file",
+	Long: `Manage the port forwarding tunnels defined in the tunnels section of the configuration file, each with a name,
+target, optional remote host, remote port, local port and bind address.`,
+}
+
+var tunnelsUpCmd = &cobra.Command{
+	Use:   "up [names...]",
+	Short: "Start the configured tunnels",
+	Long: `Start the configured tunnels with the given names, or all of them if no name is given.  The tunnels run
+concurrently until interrupted, then they are all shut down.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pkg.InitializeClient()
+		if err := pkg.StartTunnels(args); err != nil {
+			zap.S().Fatal(err)
+		}
+	},
+}
+
+func init() {
+	tunnelsCmd.AddCommand(tunnelsUpCmd)
+	rootCmd.AddCommand(tunnelsCmd)
+}
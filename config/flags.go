@@ -1,18 +1,54 @@
 package config
 
+import "time"
+
 type Config struct {
-	AWSProfile             string `mapstructure:"aws-profile"`
-	AWSRegion              string `mapstructure:"aws-region"`
-	EC2VpcEndpoint         string `mapstructure:"ec2-endpoint"`
-	ProxyURL               string `mapstructure:"proxy-url"`
-	SSHPublicKeyFile       string `mapstructure:"ssh-public-key-file"`
-	SSMMessagesVpcEndpoint string `mapstructure:"ssmmessages-endpoint"`
-	SSMVpcEndpoint         string `mapstructure:"ssm-endpoint"`
-	STSVpcEndpoint         string `mapstructure:"sts-endpoint"`
-	UseSSMSessionPlugin    bool   `mapstructure:"ssm-session-plugin"`
-	LogLevel               string `mapstructure:"log-level"`
-	UseSSOLogin            bool   `mapstructure:"sso-login"`
-	SSOOpenBrowser         bool   `mapstructure:"sso-open-browser"`
+	AWSProfile             string        `mapstructure:"aws-profile"`
+	AWSRegion              string        `mapstructure:"aws-region"`
+	EC2VpcEndpoint         string        `mapstructure:"ec2-endpoint"`
+	ProxyURL               string        `mapstructure:"proxy-url"`
+	SSHPublicKeyFile       string        `mapstructure:"ssh-public-key-file"`
+	SSMMessagesVpcEndpoint string        `mapstructure:"ssmmessages-endpoint"`
+	SSMVpcEndpoint         string        `mapstructure:"ssm-endpoint"`
+	STSVpcEndpoint         string        `mapstructure:"sts-endpoint"`
+	UseSSMSessionPlugin    bool          `mapstructure:"ssm-session-plugin"`
+	LogLevel               string        `mapstructure:"log-level"`
+	UseSSOLogin            bool          `mapstructure:"sso-login"`
+	SSOOpenBrowser         bool          `mapstructure:"sso-open-browser"`
+	ReconnectAttempts      int           `mapstructure:"reconnect-attempts"`
+	ReconnectBackoff       time.Duration `mapstructure:"reconnect-backoff"`
+	KeepAliveInterval      time.Duration `mapstructure:"keepalive-interval"`
+	KeepAliveTimeout       time.Duration `mapstructure:"keepalive-timeout"`
+	RecordFile             string        `mapstructure:"record"`
+	RecordInput            bool          `mapstructure:"record-input"`
+	CABundle               string        `mapstructure:"ca-bundle"`
+	TLSMinVersion          string        `mapstructure:"tls-min-version"`
+	ClientCert             string        `mapstructure:"client-cert"`
+	ClientKey              string        `mapstructure:"client-key"`
+	TraceFile              string        `mapstructure:"trace-file"`
+	TracePayloadLimit      int           `mapstructure:"trace-payload-limit"`
+	TraceIncludeData       bool          `mapstructure:"trace-include-data"`
+	MetricsListen          string        `mapstructure:"metrics-listen"`
+	DocumentName           string        `mapstructure:"document-name"`
+	ExecStdin              bool          `mapstructure:"stdin"`
+	Parameters             []string      `mapstructure:"parameter"`
+	Tunnels                []Tunnel      `mapstructure:"tunnels"`
+	DaemonSocket           string        `mapstructure:"daemon-socket"`
+	DaemonDetach           bool          `mapstructure:"detach"`
+	TunnelBindAddress      string        `mapstructure:"bind-address"`
+	TunnelLogLines         int           `mapstructure:"lines"`
+}
+
+// Tunnel is a port forwarding tunnel of the tunnels section of the configuration file.  RemoteHost is optional,
+// connections are forwarded to it through the target if set.  LocalPort and BindAddress default to a random port
+// on localhost.
+type Tunnel struct {
+	Name        string `mapstructure:"name"`
+	Target      string `mapstructure:"target"`
+	RemoteHost  string `mapstructure:"remote-host"`
+	RemotePort  int    `mapstructure:"remote-port"`
+	LocalPort   int    `mapstructure:"local-port"`
+	BindAddress string `mapstructure:"bind-address"`
 }
 
 // create a singleton config object
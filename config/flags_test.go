@@ -0,0 +1,67 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestUnmarshalTunnels(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		typ  string
+		data string
+		want []Tunnel
+	}{
+		{"yaml", "yaml", `
+log-level: info
+tunnels:
+  - name: db
+    target: i-0bdb4f892de4bb54c
+    remote-host: mydb.cluster-abc123.eu-west-1.rds.amazonaws.com
+    remote-port: 5432
+    local-port: 5432
+  - name: admin
+    target: i-0a1b2c3d4e5f67890
+    remote-port: 8080
+    bind-address: 0.0.0.0
+`, []Tunnel{
+			{Name: "db", Target: "i-0bdb4f892de4bb54c", RemoteHost: "mydb.cluster-abc123.eu-west-1.rds.amazonaws.com", RemotePort: 5432, LocalPort: 5432},
+			{Name: "admin", Target: "i-0a1b2c3d4e5f67890", RemotePort: 8080, BindAddress: "0.0.0.0"},
+		}},
+		{"json", "json", `{"tunnels": [{"name": "db", "target": "i-0bdb4f892de4bb54c", "remote-port": "5432"}]}`,
+			[]Tunnel{{Name: "db", Target: "i-0bdb4f892de4bb54c", RemotePort: 5432}}},
+		{"no tunnels", "yaml", "log-level: info\n", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := viper.New()
+			v.SetConfigType(tc.typ)
+			if err := v.ReadConfig(strings.NewReader(tc.data)); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := new(Config)
+			if err := v.Unmarshal(cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(cfg.Tunnels, tc.want) {
+				t.Errorf("got tunnels %+v, want %+v", cfg.Tunnels, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalTunnelsInvalid(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader("tunnels:\n  - name: db\n    remote-port: five\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Unmarshal(new(Config)); err == nil {
+		t.Error("expected an error for a remote port which is not a number")
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig returns the TLS client configuration for the AWS SDK HTTP clients and the SSM messages websocket
+// connection, built from the ca-bundle, tls-min-version, client-cert and client-key flags.  The certificates in
+// the CA bundle are trusted in addition to the system roots.  A nil value is returned if none of the flags are
+// set, so the Go defaults are used.
+func TLSConfig() (*tls.Config, error) {
+	f := &singleFlags
+	if f.CABundle == "" && f.TLSMinVersion == "" && f.ClientCert == "" && f.ClientKey == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if f.TLSMinVersion != "" {
+		v, ok := tlsVersions[f.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tls-min-version %q, must be one of 1.0, 1.1, 1.2 or 1.3", f.TLSMinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if f.CABundle != "" {
+		pem, err := os.ReadFile(f.CABundle)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca-bundle %s", f.CABundle)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if f.ClientCert != "" || f.ClientKey != "" {
+		if f.ClientCert == "" || f.ClientKey == "" {
+			return nil, errors.New("client-cert and client-key must be set together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(f.ClientCert, f.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
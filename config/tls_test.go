@@ -0,0 +1,79 @@
+package config
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setTLSFlags sets the TLS flags for the duration of the test.
+func setTLSFlags(t *testing.T, caBundle, minVersion, clientCert, clientKey string) {
+	t.Helper()
+	saved := singleFlags
+	t.Cleanup(func() { singleFlags = saved })
+
+	singleFlags.CABundle = caBundle
+	singleFlags.TLSMinVersion = minVersion
+	singleFlags.ClientCert = clientCert
+	singleFlags.ClientKey = clientKey
+}
+
+func TestTLSConfigUnset(t *testing.T) {
+	setTLSFlags(t, "", "", "", "")
+
+	cfg, err := TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != nil {
+		t.Errorf("expected nil config, got %+v", cfg)
+	}
+}
+
+func TestTLSConfigMinVersion(t *testing.T) {
+	setTLSFlags(t, "", "1.3", "", "")
+
+	cfg, err := TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3 minimum version, got %x", cfg.MinVersion)
+	}
+
+	setTLSFlags(t, "", "1.4", "", "")
+	if _, err = TLSConfig(); err == nil {
+		t.Error("expected an error for an unsupported version")
+	}
+}
+
+func TestTLSConfigClientCertAndKey(t *testing.T) {
+	for _, tc := range []struct {
+		name, cert, key string
+	}{
+		{"cert only", "client.crt", ""},
+		{"key only", "", "client.key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setTLSFlags(t, "", "", tc.cert, tc.key)
+
+			_, err := TLSConfig()
+			if err == nil || err.Error() != "client-cert and client-key must be set together" {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigEmptyCABundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setTLSFlags(t, path, "", "", "")
+
+	if _, err := TLSConfig(); err == nil {
+		t.Error("expected an error for a CA bundle without certificates")
+	}
+}
@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrDaemonNotRunning is the error returned by Dial if no daemon is listening on the socket.
+var ErrDaemonNotRunning = errors.New("the daemon is not running")
+
+// Client sends requests to a daemon over its control socket.  A Client is not safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	enc  *json.Encoder
+}
+
+// Dial connects to the daemon listening on the Unix domain socket at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDaemonNotRunning, err)
+	}
+
+	return &Client{conn: conn, r: bufio.NewReader(conn), enc: json.NewEncoder(conn)}, nil
+}
+
+// Close closes the connection with the daemon.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends the request to the daemon and returns its response.  An error is returned if the exchange with the
+// daemon fails, or if the daemon responded with an error (along with the response).
+func (c *Client) Do(req *Request) (*Response, error) {
+	if err := c.enc.Encode(req); err != nil {
+		return nil, err
+	}
+
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(Response)
+	if err = json.Unmarshal(line, resp); err != nil {
+		return nil, err
+	}
+
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Start starts the tunnel, returning its status once it is listening.
+func (c *Client) Start(spec *TunnelSpec) (*TunnelStatus, error) {
+	resp, err := c.Do(&Request{Action: ActionStart, Tunnel: spec})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Tunnels) < 1 {
+		return nil, errors.New("the daemon did not return the status of the tunnel")
+	}
+	return &resp.Tunnels[0], nil
+}
+
+// Stop stops the named tunnel.
+func (c *Client) Stop(name string) error {
+	_, err := c.Do(&Request{Action: ActionStop, Name: name})
+	return err
+}
+
+// List returns the status of the tunnels of the daemon.
+func (c *Client) List() ([]TunnelStatus, error) {
+	resp, err := c.Do(&Request{Action: ActionList})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tunnels, nil
+}
+
+// Logs returns the last log entries of the named tunnel, all the retained entries if lines is not positive.
+func (c *Client) Logs(name string, lines int) ([]LogEntry, error) {
+	resp, err := c.Do(&Request{Action: ActionLogs, Name: name, Lines: lines})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Logs, nil
+}
+
+// Shutdown stops all the tunnels and exits the daemon.
+func (c *Client) Shutdown() error {
+	_, err := c.Do(&Request{Action: ActionShutdown})
+	return err
+}
@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// logRetention is the number of log entries retained for each tunnel.
+const logRetention = 500
+
+// logBuffer retains the last log entries of a tunnel.
+type logBuffer struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+	full    bool
+}
+
+func newLogBuffer() *logBuffer {
+	return &logBuffer{entries: make([]LogEntry, logRetention)}
+}
+
+func (b *logBuffer) add(e LogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// last returns the last n entries in chronological order, all of the retained entries if n is not positive.
+func (b *logBuffer) last(n int) []LogEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	all := b.entries[:b.next]
+	if b.full {
+		all = append(append([]LogEntry{}, b.entries[b.next:]...), b.entries[:b.next]...)
+	}
+
+	if n > 0 && n < len(all) {
+		all = all[len(all)-n:]
+	}
+	return append([]LogEntry(nil), all...)
+}
+
+// logCore is a zapcore.Core adding the log entries to a logBuffer, at the levels enabled by another core.
+type logCore struct {
+	zapcore.LevelEnabler
+	buf    *logBuffer
+	fields []zapcore.Field
+}
+
+func (c *logCore) With(fields []zapcore.Field) zapcore.Core {
+	return &logCore{LevelEnabler: c.LevelEnabler, buf: c.buf, fields: append(c.fields[:len(c.fields):len(c.fields)], fields...)}
+}
+
+func (c *logCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *logCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	e := LogEntry{Time: ent.Time, Level: ent.Level.String(), Message: ent.Message}
+	if len(enc.Fields) > 0 {
+		e.Fields = enc.Fields
+	}
+	c.buf.add(e)
+	return nil
+}
+
+func (c *logCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package daemon implements a background process owning port forwarding sessions, controlled over a Unix domain
+// socket with a JSON protocol.
+//
+// A client connects to the socket and sends requests, each a JSON Request object on a single line.  The daemon
+// answers each request with a JSON Response object on a single line, in order, until the client closes the
+// connection.  The actions are:
+//
+//   - start: start the port forwarding tunnel described by Request.Tunnel, responding with its TunnelStatus once
+//     the local port is listening (or the tunnel failed).
+//   - stop: stop the tunnel named Request.Name, terminating its session.
+//   - list: respond with the TunnelStatus of all tunnels, ordered by name.
+//   - logs: respond with the last Request.Lines log entries of the tunnel named Request.Name (all the retained
+//     entries if Lines is not positive).
+//   - shutdown: stop all the tunnels and exit the daemon.
+//
+// Example exchange:
+//
+//	{"action":"start","tunnel":{"name":"db","target":"i-0bdb4f892de4bb54c","remoteHost":"db.internal","remotePort":5432,"localPort":5432}}
+//	{"ok":true,"tunnels":[{"name":"db","target":"i-0bdb4f892de4bb54c","remoteHost":"db.internal","remotePort":5432,"localPort":5432,"state":"running",...}]}
+//
+// Tunnels which failed remain listed (with their error and logs) until they are started again or stopped.
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ProtocolVersion is the version of the control protocol, reported in each Response.
+const ProtocolVersion = 1
+
+// The actions of a Request.
+const (
+	ActionStart    = "start"
+	ActionStop     = "stop"
+	ActionList     = "list"
+	ActionLogs     = "logs"
+	ActionShutdown = "shutdown"
+)
+
+// The states of a tunnel.
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateFailed   = "failed"
+	// StateClosed is the state of a tunnel whose session was ended by the service or the agent.
+	StateClosed = "closed"
+)
+
+// Request is a request sent to the daemon.  Tunnel is used by the start action, Name by the stop and logs actions,
+// and Lines by the logs action.
+type Request struct {
+	Action string      `json:"action"`
+	Tunnel *TunnelSpec `json:"tunnel,omitempty"`
+	Name   string      `json:"name,omitempty"`
+	Lines  int         `json:"lines,omitempty"`
+}
+
+// Response is the response of the daemon to a Request.  If OK is false, Error describes why the request failed.
+// Tunnels holds the status of the started tunnel (start action) or of all the tunnels (list action), and Logs
+// holds the log entries of a tunnel (logs action).
+type Response struct {
+	Version int            `json:"version"`
+	OK      bool           `json:"ok"`
+	Error   string         `json:"error,omitempty"`
+	Tunnels []TunnelStatus `json:"tunnels,omitempty"`
+	Logs    []LogEntry     `json:"logs,omitempty"`
+}
+
+// TunnelSpec describes a port forwarding tunnel.  Target is resolved by the daemon like the target of the
+// port-forwarding command.  RemoteHost is optional, connections are forwarded to it through the target if set.
+// LocalPort and BindAddress default to a random port on localhost.
+type TunnelSpec struct {
+	Name        string `json:"name"`
+	Target      string `json:"target"`
+	RemoteHost  string `json:"remoteHost,omitempty"`
+	RemotePort  int    `json:"remotePort"`
+	LocalPort   int    `json:"localPort,omitempty"`
+	BindAddress string `json:"bindAddress,omitempty"`
+}
+
+// TunnelStatus is the status of a tunnel.  InstanceID is the resolved target, and LocalAddress is the address
+// the tunnel listens on, once running.  The byte counts are the session data exchanged with the agent.
+type TunnelStatus struct {
+	TunnelSpec
+	InstanceID    string    `json:"instanceId,omitempty"`
+	SessionID     string    `json:"sessionId,omitempty"`
+	State         string    `json:"state"`
+	Error         string    `json:"error,omitempty"`
+	LocalAddress  string    `json:"localAddress,omitempty"`
+	Started       time.Time `json:"started"`
+	UptimeSeconds float64   `json:"uptimeSeconds"`
+	BytesSent     uint64    `json:"bytesSent"`
+	BytesReceived uint64    `json:"bytesReceived"`
+}
+
+// LogEntry is a log message of a tunnel, with its structured fields.
+type LogEntry struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// DefaultSocketPath returns the path of the daemon socket used if none is configured, in the user runtime
+// directory if there is one, otherwise in the temporary directory with the user ID (if any) in the name.
+func DefaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "ssm-session-client.sock")
+	}
+
+	// the temporary directory is per user on Windows, which has no user IDs
+	if uid := os.Getuid(); uid >= 0 {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("ssm-session-client-%d.sock", uid))
+	}
+	return filepath.Join(os.TempDir(), "ssm-session-client.sock")
+}
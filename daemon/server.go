@@ -0,0 +1,480 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// startTimeout is how long a start request waits for the tunnel to listen before responding with the
+	// starting state.
+	startTimeout = 30 * time.Second
+
+	// maxRequestSize is the maximum length of a request line.
+	maxRequestSize = 1 << 20
+)
+
+var (
+	// ErrDaemonRunning is the error returned by ListenAndServe if a daemon is already listening on the socket.
+	ErrDaemonRunning = errors.New("a daemon is already running")
+	// ErrTunnelNotFound is the error returned when a request names a tunnel the daemon does not have.
+	ErrTunnelNotFound = errors.New("tunnel not found")
+
+	nopLogger = zap.NewNop()
+)
+
+// Server is the daemon, owning the port forwarding sessions of the tunnels started by its clients.  Config is used
+// to start the sessions with ssmclient.PortForwardingSessionContext, and ResolveTarget (if set) to resolve the
+// target of the tunnels to an instance ID.  Logger receives the log of the daemon and its tunnels, which are named
+// after the tunnel.  If not set, a no-op logger is used (the logs of the tunnels are still retained for the logs
+// action).
+type Server struct {
+	Config        aws.Config
+	ResolveTarget func(string) (string, error)
+	Logger        *zap.Logger
+
+	mu      sync.Mutex
+	tunnels map[string]*tunnel
+	lsnr    net.Listener
+	closed  bool
+	stopped chan struct{}
+}
+
+// init creates the state of the server, called with the lock held.
+func (s *Server) init() {
+	if s.tunnels == nil && !s.closed {
+		s.tunnels = make(map[string]*tunnel)
+	}
+	if s.stopped == nil {
+		s.stopped = make(chan struct{})
+	}
+}
+
+func (s *Server) logger() *zap.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return nopLogger
+}
+
+// ListenAndServe listens on the Unix domain socket at path, and serves the requests of the clients until Shutdown
+// is called (or a client sends the shutdown action).  A stale socket file left by a daemon which did not exit
+// cleanly is replaced, ErrDaemonRunning is returned if another daemon is listening on the socket.
+func (s *Server) ListenAndServe(path string) error {
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%w on %s", ErrDaemonRunning, path)
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+
+	lsnr, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	// only the user running the daemon may control it
+	if err = os.Chmod(path, 0o600); err != nil {
+		_ = lsnr.Close()
+		return err
+	}
+
+	return s.Serve(lsnr)
+}
+
+// Serve serves the requests of the clients connecting to the listener, until Shutdown is called.
+func (s *Server) Serve(lsnr net.Listener) error {
+	s.mu.Lock()
+	s.init()
+	stopped := s.stopped
+	if s.closed {
+		s.mu.Unlock()
+		_ = lsnr.Close()
+		<-stopped
+		return nil
+	}
+	s.lsnr = lsnr
+	s.mu.Unlock()
+
+	s.logger().Info("daemon listening", zap.Stringer("addr", lsnr.Addr()))
+	for {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			if s.isClosed() {
+				// wait for the sessions of the tunnels to be terminated
+				<-stopped
+				return nil
+			}
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// Shutdown stops all the tunnels, terminating their sessions, and stops serving clients.  Serve returns once the
+// sessions are terminated.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.init()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.lsnr != nil {
+		_ = s.lsnr.Close()
+	}
+	tunnels := s.tunnels
+	s.tunnels = nil
+	s.mu.Unlock()
+
+	s.logger().Info("daemon shutting down", zap.Int("tunnels", len(tunnels)))
+	var wg sync.WaitGroup
+	for _, t := range tunnels {
+		wg.Add(1)
+		go func(t *tunnel) {
+			defer wg.Done()
+			t.stop()
+		}(t)
+	}
+	wg.Wait()
+	close(s.stopped)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// handleConn serves the requests of a client, one JSON object per line, until the client closes the connection.
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 0, 4096), maxRequestSize)
+	enc := json.NewEncoder(conn)
+
+	for sc.Scan() {
+		resp := new(Response)
+		req := new(Request)
+		if err := json.Unmarshal(sc.Bytes(), req); err != nil {
+			resp.Error = fmt.Sprintf("invalid request: %v", err)
+		} else {
+			resp = s.Do(req)
+		}
+		resp.Version = ProtocolVersion
+
+		if err := enc.Encode(resp); err != nil {
+			s.logger().Debug("client write failed", zap.Error(err))
+			return
+		}
+
+		if resp.OK && req.Action == ActionShutdown {
+			go s.Shutdown()
+			return
+		}
+	}
+}
+
+// Do processes a request, as if sent by a client.
+func (s *Server) Do(req *Request) *Response {
+	resp := new(Response)
+	var err error
+
+	switch req.Action {
+	case ActionStart:
+		var st *TunnelStatus
+		if st, err = s.start(req.Tunnel); st != nil {
+			resp.Tunnels = []TunnelStatus{*st}
+		}
+	case ActionStop:
+		err = s.stop(req.Name)
+	case ActionList:
+		resp.Tunnels = s.list()
+	case ActionLogs:
+		resp.Logs, err = s.logs(req.Name, req.Lines)
+	case ActionShutdown:
+	default:
+		err = fmt.Errorf("unknown action %q", req.Action)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.OK = true
+	}
+	return resp
+}
+
+// start starts the tunnel, and waits for it to listen (or fail) before returning its status.  A failed or closed
+// tunnel with the same name is replaced.
+func (s *Server) start(spec *TunnelSpec) (*TunnelStatus, error) {
+	if spec == nil || spec.Name == "" || spec.Target == "" || spec.RemotePort < 1 {
+		return nil, errors.New("name, target and remotePort are required to start a tunnel")
+	}
+
+	t := newTunnel(*spec, s.logger())
+
+	s.mu.Lock()
+	s.init()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errors.New("the daemon is shutting down")
+	}
+	if old, ok := s.tunnels[spec.Name]; ok && old.active() {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("tunnel %q is already running", spec.Name)
+	}
+	s.tunnels[spec.Name] = t
+	s.mu.Unlock()
+
+	instanceID := spec.Target
+	if s.ResolveTarget != nil {
+		var err error
+		if instanceID, err = s.ResolveTarget(spec.Target); err != nil {
+			t.cancel()
+			s.remove(t)
+			return nil, fmt.Errorf("tunnel %q: %w", spec.Name, err)
+		}
+	}
+
+	t.run(s.Config, instanceID)
+
+	select {
+	case <-t.readyCh:
+	case <-t.done:
+	case <-time.After(startTimeout):
+	}
+
+	st := t.status()
+	if st.State == StateFailed {
+		return &st, fmt.Errorf("tunnel %q: %s", spec.Name, st.Error)
+	}
+	return &st, nil
+}
+
+// stop stops the tunnel and forgets it.
+func (s *Server) stop(name string) error {
+	s.mu.Lock()
+	t, ok := s.tunnels[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrTunnelNotFound, name)
+	}
+
+	t.stop()
+	s.remove(t)
+	return nil
+}
+
+// remove forgets the tunnel, unless it was replaced by another tunnel with the same name.
+func (s *Server) remove(t *tunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnels[t.spec.Name] == t {
+		delete(s.tunnels, t.spec.Name)
+	}
+}
+
+func (s *Server) list() []TunnelStatus {
+	s.mu.Lock()
+	all := make([]TunnelStatus, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		all = append(all, t.status())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
+
+func (s *Server) logs(name string, lines int) ([]LogEntry, error) {
+	s.mu.Lock()
+	t, ok := s.tunnels[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrTunnelNotFound, name)
+	}
+	return t.logs.last(lines), nil
+}
+
+// errStopped is the error of a tunnel stopped before its session started.
+var errStopped = errors.New("the tunnel was stopped before it started")
+
+// tunnel is a port forwarding session run by the daemon.  The context of the session is created with the tunnel,
+// so the tunnel can be stopped before the session starts.
+type tunnel struct {
+	spec    TunnelSpec
+	log     *zap.Logger
+	logs    *logBuffer
+	ctx     context.Context
+	cancel  context.CancelFunc
+	readyCh chan struct{}
+	done    chan struct{}
+
+	mu         sync.Mutex
+	instanceID string
+	state      string
+	err        error
+	addr       string
+	dc         *datachannel.SsmDataChannel
+	running    bool
+	started    time.Time
+	ended      time.Time
+}
+
+// newTunnel creates a tunnel, logging to the daemon logger (named after the tunnel) and to its log buffer.
+func newTunnel(spec TunnelSpec, base *zap.Logger) *tunnel {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &tunnel{
+		spec:    spec,
+		logs:    newLogBuffer(),
+		ctx:     ctx,
+		cancel:  cancel,
+		readyCh: make(chan struct{}),
+		done:    make(chan struct{}),
+		state:   StateStarting,
+		started: time.Now(),
+	}
+
+	// the logs are retained at the levels of the daemon logger, or from the info level if it is disabled
+	core := base.Core()
+	var enabler zapcore.LevelEnabler = core
+	if !core.Enabled(zapcore.FatalLevel) {
+		enabler = zapcore.InfoLevel
+	}
+	t.log = zap.New(zapcore.NewTee(core, &logCore{LevelEnabler: enabler, buf: t.logs})).Named(spec.Name)
+	return t
+}
+
+// run starts the session of the tunnel in the background, unless the tunnel was stopped.
+func (t *tunnel) run(cfg aws.Config, instanceID string) {
+	ctx := t.ctx
+
+	// stop cancels the context with the lock held, so either the session is not started, or stop waits for it
+	t.mu.Lock()
+	t.instanceID = instanceID
+	if ctx.Err() != nil {
+		t.state = StateFailed
+		t.err = errStopped
+		t.ended = time.Now()
+		t.mu.Unlock()
+		close(t.done)
+		return
+	}
+	t.running = true
+	t.mu.Unlock()
+
+	in := &ssmclient.PortForwardingInput{
+		Target:      instanceID,
+		RemotePort:  t.spec.RemotePort,
+		LocalPort:   t.spec.LocalPort,
+		BindAddress: t.spec.BindAddress,
+		Host:        t.spec.RemoteHost,
+		Logger:      t.log,
+		ListeningHandler: func(addr net.Addr, c *datachannel.SsmDataChannel) {
+			t.mu.Lock()
+			t.state = StateRunning
+			t.addr = addr.String()
+			t.dc = c
+			t.mu.Unlock()
+			close(t.readyCh)
+		},
+	}
+
+	go func() {
+		defer close(t.done)
+		err := ssmclient.PortForwardingSessionContext(ctx, cfg, in)
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.ended = time.Now()
+		switch {
+		case err != nil:
+			t.state = StateFailed
+			t.err = err
+			t.log.Error("tunnel failed", zap.Error(err))
+		case ctx.Err() == nil:
+			t.state = StateClosed
+			t.log.Info("tunnel closed by the service")
+		}
+	}()
+}
+
+// stop ends the session of the tunnel, and waits for it to finish.
+func (t *tunnel) stop() {
+	t.mu.Lock()
+	t.cancel()
+	running := t.running
+	t.mu.Unlock()
+
+	if running {
+		select {
+		case <-t.done:
+		case <-time.After(startTimeout):
+			t.log.Warn("timed out waiting for the session to terminate")
+		}
+	}
+	t.log.Info("tunnel stopped")
+}
+
+// active returns true if the tunnel session has not ended.
+func (t *tunnel) active() bool {
+	select {
+	case <-t.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (t *tunnel) status() TunnelStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := TunnelStatus{
+		TunnelSpec:   t.spec,
+		InstanceID:   t.instanceID,
+		State:        t.state,
+		LocalAddress: t.addr,
+		Started:      t.started,
+	}
+
+	if t.err != nil {
+		st.Error = t.err.Error()
+	}
+
+	end := time.Now()
+	if !t.ended.IsZero() {
+		end = t.ended
+	}
+	st.UptimeSeconds = end.Sub(t.started).Seconds()
+
+	if t.dc != nil {
+		stats := t.dc.Stats()
+		st.SessionID = stats.SessionID
+		st.BytesSent = stats.BytesSent
+		st.BytesReceived = stats.BytesReceived
+	}
+	return st
+}
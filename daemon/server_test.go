@@ -0,0 +1,223 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel/ssmtest"
+)
+
+const testTarget = "i-0123456789abcdef0"
+
+// startTestDaemon serves a daemon on a socket in a temporary directory, with its tunnels started against an
+// ssmtest server.  The daemon is shut down at the end of the test.
+func startTestDaemon(t *testing.T, resolve func(string) (string, error)) (*ssmtest.Server, string) {
+	t.Helper()
+
+	srv := ssmtest.NewServer(nil)
+	t.Cleanup(srv.Close)
+
+	s := &Server{Config: srv.AWSConfig(), ResolveTarget: resolve}
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ListenAndServe(path)
+	}()
+
+	t.Cleanup(func() {
+		s.Shutdown()
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	})
+
+	waitFor(t, func() bool {
+		c, err := Dial(path)
+		if err != nil {
+			return false
+		}
+		_ = c.Close()
+		return true
+	})
+	return srv, path
+}
+
+func dialTestDaemon(t *testing.T, path string) *Client {
+	t.Helper()
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// waitFor polls the condition until it is true, failing the test after 10 seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func testSpec(name string) *TunnelSpec {
+	return &TunnelSpec{Name: name, Target: testTarget, RemotePort: 5432, BindAddress: "127.0.0.1"}
+}
+
+func TestServerTunnels(t *testing.T) {
+	srv, path := startTestDaemon(t, nil)
+	c := dialTestDaemon(t, path)
+
+	st, err := c.Start(testSpec("db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.State != StateRunning || st.LocalAddress == "" || st.InstanceID != testTarget || st.SessionID == "" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	// the tunnel forwards connections to the agent
+	conn, err := net.Dial("tcp", st.LocalAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := bytes.Repeat([]byte("x"), 4096)
+	go func() { _, _ = conn.Write(want) }()
+	got := make([]byte, len(want))
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err = io.ReadFull(conn, got); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("the echoed data does not match the data sent: %v", err)
+	}
+
+	if _, err = c.Start(testSpec("db")); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("expected an error starting a duplicate tunnel, got %v", err)
+	}
+
+	if _, err = c.Start(testSpec("web")); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Name != "db" || all[1].Name != "web" {
+		t.Errorf("unexpected tunnels %+v", all)
+	}
+
+	logs, err := c.Logs("db", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].Message == "" {
+		t.Errorf("unexpected logs %+v", logs)
+	}
+
+	if err = c.Stop("db"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, srv.Sessions()[0].Terminated)
+
+	if all, err = c.List(); err != nil || len(all) != 1 || all[0].Name != "web" {
+		t.Errorf("unexpected tunnels after stop %+v: %v", all, err)
+	}
+
+	for _, err = range []error{c.Stop("db"), logsErr(c, "db")} {
+		if err == nil || !strings.Contains(err.Error(), ErrTunnelNotFound.Error()) {
+			t.Errorf("expected a tunnel not found error, got %v", err)
+		}
+	}
+}
+
+func logsErr(c *Client, name string) error {
+	_, err := c.Logs(name, 0)
+	return err
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv, path := startTestDaemon(t, nil)
+	c := dialTestDaemon(t, path)
+
+	for _, name := range []string{"db", "web"} {
+		if _, err := c.Start(testSpec(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sess := range srv.Sessions() {
+		waitFor(t, sess.Terminated)
+	}
+
+	waitFor(t, func() bool {
+		d, err := Dial(path)
+		if err == nil {
+			_ = d.Close()
+		}
+		return errors.Is(err, ErrDaemonNotRunning)
+	})
+}
+
+func TestServerStopWhileStarting(t *testing.T) {
+	for _, action := range []string{ActionStop, ActionShutdown} {
+		t.Run(action, func(t *testing.T) {
+			resolving := make(chan struct{})
+			release := make(chan struct{})
+			srv, path := startTestDaemon(t, func(target string) (string, error) {
+				close(resolving)
+				<-release
+				return target, nil
+			})
+
+			errCh := make(chan error, 1)
+			go func() {
+				c, err := Dial(path)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				defer c.Close()
+
+				_, err = c.Start(testSpec("db"))
+				errCh <- err
+			}()
+
+			// the tunnel is stopped while its target is resolved, before the session is started
+			<-resolving
+			c := dialTestDaemon(t, path)
+			if _, err := c.Do(&Request{Action: action, Name: "db"}); err != nil {
+				t.Fatal(err)
+			}
+			close(release)
+
+			select {
+			case err := <-errCh:
+				if err == nil || !strings.Contains(err.Error(), errStopped.Error()) {
+					t.Errorf("expected the stopped error, got %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the start request did not complete")
+			}
+
+			if n := len(srv.Sessions()); n != 0 {
+				t.Errorf("%d sessions were started for the stopped tunnel", n)
+			}
+		})
+	}
+}
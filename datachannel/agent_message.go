@@ -11,7 +11,62 @@ import (
 	"time"
 )
 
-const agentMsgHeaderLen = 116 // the binary size of all AgentMessage fields except payloadLength and Payload
+const (
+	agentMsgHeaderLen     = 116 // the binary size of all AgentMessage fields except payloadLength and Payload
+	agentMsgSchemaVersion = 1   // the only message schema version defined by the agent
+	payloadDigestOffset   = 80  // the offset of the payload digest in the message header
+)
+
+var (
+	// ErrMessageTooShort is the error returned when the message data is shorter than the message header, or the
+	// header length it declares.
+	ErrMessageTooShort = errors.New("message too short")
+	// ErrInvalidHeaderLength is the error returned when the message header length is not one of the known values.
+	ErrInvalidHeaderLength = errors.New("invalid message header length")
+	// ErrInvalidSchemaVersion is the error returned when the message schema version is not supported.
+	ErrInvalidSchemaVersion = errors.New("invalid schema version")
+	// ErrInvalidMessageType is the error returned when the message type field is malformed.
+	ErrInvalidMessageType = errors.New("invalid message type")
+	// ErrInvalidMessageDate is the error returned when the message created date is not set.
+	ErrInvalidMessageDate = errors.New("invalid message date")
+	// ErrPayloadLength is the error returned when the payload length field does not match the payload data.
+	ErrPayloadLength = errors.New("payload length mismatch")
+	// ErrDigestMismatch is the error returned when the SHA-256 digest of the payload does not match the digest in
+	// the message header.
+	ErrDigestMismatch = errors.New("payload digest mismatch")
+	// ErrUnknownMessageType is the error reported for a valid message of a type the data channel does not know.
+	ErrUnknownMessageType = errors.New("unknown message type")
+	// ErrUnknownPayloadType is the error reported for a valid message with a payload type the data channel does
+	// not know.
+	ErrUnknownPayloadType = errors.New("unknown payload type")
+)
+
+// MessageError is the error returned for an invalid or unsupported message.  Err is one of the Err* values of the
+// package, so the cause can be checked with errors.Is(), the other fields describe the message (as far as it
+// could be read).
+type MessageError struct {
+	Err            error
+	MessageType    MessageType
+	PayloadType    PayloadType
+	SequenceNumber int64
+	Detail         string
+}
+
+func (e *MessageError) Error() string {
+	sb := new(strings.Builder)
+	sb.WriteString(e.Err.Error())
+	if e.MessageType != "" {
+		sb.WriteString(fmt.Sprintf(" (type: %s, payload type: %s, sequence: %d)", e.MessageType, e.PayloadType, e.SequenceNumber))
+	}
+	if e.Detail != "" {
+		sb.WriteString(": " + e.Detail)
+	}
+	return sb.String()
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
 
 // AgentMessage is the structural representation of the binary format of an SSM agent message use for communication
 // between local clients (like this), and remote agents installed on EC2 instances.
@@ -42,65 +97,99 @@ func NewAgentMessage() *AgentMessage {
 	}
 }
 
-// ValidateMessage performs checks on the values of the AgentMessage to ensure they are sane.
+// ValidateMessage performs checks on the values of the AgentMessage to ensure they are sane.  The error returned
+// for an invalid message is a *MessageError, wrapping one of the ErrInvalid*, ErrPayloadLength or
+// ErrDigestMismatch errors.
 func (m *AgentMessage) ValidateMessage() error {
 	// close_channel message header is 112 bytes
 	if m.headerLength > agentMsgHeaderLen || m.headerLength < agentMsgHeaderLen-4 {
-		return errors.New("invalid message header length")
+		return m.messageError(ErrInvalidHeaderLength, "header length %d", m.headerLength)
 	}
 
-	if m.schemaVersion < 1 {
-		return errors.New("invalid schema version")
+	if m.schemaVersion < 1 || m.schemaVersion > agentMsgSchemaVersion {
+		return m.messageError(ErrInvalidSchemaVersion, "schema version %d", m.schemaVersion)
 	}
 
 	// this seems to be a good minimum number after checking the SSM agent source code
 	if len(m.MessageType) < 10 {
-		return errors.New("invalid message type")
+		return m.messageError(ErrInvalidMessageType, "message type %q", m.MessageType)
 	}
 
 	if m.createdDate.IsZero() {
-		return errors.New("invalid message date")
-	}
-
-	if len(m.messageID[:]) != 16 {
-		return errors.New("invalid message id")
+		return m.messageError(ErrInvalidMessageDate, "")
 	}
 
 	if len(m.Payload) != int(m.payloadLength) {
-		return fmt.Errorf("payload length mismatch, WANT: %d, GOT: %d", m.payloadLength, len(m.Payload))
+		return m.messageError(ErrPayloadLength, "WANT: %d, GOT: %d", m.payloadLength, len(m.Payload))
 	}
 
-	if !bytes.Equal(m.sha256PayloadDigest(), m.payloadDigest) {
-		return errors.New("payload digest mismatch")
+	// compare without updating the digest field, which holds the value received in the message header
+	digest := sha256.Sum256(m.Payload)
+	if !bytes.Equal(digest[:], m.payloadDigest) {
+		return m.messageError(ErrDigestMismatch, "")
 	}
 
 	return nil
 }
 
 // UnmarshalBinary reads the wire format data and updates the fields in the method receiver.  Satisfies the
-// encoding.BinaryUnmarshaler interface.
+// encoding.BinaryUnmarshaler interface.  The data must hold exactly one message, the header and payload lengths
+// are checked against the size of the data before they are used, and the payload digest is verified.
 func (m *AgentMessage) UnmarshalBinary(data []byte) error {
+	// the shortest message is a channel_closed message with an empty payload
+	if len(data) < agentMsgHeaderLen {
+		return &MessageError{Err: ErrMessageTooShort, Detail: fmt.Sprintf("%d bytes", len(data))}
+	}
+
 	m.headerLength = binary.BigEndian.Uint32(data)
 	m.MessageType = parseMessageType(data[4:36])
 	m.schemaVersion = binary.BigEndian.Uint32(data[36:40])
 	m.createdDate = parseTime(data[40:48])
 	m.SequenceNumber = int64(binary.BigEndian.Uint64(data[48:56]))
 	m.Flags = AgentMessageFlag(binary.BigEndian.Uint64(data[56:64]))
-	m.messageID = uuid.Must(uuid.FromBytes(formatUUIDBytes(data[64:80])))
-	m.payloadDigest = data[80 : 80+sha256.Size]
+	m.messageID, _ = uuid.FromBytes(formatUUIDBytes(data[64:80])) // always 16 bytes, can't fail
+	m.payloadDigest = data[payloadDigestOffset : payloadDigestOffset+sha256.Size]
+
+	if m.headerLength > agentMsgHeaderLen || m.headerLength < agentMsgHeaderLen-4 {
+		return m.messageError(ErrInvalidHeaderLength, "header length %d", m.headerLength)
+	}
+
+	// the header is followed by the 4 byte payload length
+	payloadLenEnd := int(m.headerLength) + 4
+	if len(data) < payloadLenEnd {
+		return m.messageError(ErrMessageTooShort, "%d bytes, header length %d", len(data), m.headerLength)
+	}
 
 	// The channel_closed message has a header length of 112 bytes, assuming this is what's dropped
 	if m.headerLength == agentMsgHeaderLen {
 		m.PayloadType = PayloadType(binary.BigEndian.Uint32(data[112:m.headerLength]))
 	}
 
-	payloadLenEnd := m.headerLength + 4
 	m.payloadLength = binary.BigEndian.Uint32(data[m.headerLength:payloadLenEnd])
-	m.Payload = data[payloadLenEnd : payloadLenEnd+m.payloadLength]
+	if uint64(len(data)-payloadLenEnd) != uint64(m.payloadLength) {
+		return m.messageError(ErrPayloadLength, "payload length %d, message payload data %d bytes",
+			m.payloadLength, len(data)-payloadLenEnd)
+	}
+	m.Payload = data[payloadLenEnd:]
 
 	return m.ValidateMessage()
 }
 
+// messageError creates the MessageError for an invalid or unsupported message.
+func (m *AgentMessage) messageError(err error, format string, args ...interface{}) *MessageError {
+	e := &MessageError{
+		Err:            err,
+		MessageType:    m.MessageType,
+		PayloadType:    m.PayloadType,
+		SequenceNumber: m.SequenceNumber,
+	}
+
+	if format != "" {
+		e.Detail = fmt.Sprintf(format, args...)
+	}
+	return e
+}
+
 // MarshalBinary converts the fields in the method receiver to the expected wire format used by the websocket
 // protocol with the SSM messaging service.  Satisfies the encoding.BinaryMarshaler interface.
 func (m *AgentMessage) MarshalBinary() ([]byte, error) {
@@ -122,7 +211,7 @@ func (m *AgentMessage) MarshalBinary() ([]byte, error) {
 	if err := binary.Write(buf, binary.BigEndian, m.schemaVersion); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(buf, binary.BigEndian, time.Duration(m.createdDate.UnixNano()).Milliseconds()); err != nil {
+	if err := binary.Write(buf, binary.BigEndian, m.createdDate.UnixMilli()); err != nil {
 		return nil, err
 	}
 	if err := binary.Write(buf, binary.BigEndian, m.SequenceNumber); err != nil {
@@ -138,7 +227,10 @@ func (m *AgentMessage) MarshalBinary() ([]byte, error) {
 	if err := binary.Write(buf, binary.BigEndian, m.payloadDigest[:sha256.Size]); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(buf, binary.BigEndian, m.PayloadType); err != nil {
+	// the payload type is the end of the header, which is absent from the shorter channel_closed message header
+	payloadType := make([]byte, 4)
+	binary.BigEndian.PutUint32(payloadType, uint32(m.PayloadType))
+	if err := binary.Write(buf, binary.BigEndian, payloadType[:m.headerLength-(agentMsgHeaderLen-4)]); err != nil {
 		return nil, err
 	}
 	if err := binary.Write(buf, binary.BigEndian, m.payloadLength); err != nil {
@@ -191,11 +283,14 @@ func parseMessageType(data []byte) MessageType {
 }
 
 func parseTime(data []byte) time.Time {
-	ts := binary.BigEndian.Uint64(data)
-	d := time.Duration(ts) * time.Millisecond
-	return time.Unix(0, d.Nanoseconds())
+	// milliseconds, without the overflow of time.Duration for dates after 2262
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(data)))
 }
 
+// formatUUIDBytes swaps the 8 byte halves of the UUID, into a new slice (appending to data[8:] would overwrite the
+// bytes following the UUID in the message data).
 func formatUUIDBytes(data []byte) []byte {
-	return append(data[8:], data[:8]...)
+	out := make([]byte, 0, 16)
+	out = append(out, data[8:16]...)
+	return append(out, data[:8]...)
 }
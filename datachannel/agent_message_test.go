@@ -0,0 +1,145 @@
+package datachannel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// marshalTestMessage returns the wire format of a valid output_stream_data message with the payload.
+func marshalTestMessage(t testing.TB, payload []byte) []byte {
+	t.Helper()
+	m := NewAgentMessage()
+	m.MessageType = OutputStreamData
+	m.SequenceNumber = 7
+	m.Flags = 3
+	m.PayloadType = Output
+	m.Payload = payload
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	valid := marshalTestMessage(t, []byte("hello"))
+
+	for _, tc := range []struct {
+		name   string
+		modify func([]byte) []byte
+		err    error
+	}{
+		{"valid", func(b []byte) []byte { return b }, nil},
+		{"shorter than header", func(b []byte) []byte { return b[:agentMsgHeaderLen-1] }, ErrMessageTooShort},
+		{"no payload length", func(b []byte) []byte { return b[:agentMsgHeaderLen+2] }, ErrMessageTooShort},
+		{"header length too long", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b, agentMsgHeaderLen+1)
+			return b
+		}, ErrInvalidHeaderLength},
+		{"header length too short", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b, agentMsgHeaderLen-5)
+			return b
+		}, ErrInvalidHeaderLength},
+		{"payload length too long", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[agentMsgHeaderLen:], 6)
+			return b
+		}, ErrPayloadLength},
+		{"trailing data", func(b []byte) []byte { return append(b, 0) }, ErrPayloadLength},
+		{"schema version", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[36:], agentMsgSchemaVersion+1)
+			return b
+		}, ErrInvalidSchemaVersion},
+		{"no schema version", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[36:], 0)
+			return b
+		}, ErrInvalidSchemaVersion},
+		{"payload digest", func(b []byte) []byte {
+			b[len(b)-1] ^= 0xff
+			return b
+		}, ErrDigestMismatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.modify(append([]byte(nil), valid...))
+
+			err := new(AgentMessage).UnmarshalBinary(data)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+
+			var msgErr *MessageError
+			if tc.err != nil && !errors.As(err, &msgErr) {
+				t.Errorf("expected a *MessageError, got %T", err)
+			}
+		})
+	}
+}
+
+// channelClosedMessage returns the wire format of a channel_closed message, which has a 112 byte header without
+// the payload type.
+func channelClosedMessage(t testing.TB) []byte {
+	t.Helper()
+	data := marshalTestMessage(t, []byte(`{"Output":""}`))
+	closed := append([]byte(nil), data[:agentMsgHeaderLen-4]...)
+	closed = append(closed, data[agentMsgHeaderLen:]...)
+	binary.BigEndian.PutUint32(closed, agentMsgHeaderLen-4)
+	return closed
+}
+
+func TestUnmarshalBinaryChannelClosed(t *testing.T) {
+	m := new(AgentMessage)
+	if err := m.UnmarshalBinary(channelClosedMessage(t)); err != nil {
+		t.Fatal(err)
+	}
+	if m.PayloadType != Undefined || string(m.Payload) != `{"Output":""}` {
+		t.Errorf("unexpected message %v", m)
+	}
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	f.Add(marshalTestMessage(f, nil))
+	f.Add(marshalTestMessage(f, []byte("hello")))
+	f.Add(marshalTestMessage(f, bytes.Repeat([]byte{0xff}, 1024)))
+	f.Add(channelClosedMessage(f))
+
+	// a created date out of the range of time.Duration
+	data := marshalTestMessage(f, []byte("hello"))
+	binary.BigEndian.PutUint64(data[40:], 1<<62+7)
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := new(AgentMessage)
+		if err := m.UnmarshalBinary(data); err != nil {
+			var msgErr *MessageError
+			if !errors.As(err, &msgErr) {
+				t.Fatalf("expected a *MessageError, got %T: %v", err, err)
+			}
+			return
+		}
+
+		// a valid message must marshal to data holding the same message
+		out, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("marshal of a valid message failed: %v", err)
+		}
+
+		m2 := new(AgentMessage)
+		if err = m2.UnmarshalBinary(out); err != nil {
+			t.Fatalf("unmarshal of a marshaled message failed: %v", err)
+		}
+
+		// the bytes of the payload type are only kept if the header holds all of it (or none, for channel_closed)
+		if (m.headerLength == agentMsgHeaderLen || m.headerLength == agentMsgHeaderLen-4) && !bytes.Equal(out, data) {
+			t.Fatalf("round trip changed the message data\n%x\n%x", data, out)
+		}
+
+		if m2.headerLength != m.headerLength || m2.MessageType != m.MessageType ||
+			m2.schemaVersion != m.schemaVersion || !m2.createdDate.Equal(m.createdDate) ||
+			m2.SequenceNumber != m.SequenceNumber || m2.Flags != m.Flags || m2.messageID != m.messageID ||
+			m2.PayloadType != m.PayloadType || !bytes.Equal(m2.Payload, m.Payload) {
+			t.Fatalf("round trip changed the message\n%v\n%v", m, m2)
+		}
+	})
+}
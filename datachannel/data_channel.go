@@ -3,6 +3,7 @@ package datachannel
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -10,11 +11,15 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -24,7 +29,13 @@ import (
 // DataChannel is the interface definition for handling communication with the AWS SSM messaging service.
 type DataChannel interface {
 	Open(aws.Config, *ssm.StartSessionInput, *SSMMessagesResover) error
+	OpenContext(context.Context, aws.Config, *ssm.StartSessionInput, *SSMMessagesResover) error
+	Reconnect() error
+	ReadContext(ctx context.Context, data []byte) (int, error)
+	ReadMessage() (*AgentMessage, error)
+	ReadMessageContext(ctx context.Context) (*AgentMessage, error)
 	HandleMsg(data []byte) ([]byte, error)
+	HandleMessage(m *AgentMessage) ([]byte, error)
 	SetTerminalSize(rows, cols uint32) error
 	TerminateSession() error
 	DisconnectPort() error
@@ -36,24 +47,98 @@ type DataChannel interface {
 
 // SsmDataChannel represents the data channel of the websocket connection used to communicate with the AWS
 // SSM service.  A new(SsmDataChannel) is ready for use, and should immediately call the Open() method.
+// The KMSClient field may be set before calling Open() to override the client used to generate the data
+// key when the session requires KMS encryption, otherwise a client is created from the aws.Config.  If the
+// ReconnectPolicy field is set, a lost websocket connection is automatically resumed during Read().  The
+// RetransmitPolicy field may be set before calling Open() to tune the retransmission of unacknowledged messages.
+// Setting the KeepAlivePolicy field before calling Open() enables websocket keepalive, and the detection of
+// dead connections.  The Dialer field may be set to configure the websocket connection (for example, to use a
+// proxy), otherwise websocket.DefaultDialer is used.  If the Tracer field is set, every message sent and received
+// is written to the protocol trace.  The stderr output of the session is written to the Stderr field, or logged if
+// it is not set.  The ConnectToPortErrorHandler function, if set, is called when the agent reports that it failed
+// to connect to the remote port of a port forwarding session (it is called from the goroutine reading the data
+// channel, and must not block).  The OnClose function, if set, is called once by the first call to Close().
+// The CustomerMessage of the handshake is written to Stderr as a banner.  Protocol
+// events are logged to the Logger field (with the target and session ID, and the message sequence number and types
+// as structured fields), nothing is logged if it is not set.
 type SsmDataChannel struct {
-	seqNum      int64
-	inSeqNum    int64
-	mu          sync.Mutex
-	ws          *websocket.Conn
-	synSent     bool
-	handshakeCh chan bool
-	pausePub    bool
-	outMsgBuf   MessageBuffer
-	inMsgBuf    MessageBuffer
-	lastRows    uint32
-	lastCols    uint32
+	KMSClient        KMSClient
+	ReconnectPolicy  *ReconnectPolicy
+	RetransmitPolicy *RetransmitPolicy
+	KeepAlivePolicy  *KeepAlivePolicy
+	Dialer           *websocket.Dialer
+	Tracer           *Tracer
+	Stderr           io.Writer
+	Logger           *zap.Logger
+
+	ConnectToPortErrorHandler func()
+	OnClose                   func()
+
+	seqNum       int64 // the sequence number of the next message of the client stream
+	mu           sync.Mutex
+	ws           *websocket.Conn
+	handshakeCh  chan bool
+	pausePub     bool
+	outMsgBuf    MessageBuffer
+	inMsgBuf     *reorderBuffer
+	lastRows     uint32
+	lastCols     uint32
+	handshake    HandshakeInfo
+	sessionID    string
+	targetID     string
+	sessionState string
+	exitCode     *int
+	encrypter    atomic.Pointer[encrypter] // set by the read goroutine during the handshake, read by Write
+
+	ssmClient     *ssm.Client
+	resolver      *SSMMessagesResover
+	reconnecting  bool
+	closed        bool
+	channelClosed bool
+
+	rtx   *retransmitter
+	err   error
+	stats channelStats
+	log   sessionLogger
+
+	// pendingFrame holds the message which did not fit in the buffer passed to Read
+	readMu       sync.Mutex
+	pendingFrame *bytes.Buffer
+
+	// output holds the session output not yet returned by ReadOutput (or WriteTo), outputEOF is set once the
+	// channel is closed
+	outputMu  sync.Mutex
+	output    []byte
+	outputEOF bool
+}
+
+const (
+	// maxPooledFrameSize is the capacity above which a frame buffer is released instead of returned to the pool,
+	// so an occasional large message doesn't pin memory.
+	maxPooledFrameSize = 64 * 1024
+)
+
+// framePool holds the buffers websocket messages are read into, which are recycled once the message is decoded.
+var framePool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getFrame() *bytes.Buffer {
+	buf := framePool.Get().(*bytes.Buffer) //nolint:forcetypeassert // the pool only holds *bytes.Buffer
+	buf.Reset()
+	return buf
+}
+
+func putFrame(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledFrameSize {
+		framePool.Put(buf)
+	}
 }
 
 func StreamEndpointOverride(resolver *SSMMessagesResover, output *ssm.StartSessionOutput) error {
 	//get the endpoint from the config
 
-	if resolver.Endpoint != "" {
+	if resolver != nil && resolver.Endpoint != "" {
 		//replace the hostname part of the stream url with the vpc endpoint
 		parsedUrl, err := url.Parse(*output.StreamUrl)
 		if err != nil {
@@ -68,109 +153,343 @@ func StreamEndpointOverride(resolver *SSMMessagesResover, output *ssm.StartSessi
 
 // Open creates the web socket connection with the AWS service and opens the data channel.
 func (c *SsmDataChannel) Open(cfg aws.Config, in *ssm.StartSessionInput, resolver *SSMMessagesResover) error {
+	return c.OpenContext(context.Background(), cfg, in, resolver)
+}
+
+// OpenContext is Open with a context, which bounds the StartSession API call and the websocket connection
+// setup.  The context is not retained after OpenContext returns.
+func (c *SsmDataChannel) OpenContext(ctx context.Context, cfg aws.Config, in *ssm.StartSessionInput, resolver *SSMMessagesResover) error {
 	c.handshakeCh = make(chan bool, 1)
-	c.outMsgBuf = NewMessageBuffer(50)
-	c.inMsgBuf = NewMessageBuffer(50)
+	c.outMsgBuf = NewMessageBuffer(sendWindowMessages, sendWindowBytes)
+	c.inMsgBuf = newReorderBuffer(receiveWindowMessages)
+	c.targetID = aws.ToString(in.Target)
+
+	if c.KMSClient == nil {
+		c.KMSClient = kms.NewFromConfig(cfg)
+	}
 
+	policy := DefaultRetransmitPolicy
+	if c.RetransmitPolicy != nil {
+		policy = *c.RetransmitPolicy
+	}
+	c.rtx = newRetransmitter(policy, realClock{})
 	go c.processOutboundQueue()
 
-	return c.startSession(cfg, in, resolver)
+	if c.idleTimeout() > 0 {
+		go c.processKeepAlive(*c.KeepAlivePolicy, c.rtx.done)
+	}
+
+	return c.startSession(ctx, cfg, in, resolver)
 }
 
 // Close shuts down the web socket connection with the AWS service. Type-specific actions (like sending
 // TerminateSession for port forwarding should be handled before calling Close().
 func (c *SsmDataChannel) Close() error {
+	c.mu.Lock()
+	first := !c.closed
+	c.closed = true
+
+	if c.rtx != nil {
+		c.rtx.stop()
+	}
+
+	if c.outMsgBuf != nil {
+		c.outMsgBuf.Close()
+	}
+
 	var err error
 	if c.ws != nil {
 		err = c.ws.Close()
 	}
+	c.mu.Unlock()
+
+	// called without the lock, OnClose may use the data channel
+	if first && c.OnClose != nil {
+		c.OnClose()
+	}
 	return err
 }
 
 // WaitForHandshakeComplete blocks further processing until the required SSM handshake sequence used for
 // port-based clients (including ssh) completes.
 func (c *SsmDataChannel) WaitForHandshakeComplete() error {
-	buf := make([]byte, 4096)
+	return c.WaitForHandshakeCompleteContext(context.Background())
+}
 
+// WaitForHandshakeCompleteContext is WaitForHandshakeComplete with a context, use a context with a deadline
+// to limit the time allowed for the handshake.  The context error is returned if the handshake does not
+// complete before the context is done, the data channel should be closed in that case.
+func (c *SsmDataChannel) WaitForHandshakeCompleteContext(ctx context.Context) error {
 	for {
 		select {
 		case <-c.handshakeCh:
-			// make stream unbuffered
-			c.inMsgBuf = nil
-			c.outMsgBuf = nil
+			// the stream stays buffered, so data is delivered in order and re-sent until acknowledged
 			c.handshakeCh = nil
 			return nil
 		default:
-			n, err := c.Read(buf)
+			m, err := c.ReadMessageContext(ctx)
 			if err != nil {
 				return err
 			}
 
-			if _, err = c.HandleMsg(buf[:n]); err != nil {
+			// output received with the handshake messages (for input sent before the handshake) is kept for the
+			// next read
+			payload, err := c.HandleMessageContext(ctx, m)
+			if len(payload) > 0 {
+				c.outputMu.Lock()
+				c.output = append(c.output, payload...)
+				c.outputMu.Unlock()
+			}
+
+			if err != nil {
 				return err
 			}
 		}
 	}
 }
 
-// Read will get a single message from the websocket connection. The unprocessed message is copied to the
-// requested []byte (which should be sized to handle at least 1536 bytes).
+// Read returns the next message read from the websocket connection in its wire format, which is processed with
+// HandleMsg.  Each call returns a whole message, if the provided []byte is smaller than the message
+// io.ErrShortBuffer is returned, and the message is returned by the next call.  A message shorter than the message
+// header is discarded, and a *MessageError returned.  Use ReadOutput to read the session output as a stream of
+// bytes instead, or ReadMessage to read decoded messages.  If a ReconnectPolicy is configured, errors reading
+// from the websocket will attempt to resume the session before returning the error.
 func (c *SsmDataChannel) Read(data []byte) (int, error) {
-	_, msg, err := c.ws.ReadMessage()
-	n := copy(data[:len(msg)], msg)
+	return c.ReadContext(context.Background(), data)
+}
+
+// ReadContext is Read with a context, which bounds the wait for the next message (and any reconnect attempts).
+// If the context is done before a message is read, the context error is returned.  The websocket connection
+// can not be read after an interrupted read, so the data channel should be closed in that case.
+func (c *SsmDataChannel) ReadContext(ctx context.Context, data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, nil
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.pendingFrame == nil {
+		frame, err := c.readFrame(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		if frame.Len() < agentMsgHeaderLen {
+			err = &MessageError{Err: ErrMessageTooShort, Detail: fmt.Sprintf("%d bytes", frame.Len())}
+			c.traceInvalid(frame.Bytes(), err)
+			putFrame(frame)
+			return 0, err
+		}
+		c.pendingFrame = frame
+	}
+
+	if len(data) < c.pendingFrame.Len() {
+		return 0, io.ErrShortBuffer
+	}
+
+	n := copy(data, c.pendingFrame.Bytes())
+	putFrame(c.pendingFrame)
+	c.pendingFrame = nil
+	return n, nil
+}
+
+// ReadOutput returns the output of the session as a stream of bytes, the (decrypted) payloads of the output
+// messages which WriteTo writes.  All other messages are processed like HandleMessage does, io.EOF is returned
+// once the agent has closed the channel (after the final output of the channel_closed message).  A payload larger
+// than the provided []byte is returned over multiple calls.
+func (c *SsmDataChannel) ReadOutput(data []byte) (int, error) {
+	return c.ReadOutputContext(context.Background(), data)
+}
+
+// ReadOutputContext is ReadOutput with a context, which bounds the wait for the next message like ReadContext.
+func (c *SsmDataChannel) ReadOutputContext(ctx context.Context, data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, nil
+	}
+
+	c.outputMu.Lock()
+	defer c.outputMu.Unlock()
+
+	for len(c.output) < 1 {
+		if c.outputEOF {
+			return 0, io.EOF
+		}
+
+		m, err := c.ReadMessageContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		payload, err := c.HandleMessageContext(ctx, m)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return 0, err
+			}
+			c.outputEOF = true
+		}
+		c.output = payload
+	}
+
+	n := copy(data, c.output)
+	c.output = c.output[n:]
+	return n, nil
+}
+
+// ReadMessage reads and decodes the next message from the websocket connection, which can be processed with
+// HandleMessage.  The returned message does not share memory with the data channel, and stays valid after
+// further reads.  If a ReconnectPolicy is configured, errors reading from the websocket will attempt to resume
+// the session before returning the error.
+func (c *SsmDataChannel) ReadMessage() (*AgentMessage, error) {
+	return c.ReadMessageContext(context.Background())
+}
+
+// ReadMessageContext is ReadMessage with a context, which bounds the wait for the next message (and any reconnect
+// attempts).  If the context is done before a message is read, the context error is returned.
+func (c *SsmDataChannel) ReadMessageContext(ctx context.Context) (*AgentMessage, error) {
+	frame, err := c.readFrame(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer putFrame(frame)
+
+	m := new(AgentMessage)
+	if err = m.UnmarshalBinary(frame.Bytes()); err != nil {
+		c.traceInvalid(frame.Bytes(), err)
+		return nil, err
+	}
+
+	// the decoded fields point into the frame, which is reused by the next read
+	m.payloadDigest = append([]byte(nil), m.payloadDigest...)
+	if len(m.Payload) > 0 {
+		m.Payload = append(make([]byte, 0, len(m.Payload)), m.Payload...)
+	}
+	return m, nil
+}
+
+// readFrame reads the next websocket message into a buffer from the frame pool, resuming the session if the
+// connection is lost.  The caller returns the buffer to the pool with putFrame.
+func (c *SsmDataChannel) readFrame(ctx context.Context) (*bytes.Buffer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	ws := c.ws
+	c.mu.Unlock()
+
+	idle := c.idleTimeout()
+	if idle > 0 {
+		_ = ws.SetReadDeadline(time.Now().Add(idle))
+	}
+
+	// expire the read deadline to interrupt the blocked read when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = ws.SetReadDeadline(time.Now())
+	})
+	frame, err := readWebsocketFrame(ws)
+	stop()
+
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if err != nil && c.failed() != nil {
+		// the websocket was closed because the data channel failed, report the cause
+		return nil, c.failed()
+	}
+
+	if err != nil && idle > 0 && isTimeout(err) {
+		err = ErrConnectionStale
+	}
+
+	if err != nil && c.canReconnect() {
+		c.logger().Info("websocket read error, attempting to resume session", zap.Error(err))
+		rerr := c.ReconnectContext(ctx)
+		if rerr == nil {
+			return c.readFrame(ctx)
+		}
+		c.logger().Info("unable to resume session", zap.Error(rerr))
+	}
+
+	if errors.Is(err, ErrConnectionStale) {
+		// unblock any writers waiting on the send window, nothing will be acknowledged
+		c.fail(err)
+		return nil, err
+	}
 
 	if err != nil {
 		// gorilla code states this is uber-fatal, and we just need to bail out
 		if websocket.IsCloseError(err, 1000, 1001, 1006) {
 			err = io.EOF
 		}
-		return n, err
+		return nil, err
 	}
+	return frame, nil
+}
 
-	if n < agentMsgHeaderLen {
-		return n, errors.New("invalid message received, too short")
+// readWebsocketFrame reads a whole websocket message into a buffer from the frame pool.
+func readWebsocketFrame(ws *websocket.Conn) (*bytes.Buffer, error) {
+	_, r, err := ws.NextReader()
+	if err != nil {
+		return nil, err
 	}
 
-	return n, nil
+	frame := getFrame()
+	if _, err = frame.ReadFrom(r); err != nil {
+		putFrame(frame)
+		return nil, err
+	}
+	return frame, nil
 }
 
 // WriteTo uses the data channel as an io.Copy read source, writing output to the provided writer.
 func (c *SsmDataChannel) WriteTo(w io.Writer) (n int64, err error) {
-	buf := make([]byte, 2048)
-	var nr, nw int
+	var m *AgentMessage
+	var nw int
 	var payload []byte
 
+	c.outputMu.Lock()
+	payload, c.output = c.output, nil
+	c.outputMu.Unlock()
+
+	if len(payload) > 0 {
+		nw, err = w.Write(payload)
+		n += int64(nw)
+		if err != nil {
+			return n, err
+		}
+	}
+
 	for {
-		nr, err = c.Read(buf)
+		m, err = c.ReadMessage()
 		if err != nil {
-			zap.S().Infof("WriteTo read error: %v", err)
+			c.logger().Info("WriteTo read error", zap.Error(err))
 			return n, err
 		}
 
-		if nr > 0 {
-			payload, err = c.HandleMsg(buf[:nr])
-			var isEOF bool
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					isEOF = true
-				} else {
-					zap.S().Infof("WriteTo HandleMsg error: %v", err)
-					return n, err
-				}
+		payload, err = c.HandleMessage(m)
+		var isEOF bool
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				isEOF = true
+			} else {
+				c.logger().Info("WriteTo HandleMessage error", zap.Error(err))
+				return n, err
 			}
+		}
 
-			if len(payload) > 0 {
-				nw, err = w.Write(payload)
-				n += int64(nw)
-				if err != nil {
-					zap.S().Infof("WriteTo write error: %v", err)
-					return n, err
-				}
+		if len(payload) > 0 {
+			nw, err = w.Write(payload)
+			n += int64(nw)
+			if err != nil {
+				c.logger().Info("WriteTo write error", zap.Error(err))
+				return n, err
 			}
+		}
 
-			if isEOF {
-				return n, nil
-			}
+		if isEOF {
+			return n, nil
 		}
 	}
 }
@@ -188,13 +507,13 @@ func (c *SsmDataChannel) ReadFrom(r io.Reader) (n int64, err error) {
 				// the contract of ReaderFrom states that io.EOF should not be returned, just
 				// exit the loop and return no error to indicate we are done
 				err = nil
-				zap.S().Info("ReadFrom reader is closed")
+				c.logger().Info("ReadFrom reader is closed")
 			}
 			break
 		}
 
 		if _, err = c.Write(buf[:nr]); err != nil {
-			zap.S().Infof("ReadFrom write error: %v", err)
+			c.logger().Info("ReadFrom write error", zap.Error(err))
 			break
 		}
 	}
@@ -202,29 +521,44 @@ func (c *SsmDataChannel) ReadFrom(r io.Reader) (n int64, err error) {
 }
 
 // Write sends an input stream data message type with the provided payload bytes as the message payload.
+// If the session is using KMS encryption, the payload is encrypted before sending.  This call blocks while
+// the send window is full, or publication is paused by the agent.
 func (c *SsmDataChannel) Write(payload []byte) (int, error) {
 	msg := NewAgentMessage()
 	msg.MessageType = InputStreamData
 	msg.Flags = Data
 	msg.PayloadType = Output
-	msg.Payload = payload
-	msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
+	// the message is kept until acknowledged, so it can't refer to the caller's buffer
+	msg.Payload = append([]byte(nil), payload...)
+	msg.SequenceNumber = c.nextSequenceNumber()
+
+	if e := c.encrypter.Load(); e != nil {
+		var err error
+		if msg.Payload, err = e.Encrypt(payload); err != nil {
+			return 0, err
+		}
+	}
 
-	return c.WriteMsg(msg)
+	if _, err := c.WriteMsg(msg); err != nil {
+		return 0, err
+	}
+	c.stats.add(&c.stats.bytesSent, len(payload))
+	return len(payload), nil
 }
 
 // WriteMsg is the underlying method which marshals AgentMessage types and sends them to the AWS service.
 // This is provided as a convenience so that messages types not already handled can be sent. If the message
-// SequenceNumber field is less than 0, it will be automatically incremented using the internal counter.
+// SequenceNumber field is less than 0, the next sequence number of the client stream is assigned.
 func (c *SsmDataChannel) WriteMsg(msg *AgentMessage) (int, error) {
-	if !c.synSent {
-		atomic.StoreInt64(&c.seqNum, 0)
-		msg.Flags = Syn
-		msg.SequenceNumber = c.seqNum
-	}
+	if msg.MessageType != Acknowledge {
+		if msg.SequenceNumber < 0 {
+			msg.SequenceNumber = c.nextSequenceNumber()
+		}
 
-	if msg.SequenceNumber < 0 {
-		atomic.StoreInt64(&c.seqNum, 1)
+		// the first message of the client stream opens the stream
+		if msg.SequenceNumber == 0 {
+			msg.Flags = Syn
+		}
 	}
 
 	data, err := msg.MarshalBinary()
@@ -232,75 +566,127 @@ func (c *SsmDataChannel) WriteMsg(msg *AgentMessage) (int, error) {
 		return 0, err
 	}
 
+	if err = c.failed(); err != nil {
+		return 0, err
+	}
+
+	// wait for space in the send window before sending, this blocks while publication is paused by the agent.
+	// The control responses are sent by the goroutine reading from the agent, which also handles the
+	// acknowledgements and StartPublication messages ending the wait, so they are buffered without waiting.
+	if c.outMsgBuf != nil && msg.MessageType != Acknowledge {
+		if isControlResponse(msg) {
+			err = c.outMsgBuf.Put(msg)
+		} else {
+			err = c.outMsgBuf.Add(msg)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if c.rtx != nil {
+			c.rtx.sent(msg.SequenceNumber)
+		}
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.synSent = true
 
-	if c.outMsgBuf != nil && msg.MessageType != Acknowledge && msg.PayloadType != HandshakeResponse {
-		err = c.outMsgBuf.Add(msg)
+	// while reconnecting, buffered messages will be sent once the session is resumed
+	if !c.reconnecting {
+		return int(msg.payloadLength), c.writeMessage(msg, data)
 	}
+	return int(msg.payloadLength), nil
+}
 
-	if !c.pausePub {
-		return int(msg.payloadLength), c.ws.WriteMessage(websocket.BinaryMessage, data)
-	}
-	return int(msg.payloadLength), err
+// nextSequenceNumber returns the sequence number of the next message of the client stream, starting at 0.
+// Acknowledgements use the sequence number of the acknowledged message, and are not part of the stream.
+func (c *SsmDataChannel) nextSequenceNumber() int64 {
+	return atomic.AddInt64(&c.seqNum, 1) - 1
+}
+
+// isControlResponse reports if the message is a response to a control message from the agent (like the
+// HandshakeResponse), sent while handling the agent message.
+func isControlResponse(msg *AgentMessage) bool {
+	return msg.PayloadType == HandshakeResponse || msg.PayloadType == EncChallengeResponse
 }
 
-// HandleMsg takes the unprocessed message bytes from the websocket connection (a la Read()), unmarshals the data
+// HandleMsg takes the wire format bytes of a message from the websocket connection (a la Read()), unmarshals the data
 // and takes the appropriate action based on the message type.  Messages which have an actionable payload (output
-// payload types, and channel closed payloads) will have that data returned.  Errors will be returned for unknown/
-// unhandled message or payload types.  A ChannelClosed message type will return an io.EOF error to indicate that
-// this SSM data channel is shutting down and should no longer be used.
-//
-//nolint:gocognit,gocyclo
+// payload types, and channel closed payloads) will have that data returned, stderr output is written to the Stderr
+// writer.  A *MessageError is returned for invalid messages.  Message and payload types which are not meant for
+// the client, or not known, are acknowledged and skipped with a warning, so newer agents don't end the session.
+// A ChannelClosed message type will return an io.EOF error to indicate that this SSM data channel is shutting down
+// and should no longer be used.  The returned payload may share memory with data.
 func (c *SsmDataChannel) HandleMsg(data []byte) ([]byte, error) {
 	m := new(AgentMessage)
 	if err := m.UnmarshalBinary(data); err != nil {
 		// validation error
+		c.traceInvalid(data, err)
 		return nil, err
 	}
+	return c.HandleMessage(m)
+}
+
+// traceInvalid adds a message received from the agent which could not be decoded to the protocol trace.
+func (c *SsmDataChannel) traceInvalid(data []byte, err error) {
+	if c.Tracer != nil {
+		c.Tracer.TraceInvalid(TraceInbound, c.SessionID(), data, err)
+	}
+}
+
+// HandleMessage is HandleMsg for a message already decoded by ReadMessage, the returned payload may share memory
+// with the message.
+func (c *SsmDataChannel) HandleMessage(m *AgentMessage) ([]byte, error) {
+	return c.HandleMessageContext(context.Background(), m)
+}
+
+// HandleMessageContext is HandleMessage with a context, which bounds the AWS API calls made to process the
+// message (like the KMS call generating the data key of an encrypted session during the handshake).
+//
+//nolint:gocognit,gocyclo
+func (c *SsmDataChannel) HandleMessageContext(ctx context.Context, m *AgentMessage) ([]byte, error) {
+	if c.Tracer != nil {
+		c.Tracer.Trace(TraceInbound, c.SessionID(), m)
+	}
+	c.stats.add(&c.stats.messagesReceived, 1)
 
 	//nolint:exhaustive // we'll add more as we find them
 	switch m.MessageType {
 	case Acknowledge:
-		if c.outMsgBuf != nil {
-			c.outMsgBuf.Remove(m.SequenceNumber)
-		}
+		c.processAcknowledge(m)
 	case PausePublication:
-		c.pausePub = true
+		c.setPaused(true)
 	case StartPublication:
-		c.pausePub = false
+		c.setPaused(false)
+	case AgentSession:
+		c.processSessionState(m)
+	case InteractiveShell, TaskReply, TaskComplete, InputStreamData:
+		// exchanged between the agent and the service, or sent by the client, not expected here
+		c.logger().Debug("skipping message not meant for the client", messageFields(m)...)
 	case OutputStreamData:
-		switch m.PayloadType {
-		case Output:
-			// unbuffered - return payload directly
-			if c.inMsgBuf == nil {
-				_ = c.sendAcknowledgeMessage(m) // todo - handle error?
-				return m.Payload, nil
+		// unbuffered - process and return payload directly
+		if c.inMsgBuf == nil {
+			payload, err := c.processOutputStreamMsg(ctx, m)
+			if err != nil {
+				return nil, err
 			}
+			_ = c.sendAcknowledgeMessage(m) // todo - handle error?
+			return payload, nil
+		}
 
-			// duplicate message - discard
-			if m.SequenceNumber < c.inSeqNum {
+		// queue everything for in-order processing, duplicates are discarded by the queue
+		if err := c.inMsgBuf.Add(m); err != nil {
+			if errors.Is(err, ErrBufferFull) {
+				// outside the receive window, skip the acknowledgement so the agent re-sends it later
 				return nil, nil
 			}
-
-			// queue everything else
-			if err := c.inMsgBuf.Add(m); err != nil {
-				return nil, err
-			}
-		case HandshakeRequest:
-			// port forwarding session setup, we'll consider a handshake failure fatal
-			if err := c.processHandshakeRequest(m); err != nil {
-				return nil, err
-			}
-		case HandshakeComplete:
-			if c.handshakeCh != nil {
-				close(c.handshakeCh)
-			}
-		default:
-			return nil, fmt.Errorf("UNKNOWN INCOMING MSG PAYLOAD: %s\n%s", m, m.Payload)
+			return nil, err
 		}
 	case ChannelClosed:
+		c.mu.Lock()
+		c.channelClosed = true
+		c.mu.Unlock()
+
 		payload := new(ChannelClosedPayload)
 		if err := json.Unmarshal(m.Payload, payload); err != nil {
 			return nil, err
@@ -312,7 +698,7 @@ func (c *SsmDataChannel) HandleMsg(data []byte) ([]byte, error) {
 		}
 		return output, io.EOF
 	default:
-		return nil, fmt.Errorf("UNKNOWN MESSAGE TYPE: %+v", m)
+		c.logger().Warn("skipping message", messageFields(m, zap.Error(m.messageError(ErrUnknownMessageType, "")))...)
 	}
 
 	if err := c.sendAcknowledgeMessage(m); err != nil {
@@ -320,7 +706,7 @@ func (c *SsmDataChannel) HandleMsg(data []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return c.processInboundQueue()
+	return c.processInboundQueue(ctx)
 }
 
 // SetTerminalSize sends a message to the SSM service which indicates the size to use for the remote terminal
@@ -344,7 +730,7 @@ func (c *SsmDataChannel) SetTerminalSize(rows, cols uint32) error {
 	msg := NewAgentMessage()
 	msg.MessageType = InputStreamData
 	msg.Flags = Data
-	msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
+	msg.SequenceNumber = c.nextSequenceNumber()
 	msg.PayloadType = Size
 	msg.Payload = payload
 
@@ -357,11 +743,16 @@ func (c *SsmDataChannel) SetTerminalSize(rows, cols uint32) error {
 }
 
 // TerminateSession sends the TerminateSession message to the AWS service to indicate that the port forwarding
-// session is ending, so it can clean up any connections used to communicate with the EC2 instance agent.
+// session is ending, so it can clean up any connections used to communicate with the EC2 instance agent.  An
+// *AgentVersionError is returned if the agent reported a version which does not support the flag.
 func (c *SsmDataChannel) TerminateSession() error {
+	if err := c.requireKnownFeature(FeatureTerminateSession); err != nil {
+		return err
+	}
+
 	msg := NewAgentMessage()
 	msg.MessageType = InputStreamData
-	msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
+	msg.SequenceNumber = c.nextSequenceNumber()
 	msg.Flags = Fin
 	msg.PayloadType = Flag
 
@@ -376,11 +767,16 @@ func (c *SsmDataChannel) TerminateSession() error {
 // DisconnectPort sends the DisconnectToPort message to the AWS service to indicate that a non-muxing stream is
 // shutting down and any connection used to communicate with the EC2 instance agent can be cleaned up.  Unlike
 // the TerminateSession action, the websocket connection is still capable of initiating a new port forwarding
-// stream to the agent without needing to restart the program.
+// stream to the agent without needing to restart the program.  An *AgentVersionError is returned if the agent
+// reported a version which does not support the flag.
 func (c *SsmDataChannel) DisconnectPort() error {
+	if err := c.requireKnownFeature(FeatureTerminateSession); err != nil {
+		return err
+	}
+
 	msg := NewAgentMessage()
 	msg.MessageType = InputStreamData
-	msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
+	msg.SequenceNumber = c.nextSequenceNumber()
 	msg.Flags = Data
 	msg.PayloadType = Flag
 
@@ -392,58 +788,366 @@ func (c *SsmDataChannel) DisconnectPort() error {
 	return err
 }
 
-func (c *SsmDataChannel) processInboundQueue() ([]byte, error) {
+func (c *SsmDataChannel) processInboundQueue(ctx context.Context) ([]byte, error) {
 	if c.inMsgBuf == nil {
 		return nil, nil
 	}
 
-	var err error
 	data := new(bytes.Buffer)
+	for msg := c.inMsgBuf.Next(); msg != nil; msg = c.inMsgBuf.Next() {
+		payload, err := c.processOutputStreamMsg(ctx, msg)
+		if err != nil {
+			return data.Bytes(), err
+		}
+		data.Write(payload)
+	}
 
-	for {
-		if msg := c.inMsgBuf.Get(c.inSeqNum); msg != nil {
-			atomic.AddInt64(&c.inSeqNum, 1)
+	return data.Bytes(), nil
+}
 
-			if _, err = data.Write(msg.Payload); err != nil {
-				break
+// processOutputStreamMsg takes the action required for the payload type of an OutputStreamData message.  All
+// payload types share the same sequence, so messages must be processed in sequence number order.  Payload data
+// is returned for Output payload types, decrypted if the session is using KMS encryption.
+func (c *SsmDataChannel) processOutputStreamMsg(ctx context.Context, m *AgentMessage) ([]byte, error) {
+	//nolint:exhaustive // we'll add more as we find them
+	switch m.PayloadType {
+	case Output:
+		payload := m.Payload
+		if e := c.encrypter.Load(); e != nil {
+			var err error
+			if payload, err = e.Decrypt(m.Payload); err != nil {
+				return nil, err
 			}
+		}
+		c.stats.add(&c.stats.bytesReceived, len(payload))
+		return payload, nil
+	case HandshakeRequest:
+		// port forwarding session setup, we'll consider a handshake failure fatal
+		if err := c.processHandshakeRequest(ctx, m); err != nil {
+			return nil, err
+		}
+	case HandshakeComplete:
+		if err := c.processHandshakeComplete(m); err != nil {
+			return nil, err
+		}
+	case EncChallengeRequest:
+		if err := c.processEncryptionChallenge(m); err != nil {
+			return nil, err
+		}
+	case Error, StdErr:
+		return nil, c.processStderr(m)
+	case ExitCode:
+		c.processExitCode(m)
+	case Flag:
+		c.processFlag(m)
+	case Size, Parameter, HandshakeResponse, EncChallengeResponse:
+		// payload types sent by the client, not expected from the agent
+		c.logger().Debug("skipping payload not meant for the client", messageFields(m)...)
+	default:
+		c.logger().Warn("skipping message", messageFields(m, zap.Error(m.messageError(ErrUnknownPayloadType, "")))...)
+	}
+	return nil, nil
+}
+
+// processStderr writes the stderr output of the session to the Stderr writer, or logs it if no writer is set.
+func (c *SsmDataChannel) processStderr(m *AgentMessage) error {
+	payload := m.Payload
+	if e := c.encrypter.Load(); e != nil {
+		var err error
+		if payload, err = e.Decrypt(m.Payload); err != nil {
+			return err
+		}
+	}
+
+	if c.Stderr == nil {
+		c.logger().Warn("session stderr", messageFields(m, zap.ByteString("output", bytes.TrimSpace(payload)))...)
+		return nil
+	}
+
+	_, err := c.Stderr.Write(payload)
+	return err
+}
+
+// processFlag handles a flag message from the agent.  ConnectToPortError is sent when the agent fails to connect
+// to the remote port of a port forwarding session.
+func (c *SsmDataChannel) processFlag(m *AgentMessage) {
+	if len(m.Payload) < 4 {
+		c.logger().Warn("skipping message",
+			messageFields(m, zap.Error(m.messageError(ErrPayloadLength, "flag payload %d bytes", len(m.Payload))))...)
+		return
+	}
+
+	flag := PayloadTypeFlag(binary.BigEndian.Uint32(m.Payload))
+	if flag == ConnectToPortError {
+		if c.ConnectToPortErrorHandler != nil {
+			c.ConnectToPortErrorHandler()
+			return
+		}
+		c.logger().Warn("the agent failed to connect to the remote port, check the SSM agent logs on the target", messageFields(m)...)
+		return
+	}
+	c.logger().Debug("received flag from the agent", messageFields(m, zap.Stringer("flag", flag))...)
+}
 
-			c.inMsgBuf.Remove(msg.SequenceNumber)
+// processSessionState records the session state reported by the agent.
+func (c *SsmDataChannel) processSessionState(m *AgentMessage) {
+	state := new(AgentSessionStatePayload)
+	if err := json.Unmarshal(m.Payload, state); err != nil {
+		c.logger().Warn("skipping invalid message", messageFields(m, zap.Error(err))...)
+		return
+	}
+
+	c.mu.Lock()
+	changed := state.SessionState != c.sessionState
+	c.sessionState = state.SessionState
+	c.mu.Unlock()
+
+	if changed {
+		c.logger().Info("session state changed", messageFields(m, zap.String("sessionState", state.SessionState))...)
+	}
+}
+
+// SessionState returns the last session state reported by the agent in an agent_session_state message, or an
+// empty string if the agent has not reported a state.
+func (c *SsmDataChannel) SessionState() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionState
+}
+
+// processExitCode records the exit code of the command run by a non-interactive command session, which the agent
+// sends as a decimal string before closing the channel.
+func (c *SsmDataChannel) processExitCode(m *AgentMessage) {
+	code, err := strconv.Atoi(strings.TrimSpace(string(m.Payload)))
+	if err != nil {
+		c.logger().Warn("skipping invalid exit code", messageFields(m, zap.Error(err))...)
+		return
+	}
+
+	c.mu.Lock()
+	c.exitCode = &code
+	c.mu.Unlock()
+
+	c.logger().Debug("received exit code", messageFields(m, zap.Int("exitCode", code))...)
+}
+
+// ExitCode returns the exit code of the command run by a non-interactive command session, and false if the
+// agent did not report an exit code (yet), which older agents don't.
+func (c *SsmDataChannel) ExitCode() (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.exitCode == nil {
+		return 0, false
+	}
+	return *c.exitCode, true
+}
+
+// SessionID returns the ID of the session started by Open, or an empty string.
+func (c *SsmDataChannel) SessionID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionID
+}
+
+// processHandshakeComplete records the HandshakeComplete payload, prints the customer message banner and
+// releases WaitForHandshakeComplete.
+func (c *SsmDataChannel) processHandshakeComplete(m *AgentMessage) error {
+	payload := new(HandshakeCompletePayload)
+	if err := json.Unmarshal(m.Payload, payload); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.handshake.HandshakeTimeToComplete = payload.HandshakeTimeToComplete
+	c.handshake.CustomerMessage = payload.CustomerMessage
+	c.handshake.Complete = true
+	c.mu.Unlock()
+
+	c.logger().Debug("handshake complete", messageFields(m, zap.String("agentVersion", c.AgentVersion()),
+		zap.Duration("timeToComplete", payload.HandshakeTimeToComplete))...)
+
+	if payload.CustomerMessage != "" {
+		if c.Stderr != nil {
+			_, _ = fmt.Fprintln(c.Stderr, payload.CustomerMessage)
 		} else {
-			break
+			c.logger().Info(payload.CustomerMessage, messageFields(m)...)
 		}
 	}
 
-	return data.Bytes(), err
+	if c.handshakeCh != nil {
+		close(c.handshakeCh)
+	}
+	return nil
+}
+
+// HandshakeInfo returns the details of the handshake with the agent, which are complete after
+// WaitForHandshakeComplete returns.
+func (c *SsmDataChannel) HandshakeInfo() HandshakeInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := c.handshake
+	info.RequestedClientActions = append([]ActionType(nil), c.handshake.RequestedClientActions...)
+	return info
+}
+
+// AgentVersion returns the version reported by the agent in the handshake, or an empty string if the session
+// did not do a handshake (yet).
+func (c *SsmDataChannel) AgentVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.handshake.AgentVersion
+}
+
+// setPaused stops (or restarts) sending new and retransmitted messages, in response to the agent
+// PausePublication and StartPublication messages.
+func (c *SsmDataChannel) setPaused(paused bool) {
+	c.mu.Lock()
+	c.pausePub = paused
+	c.mu.Unlock()
+	c.stats.setPaused(paused)
+
+	if c.outMsgBuf != nil {
+		c.outMsgBuf.SetPaused(paused)
+	}
 }
 
+// processOutboundQueue re-sends unacknowledged messages as their retransmission timers expire.  If a message
+// reaches the maximum number of retransmissions, the data channel is failed with the RetransmitError.
 func (c *SsmDataChannel) processOutboundQueue() {
 	for {
-		time.Sleep(500 * time.Millisecond)
-		if c.pausePub {
+		var timer <-chan time.Time
+		if d, ok := c.rtx.nextTimeout(); ok {
+			timer = c.rtx.clock.After(d)
+		}
+
+		select {
+		case <-c.rtx.done:
+			return
+		case <-c.rtx.wake:
 			continue
+		case <-timer:
 		}
 
-		if c.outMsgBuf == nil {
+		c.mu.Lock()
+		paused := c.pausePub || c.reconnecting
+		c.mu.Unlock()
+
+		if paused {
+			// the retransmission timers will have expired, wait for the pause to end before re-sending
+			select {
+			case <-c.rtx.done:
+				return
+			case <-c.rtx.clock.After(c.rtx.policy.MinRTO):
+			}
+			continue
+		}
+
+		seqs, err := c.rtx.due()
+		if err != nil {
+			c.fail(err)
 			return
 		}
 
-		for m := c.outMsgBuf.Next(); m != nil; m = c.outMsgBuf.Next() {
-			if _, err := c.WriteMsg(m); err != nil {
-				// todo - handle error?
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		for _, seq := range seqs {
+			if m := c.outMsgBuf.Get(seq); m != nil {
+				if err = c.resend(m); err != nil {
+					c.logger().Debug("retransmit failed", messageFields(m, zap.Error(err))...)
+				}
 			}
 		}
 	}
 }
 
+// resend writes an already buffered message to the websocket, without resetting its retransmission state.
+func (c *SsmDataChannel) resend(msg *AgentMessage) error {
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.add(&c.stats.retransmits, 1)
+	return c.writeMessage(msg, data)
+}
+
+// writeMessage sends the marshaled message data on the websocket connection, adding the message to the protocol
+// trace.  Must be called with the mutex held.
+func (c *SsmDataChannel) writeMessage(msg *AgentMessage, data []byte) error {
+	if c.Tracer != nil {
+		c.Tracer.Trace(TraceOutbound, c.sessionID, msg)
+	}
+	c.stats.add(&c.stats.messagesSent, 1)
+	return c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// processAcknowledge removes the acknowledged message from the outbound buffer and stops its retransmission
+// timer.  The acknowledged sequence number is taken from the message payload, falling back to the message
+// header if the payload can not be parsed.
+func (c *SsmDataChannel) processAcknowledge(msg *AgentMessage) {
+	seq := msg.SequenceNumber
+
+	ack := new(AcknowledgeContent)
+	if err := json.Unmarshal(msg.Payload, ack); err == nil {
+		seq = ack.AcknowledgedMessageSequenceNumber
+	}
+
+	if c.outMsgBuf != nil {
+		c.outMsgBuf.Remove(seq)
+	}
+
+	if c.rtx != nil {
+		if rtt, ok := c.rtx.acked(seq); ok {
+			c.stats.observeAck(rtt)
+		}
+	}
+}
+
+// fail shuts down the data channel because of an unrecoverable error, the error is returned from subsequent
+// Read and Write calls.
+func (c *SsmDataChannel) fail(err error) {
+	c.logger().Info("data channel failed", zap.Error(err))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	if c.ws != nil {
+		_ = c.ws.Close()
+	}
+
+	if c.outMsgBuf != nil {
+		c.outMsgBuf.Close()
+	}
+}
+
+// Err returns the error which caused the data channel to fail (for example ErrConnectionStale, or a
+// RetransmitError), or nil if the data channel has not failed.
+func (c *SsmDataChannel) Err() error {
+	return c.failed()
+}
+
+// failed returns the error which caused the data channel to fail, or nil.
+func (c *SsmDataChannel) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
 // sendAcknowledgeMessage sends the Acknowledge message type for each incoming message read from
 // the web socket connection, which is required as part of the SSM session protocol.
 func (c *SsmDataChannel) sendAcknowledgeMessage(msg *AgentMessage) error {
-	ack := map[string]interface{}{
-		"AcknowledgedMessageType":           msg.MessageType,
-		"AcknowledgedMessageId":             msg.messageID.String(),
-		"AcknowledgedMessageSequenceNumber": msg.SequenceNumber,
-		"IsSequentialMessage":               true,
+	ack := &AcknowledgeContent{
+		AcknowledgedMessageType:           msg.MessageType,
+		AcknowledgedMessageID:             msg.messageID.String(),
+		AcknowledgedMessageSequenceNumber: msg.SequenceNumber,
+		IsSequentialMessage:               true,
 	}
 
 	payload, err := json.Marshal(ack)
@@ -465,20 +1169,29 @@ func (c *SsmDataChannel) sendAcknowledgeMessage(msg *AgentMessage) error {
 // processHandshakeRequest handles the incoming handshake request message for a port forwarding session
 // and sends the required HandshakeResponse message.  This must complete before sending data over the
 // forwarded connection.
-func (c *SsmDataChannel) processHandshakeRequest(msg *AgentMessage) error {
+func (c *SsmDataChannel) processHandshakeRequest(ctx context.Context, msg *AgentMessage) error {
 	req := new(HandshakeRequestPayload)
 	if err := json.Unmarshal(msg.Payload, req); err != nil {
 		return err
 	}
 
-	payload, err := json.Marshal(buildHandshakeResponse(req.RequestedClientActions))
+	c.mu.Lock()
+	c.handshake.AgentVersion = req.AgentVersion
+	c.handshake.RequestedClientActions = make([]ActionType, 0, len(req.RequestedClientActions))
+	for _, a := range req.RequestedClientActions {
+		c.handshake.RequestedClientActions = append(c.handshake.RequestedClientActions, a.ActionType)
+	}
+	c.mu.Unlock()
+
+	payload, err := json.Marshal(c.buildHandshakeResponse(ctx, req.RequestedClientActions))
 	if err != nil {
 		return err
 	}
 
 	out := NewAgentMessage()
 	out.MessageType = InputStreamData
-	out.SequenceNumber = msg.SequenceNumber
+	// the response is part of the client stream, which may already have sent input (like the terminal size)
+	out.SequenceNumber = c.nextSequenceNumber()
 	out.Flags = Data
 	out.PayloadType = HandshakeResponse
 	out.Payload = payload
@@ -487,21 +1200,39 @@ func (c *SsmDataChannel) processHandshakeRequest(msg *AgentMessage) error {
 	return err
 }
 
-func (c *SsmDataChannel) startSession(cfg aws.Config, in *ssm.StartSessionInput, resolver *SSMMessagesResover) error {
-	out, err := ssm.NewFromConfig(cfg).StartSession(context.Background(), in)
+func (c *SsmDataChannel) startSession(ctx context.Context, cfg aws.Config, in *ssm.StartSessionInput, resolver *SSMMessagesResover) error {
+	client := ssm.NewFromConfig(cfg)
+	c.mu.Lock()
+	c.ssmClient = client
+	c.resolver = resolver
+	c.mu.Unlock()
+
+	out, err := client.StartSession(ctx, in)
 	if err != nil {
 		return err
 	}
+
+	sessionID := aws.ToString(out.SessionId)
+	c.mu.Lock()
+	c.sessionID = sessionID
+	c.mu.Unlock()
+	c.setLogFields(c.targetID, sessionID)
 	StreamEndpointOverride(resolver, out)
-	return c.StartSessionFromDataChannelURL(*out.StreamUrl, *out.TokenValue)
+	return c.StartSessionFromDataChannelURLContext(ctx, *out.StreamUrl, *out.TokenValue)
 }
 
 func (c *SsmDataChannel) StartSessionFromDataChannelURL(url string, token string) error {
-	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{}) //nolint:bodyclose
+	return c.StartSessionFromDataChannelURLContext(context.Background(), url, token)
+}
+
+// StartSessionFromDataChannelURLContext is StartSessionFromDataChannelURL with a context, which bounds the
+// websocket connection setup.
+func (c *SsmDataChannel) StartSessionFromDataChannelURLContext(ctx context.Context, url string, token string) error {
+	ws, _, err := c.dialer().DialContext(ctx, url, http.Header{}) //nolint:bodyclose
 	if err != nil {
 		return err
 	}
-	c.ws = ws
+	c.setConn(ws)
 
 	if err = c.openDataChannel(token); err != nil {
 		_ = c.Close()
@@ -511,6 +1242,13 @@ func (c *SsmDataChannel) StartSessionFromDataChannelURL(url string, token string
 	return nil
 }
 
+func (c *SsmDataChannel) dialer() *websocket.Dialer {
+	if c.Dialer != nil {
+		return c.Dialer
+	}
+	return websocket.DefaultDialer
+}
+
 func (c *SsmDataChannel) openDataChannel(token string) error {
 	openDataChanInput := map[string]string{
 		"MessageSchemaVersion": "1.0",
@@ -523,27 +1261,115 @@ func (c *SsmDataChannel) openDataChannel(token string) error {
 	return c.ws.WriteJSON(openDataChanInput)
 }
 
+// processEncryptionChallenge handles the incoming encryption challenge sent by the agent after the KMS
+// encryption handshake action.  The challenge is decrypted with the agent key and re-encrypted with the client
+// key to prove both sides hold the same data key.
+func (c *SsmDataChannel) processEncryptionChallenge(msg *AgentMessage) error {
+	e := c.encrypter.Load()
+	if e == nil {
+		return ErrEncryptionNotEnabled
+	}
+
+	req := new(EncryptionChallengeRequest)
+	if err := json.Unmarshal(msg.Payload, req); err != nil {
+		return err
+	}
+
+	challenge, err := e.Decrypt(req.Challenge)
+	if err != nil {
+		return err
+	}
+
+	if challenge, err = e.Encrypt(challenge); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(&EncryptionChallengeResponse{Challenge: challenge})
+	if err != nil {
+		return err
+	}
+
+	out := NewAgentMessage()
+	out.MessageType = InputStreamData
+	out.SequenceNumber = c.nextSequenceNumber()
+	out.Flags = Data
+	out.PayloadType = EncChallengeResponse
+	out.Payload = payload
+
+	_, err = c.WriteMsg(out)
+	return err
+}
+
+// processKMSEncryptionAction generates the data key used to encrypt the session using the KMS key requested by
+// the agent.  The encrypted copy of the data key is returned so it can be sent to the agent in the handshake response.
+func (c *SsmDataChannel) processKMSEncryptionAction(ctx context.Context, params interface{}) (json.RawMessage, error) {
+	if c.KMSClient == nil {
+		return nil, errors.New("no KMS client configured")
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	req := new(KMSEncryptionRequest)
+	if err = json.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+
+	encCtx := map[string]string{
+		"aws:ssm:SessionId": c.SessionID(),
+		"aws:ssm:TargetId":  c.targetID,
+	}
+
+	e, err := newEncrypter(ctx, c.KMSClient, req.KMSKeyID, encCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(e.cipherTextKey)
+	res, err := json.Marshal(&KMSEncryptionResponse{KMSCipherTextKey: e.cipherTextKey, KMSCipherTextHash: hash[:]})
+	if err != nil {
+		return nil, err
+	}
+
+	c.encrypter.Store(e)
+	return res, nil
+}
+
 // the only requirement of the handshake response is that we include an element in ProcessedClientActions
-// for each element of RequestedClientActions (there's only 2 types, and port forwarding only uses the
-// SessionType action type, so there should only be 1 element), and the ActionStatus is Success.  Any
-// non-success is considered a failure in the receiving agent.
-func buildHandshakeResponse(actions []RequestedClientAction) *HandshakeResponsePayload {
+// for each element of RequestedClientActions, and the ActionStatus is Success.  Any non-success is considered
+// a failure in the receiving agent.  The SessionType action needs no processing on our side, the KMSEncryption
+// action generates the data key used to encrypt the session.
+func (c *SsmDataChannel) buildHandshakeResponse(ctx context.Context, actions []RequestedClientAction) *HandshakeResponsePayload {
 	res := HandshakeResponsePayload{
 		// seems this can be whatever we need it to be, however certain features may only be available at
-		// certain client versions (must report at least version 1.1.70 to do stream muxing)
-		ClientVersion:          "0.0.1",
+		// certain client versions, see ClientVersion
+		ClientVersion:          ClientVersion,
 		ProcessedClientActions: make([]ProcessedClientAction, len(actions)),
 	}
 
 	for i, a := range actions {
-		action := new(ProcessedClientAction)
+		action := ProcessedClientAction{ActionType: a.ActionType}
 
-		if a.ActionType == SessionType {
-			action.ActionType = a.ActionType
+		switch a.ActionType {
+		case SessionType:
 			action.ActionStatus = Success
+		case KMSEncryption:
+			result, err := c.processKMSEncryptionAction(ctx, a.ActionParameters)
+			if err != nil {
+				action.ActionStatus = Failed
+				action.Error = fmt.Sprintf("failed to process action %s: %v", a.ActionType, err)
+				res.Errors = append(res.Errors, err.Error())
+				break
+			}
+			action.ActionStatus = Success
+			action.ActionResult = result
+		default:
+			action.ActionStatus = Unsupported
 		}
 
-		res.ProcessedClientActions[i] = *action
+		res.ProcessedClientActions[i] = action
 	}
 
 	return &res
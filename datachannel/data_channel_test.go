@@ -0,0 +1,536 @@
+package datachannel_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/alexbacchin/ssm-session-client/datachannel/ssmtest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestHandshakeResponseRetransmitted(t *testing.T) {
+	// the first messages of the client are the HandshakeResponse, then the input, each is dropped on some seeds
+	for seed := int64(1); seed <= 8; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			srv := ssmtest.NewServer(&ssmtest.Options{Faults: ssmtest.Faults{Drop: 0.5, Seed: seed}})
+			defer srv.Close()
+
+			c := openTestChannel(t, srv)
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := c.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			var out []byte
+			for string(out) != "hello" {
+				m, err := c.ReadMessageContext(ctx)
+				if err != nil {
+					t.Fatalf("read failed with output %q: %v", out, err)
+				}
+
+				payload, err := c.HandleMessage(m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out = append(out, payload...)
+			}
+
+			if srv.LastSession().Handshake() == nil {
+				t.Error("the agent did not receive the HandshakeResponse")
+			}
+		})
+	}
+}
+
+func TestInputBeforeHandshake(t *testing.T) {
+	// the terminal size is the first message of the client stream, and must not share its sequence number with
+	// the HandshakeResponse, which is dropped on some seeds
+	for seed := int64(1); seed <= 4; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			srv := ssmtest.NewServer(&ssmtest.Options{Faults: ssmtest.Faults{Drop: 0.3, Seed: seed}})
+			defer srv.Close()
+
+			c := openTestChannel(t, srv)
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := c.SetTerminalSize(45, 132); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := c.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			out := make([]byte, 5)
+			if _, err := io.ReadFull(readerFunc(func(p []byte) (int, error) { return c.ReadOutputContext(ctx, p) }), out); err != nil {
+				t.Fatalf("read failed with output %q: %v", out, err)
+			}
+
+			if string(out) != "hello" {
+				t.Errorf("got output %q", out)
+			}
+
+			sess := srv.LastSession()
+			if sess.Handshake() == nil {
+				t.Error("the agent did not receive the HandshakeResponse")
+			}
+
+			if rows, cols := sess.TerminalSize(); rows != 45 || cols != 132 {
+				t.Errorf("got terminal size %dx%d", rows, cols)
+			}
+		})
+	}
+}
+
+func TestDataChannelFaults(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		faults ssmtest.Faults
+	}{
+		{"none", ssmtest.Faults{}},
+		{"drop", ssmtest.Faults{Drop: 0.1, Seed: 1}},
+		{"reorder", ssmtest.Faults{Reorder: 0.2, Seed: 2}},
+		{"duplicate", ssmtest.Faults{Duplicate: 0.2, Seed: 3}},
+		{"all", ssmtest.Faults{Drop: 0.05, Reorder: 0.1, Duplicate: 0.1, Delay: 5 * time.Millisecond, Seed: 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := ssmtest.NewServer(&ssmtest.Options{Faults: tc.faults})
+			defer srv.Close()
+
+			c := openTestChannel(t, srv)
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// the data is sent in many messages, to be hit by the faults
+			var want []byte
+			for i := 0; len(want) < 64*1024; i++ {
+				want = append(want, fmt.Sprintf("line %d\n", i)...)
+			}
+
+			go func() {
+				for data := want; len(data) > 0; {
+					sz := 1024
+					if sz > len(data) {
+						sz = len(data)
+					}
+					if _, err := c.Write(data[:sz]); err != nil {
+						return
+					}
+					data = data[sz:]
+				}
+			}()
+
+			got := make([]byte, 0, len(want))
+			for len(got) < len(want) {
+				m, err := c.ReadMessageContext(ctx)
+				if err != nil {
+					t.Fatalf("read failed after %d bytes: %v", len(got), err)
+				}
+
+				payload, err := c.HandleMessage(m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, payload...)
+			}
+
+			if string(got) != string(want) {
+				t.Error("the echoed data does not match the data sent")
+			}
+		})
+	}
+}
+
+func TestReadOutputSmallBuffer(t *testing.T) {
+	srv := ssmtest.NewServer(nil)
+	defer srv.Close()
+
+	c := openTestChannel(t, srv)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "the output is returned by ReadOutput over multiple calls"
+	if _, err := c.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	// ReadOutput returns the decoded payload, however small the buffer
+	got := make([]byte, len(want))
+	buf := make([]byte, 7)
+	for n := 0; n < len(got); {
+		nr, err := c.ReadOutputContext(ctx, buf)
+		if err != nil {
+			t.Fatalf("read failed with output %q: %v", got[:n], err)
+		}
+		n += copy(got[n:], buf[:nr])
+	}
+
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// the final output of the channel_closed message is returned before io.EOF
+	srv.LastSession().CloseChannel("final output")
+	var final []byte
+	for {
+		nr, err := c.ReadOutputContext(ctx, buf)
+		final = append(final, buf[:nr]...)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Errorf("expected io.EOF once the channel is closed, got %v", err)
+			}
+			break
+		}
+	}
+
+	if string(final) != "final output" {
+		t.Errorf("got final output %q", final)
+	}
+}
+
+func TestReadWireFormat(t *testing.T) {
+	srv := ssmtest.NewServer(nil)
+	defer srv.Close()
+
+	c := openTestChannel(t, srv)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read returns whole messages for HandleMsg, a message is not split over buffers which are too small
+	var out []byte
+	for string(out) != "hello" {
+		if _, err := c.ReadContext(ctx, make([]byte, 16)); !errors.Is(err, io.ErrShortBuffer) {
+			t.Fatalf("expected io.ErrShortBuffer for a small buffer, got %v", err)
+		}
+
+		buf := make([]byte, 4096)
+		n, err := c.ReadContext(ctx, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := c.HandleMsg(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, payload...)
+	}
+}
+
+func TestReconnectReplaysUnacknowledged(t *testing.T) {
+	srv := ssmtest.NewServer(nil)
+	defer srv.Close()
+
+	// the messages are not retransmitted before the connection is lost, only replayed once it is resumed
+	c := openTestChannel(t, srv, func(c *datachannel.SsmDataChannel) {
+		c.RetransmitPolicy = &datachannel.RetransmitPolicy{InitialRTO: time.Hour, MinRTO: time.Hour, MaxRTO: time.Hour, MaxAttempts: 1}
+		c.ReconnectPolicy = &datachannel.ReconnectPolicy{MaxAttempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	outCh := make(chan []byte)
+	go func() {
+		defer close(outCh)
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.ReadOutputContext(ctx, buf)
+			if err != nil {
+				return
+			}
+			outCh <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	var got []byte
+	readUntil := func(want string) {
+		t.Helper()
+		for len(got) < len(want) {
+			select {
+			case data, ok := <-outCh:
+				if !ok {
+					t.Fatalf("read failed with output %q", got)
+				}
+				got = append(got, data...)
+			case <-ctx.Done():
+				t.Fatalf("timed out with output %q", got)
+			}
+		}
+		if string(got) != want {
+			t.Fatalf("got output %q, want %q", got, want)
+		}
+	}
+
+	if _, err := c.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil("before\n")
+
+	// the input is lost on the broken connection, and stays unacknowledged
+	sess := srv.LastSession()
+	sess.DropInput()
+
+	want := "before\n"
+	for i := 0; i < 10; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		if _, err := c.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		want += line
+	}
+
+	select {
+	case data := <-outCh:
+		t.Fatalf("got output %q before the connection was resumed", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	sess.Disconnect()
+	readUntil(want)
+
+	// each message is received once, the replayed messages are not echoed again
+	select {
+	case data := <-outCh:
+		t.Errorf("got duplicate output %q", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if st := c.Stats(); st.Reconnects != 1 {
+		t.Errorf("got %d reconnects", st.Reconnects)
+	}
+}
+
+func TestAgentVersionTooOld(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		tooOld  bool
+	}{
+		{"2.3.700.0", true},
+		{"2.3.722.0", true},
+		{"2.3.723.0", false},
+		{ssmtest.DefaultAgentVersion, false},
+	} {
+		t.Run(tc.version, func(t *testing.T) {
+			srv := ssmtest.NewServer(&ssmtest.Options{AgentVersion: tc.version})
+			defer srv.Close()
+
+			c := openTestChannel(t, srv)
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, send := range map[string]func() error{"DisconnectPort": c.DisconnectPort, "TerminateSession": c.TerminateSession} {
+				err := send()
+				if !tc.tooOld {
+					if err != nil {
+						t.Errorf("%s: %v", name, err)
+					}
+					continue
+				}
+
+				var verr *datachannel.AgentVersionError
+				if !errors.As(err, &verr) || !errors.Is(err, datachannel.ErrAgentTooOld) {
+					t.Fatalf("%s: expected an AgentVersionError, got %v", name, err)
+				}
+
+				if verr.AgentVersion != tc.version || verr.Feature != datachannel.FeatureTerminateSession {
+					t.Errorf("%s: unexpected error %+v", name, verr)
+				}
+			}
+
+			// the flags the agent does not support are not sent
+			if flags := srv.LastSession().Flags(); tc.tooOld && len(flags) != 0 {
+				t.Errorf("the flags %v were sent to the agent", flags)
+			}
+		})
+	}
+}
+
+func TestHandshakeInfo(t *testing.T) {
+	srv := ssmtest.NewServer(&ssmtest.Options{AgentVersion: "3.2.582.0", CustomerMessage: "Authorized use only"})
+	defer srv.Close()
+
+	stderr := new(bytes.Buffer)
+	c := openTestChannel(t, srv, func(c *datachannel.SsmDataChannel) { c.Stderr = stderr })
+	defer c.Close()
+
+	if info := c.HandshakeInfo(); info.Complete || info.AgentVersion != "" {
+		t.Errorf("unexpected handshake info before the handshake %+v", info)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	info := c.HandshakeInfo()
+	if !info.Complete || info.AgentVersion != "3.2.582.0" || c.AgentVersion() != info.AgentVersion {
+		t.Errorf("unexpected handshake info %+v", info)
+	}
+
+	if info.CustomerMessage != "Authorized use only" || info.HandshakeTimeToComplete <= 0 {
+		t.Errorf("unexpected handshake info %+v", info)
+	}
+
+	if len(info.RequestedClientActions) == 0 || info.RequestedClientActions[0] != datachannel.SessionType {
+		t.Errorf("unexpected requested actions %v", info.RequestedClientActions)
+	}
+
+	// the banner is shown to the user
+	if stderr.String() != "Authorized use only\n" {
+		t.Errorf("got stderr %q", stderr.String())
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// the handshake request is delayed until after the context is cancelled
+		delayed bool
+		call    func(ctx context.Context, c *datachannel.SsmDataChannel) error
+	}{
+		{"WaitForHandshakeComplete", true, func(ctx context.Context, c *datachannel.SsmDataChannel) error {
+			return c.WaitForHandshakeCompleteContext(ctx)
+		}},
+		{"Read", false, func(ctx context.Context, c *datachannel.SsmDataChannel) error {
+			_, err := c.ReadContext(ctx, make([]byte, 4096))
+			return err
+		}},
+		{"ReadMessage", false, func(ctx context.Context, c *datachannel.SsmDataChannel) error {
+			_, err := c.ReadMessageContext(ctx)
+			return err
+		}},
+		{"ReadOutput", false, func(ctx context.Context, c *datachannel.SsmDataChannel) error {
+			_, err := c.ReadOutputContext(ctx, make([]byte, 4096))
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &ssmtest.Options{}
+			if tc.delayed {
+				opts.Faults = ssmtest.Faults{Delay: time.Hour, Seed: 1}
+			}
+			srv := ssmtest.NewServer(opts)
+			defer srv.Close()
+
+			c := openTestChannel(t, srv)
+			defer c.Close()
+
+			if !tc.delayed {
+				// nothing is sent by the agent once the handshake is complete
+				if err := c.WaitForHandshakeComplete(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- tc.call(ctx, c)
+			}()
+
+			select {
+			case err := <-errCh:
+				t.Fatalf("the call returned before the context was cancelled: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			cancel()
+			select {
+			case err := <-errCh:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("expected the context error, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the call was not unblocked by the cancelled context")
+			}
+		})
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// openTestChannel opens a data channel with the server, retransmitting quickly.  The options are applied to the
+// data channel before it is opened.
+func openTestChannel(t *testing.T, srv *ssmtest.Server, opts ...func(*datachannel.SsmDataChannel)) *datachannel.SsmDataChannel {
+	t.Helper()
+
+	c := new(datachannel.SsmDataChannel)
+	c.RetransmitPolicy = &datachannel.RetransmitPolicy{
+		InitialRTO:  50 * time.Millisecond,
+		MinRTO:      50 * time.Millisecond,
+		MaxRTO:      200 * time.Millisecond,
+		MaxAttempts: 50,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	err := c.Open(srv.AWSConfig(), &ssm.StartSessionInput{Target: aws.String("i-0123456789abcdef0")},
+		&datachannel.SSMMessagesResover{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,92 @@
+package datachannel
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+const (
+	// kmsKeySize is the size of the data key requested from KMS.  The key is split in half, the first half is
+	// used by the client for encryption (the agent's decryption) and the second half is used by the agent for
+	// encryption (our decryption), like the session-manager-plugin.
+	kmsKeySize = 64
+	nonceSize  = 12
+)
+
+// ErrEncryptionNotEnabled is the error returned if the agent sends an encryption challenge before the KMS
+// encryption handshake action has been processed.
+var ErrEncryptionNotEnabled = errors.New("encryption not enabled for session")
+
+// KMSClient is the subset of the AWS KMS API used to set up session encryption.  The *kms.Client type satisfies
+// this interface, other implementations may be provided (for example, a local fake for testing).
+type KMSClient interface {
+	GenerateDataKey(ctx context.Context, in *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+}
+
+// encrypter performs the AES-GCM encryption and decryption of message payloads using the data key generated
+// by KMS during the session handshake.
+type encrypter struct {
+	cipherTextKey []byte
+	encryptAEAD   cipher.AEAD
+	decryptAEAD   cipher.AEAD
+}
+
+func newEncrypter(ctx context.Context, client KMSClient, keyID string, encCtx map[string]string) (*encrypter, error) {
+	out, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(keyID),
+		NumberOfBytes:     aws.Int32(kmsKeySize),
+		EncryptionContext: encCtx,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out.Plaintext) != kmsKeySize {
+		return nil, errors.New("invalid data key size returned from KMS")
+	}
+
+	e := &encrypter{cipherTextKey: out.CiphertextBlob}
+	if e.encryptAEAD, err = newAEAD(out.Plaintext[:kmsKeySize/2]); err != nil {
+		return nil, err
+	}
+
+	if e.decryptAEAD, err = newAEAD(out.Plaintext[kmsKeySize/2:]); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Encrypt returns the encrypted data, prefixed with the random nonce used for the encryption.
+func (e *encrypter) Encrypt(data []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize, nonceSize+len(data)+e.encryptAEAD.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return e.encryptAEAD.Seal(nonce, nonce, data, nil), nil
+}
+
+// Decrypt returns the plain text of data encrypted by the agent, which is expected to be prefixed with the nonce.
+func (e *encrypter) Decrypt(data []byte) ([]byte, error) {
+	if len(data) < nonceSize {
+		return nil, errors.New("encrypted payload too short")
+	}
+
+	return e.decryptAEAD.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,134 @@
+package datachannel
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// testDataKey has different halves, so using the wrong half of the key fails the decryption.
+var testDataKey = func() []byte {
+	key := make([]byte, kmsKeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}()
+
+// fakeKMS returns testDataKey from GenerateDataKey, or the context error if the context is done.
+type fakeKMS struct {
+	in *kms.GenerateDataKeyInput
+}
+
+func (f *fakeKMS) GenerateDataKey(ctx context.Context, in *kms.GenerateDataKeyInput, _ ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	f.in = in
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{
+		CiphertextBlob: []byte("encrypted data key"),
+		Plaintext:      testDataKey,
+	}, nil
+}
+
+// agentSeal encrypts data like the agent, with the second half of the data key.
+func agentSeal(t *testing.T, data []byte) []byte {
+	t.Helper()
+	aead, err := newAEAD(testDataKey[kmsKeySize/2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := bytes.Repeat([]byte{1}, nonceSize)
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+// agentOpen decrypts data like the agent, with the first half of the data key.
+func agentOpen(t *testing.T, data []byte) ([]byte, error) {
+	t.Helper()
+	aead, err := newAEAD(testDataKey[:kmsKeySize/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+}
+
+func TestProcessKMSEncryptionAction(t *testing.T) {
+	kmsClient := new(fakeKMS)
+	c := &SsmDataChannel{KMSClient: kmsClient, sessionID: "session-1", targetID: "i-0123456789abcdef0"}
+
+	data, err := c.processKMSEncryptionAction(context.Background(), map[string]string{"KMSKeyId": "alias/session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := new(KMSEncryptionResponse)
+	if err = json.Unmarshal(data, res); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := sha256.Sum256([]byte("encrypted data key"))
+	if string(res.KMSCipherTextKey) != "encrypted data key" || !bytes.Equal(res.KMSCipherTextHash, hash[:]) {
+		t.Errorf("unexpected response %+v", res)
+	}
+
+	if *kmsClient.in.KeyId != "alias/session" || kmsClient.in.EncryptionContext["aws:ssm:SessionId"] != "session-1" ||
+		kmsClient.in.EncryptionContext["aws:ssm:TargetId"] != "i-0123456789abcdef0" {
+		t.Errorf("unexpected GenerateDataKey input %+v", kmsClient.in)
+	}
+
+	e := c.encrypter.Load()
+	if e == nil {
+		t.Fatal("encryption not enabled")
+	}
+
+	// client to agent
+	enc, err := e.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := agentOpen(t, enc); err != nil || string(dec) != "hello" {
+		t.Errorf("the agent decrypted %q: %v", dec, err)
+	}
+	if _, err = e.Decrypt(enc); err == nil {
+		t.Error("data encrypted by the client was decrypted with the agent key")
+	}
+
+	// agent to client
+	enc = agentSeal(t, []byte("world"))
+	if dec, err := e.Decrypt(enc); err != nil || string(dec) != "world" {
+		t.Errorf("the client decrypted %q: %v", dec, err)
+	}
+	if _, err = agentOpen(t, enc); err == nil {
+		t.Error("data encrypted by the agent was decrypted with the client key")
+	}
+}
+
+func TestKMSEncryptionActionContext(t *testing.T) {
+	c := &SsmDataChannel{KMSClient: new(fakeKMS), sessionID: "session-1", targetID: "i-0123456789abcdef0"}
+
+	// the KMS call uses the context of the read processing the handshake
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	res := c.buildHandshakeResponse(ctx, []RequestedClientAction{
+		{ActionType: KMSEncryption, ActionParameters: map[string]string{"KMSKeyId": "alias/session"}},
+	})
+
+	if len(res.ProcessedClientActions) != 1 || res.ProcessedClientActions[0].ActionStatus != Failed {
+		t.Fatalf("unexpected handshake response %+v", res)
+	}
+
+	if len(res.Errors) != 1 || !strings.Contains(res.Errors[0], context.Canceled.Error()) {
+		t.Errorf("expected the context error, got %v", res.Errors)
+	}
+
+	if c.encrypter.Load() != nil {
+		t.Error("encryption enabled without a data key")
+	}
+}
@@ -0,0 +1,85 @@
+package datachannel
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// ErrConnectionStale is the error returned by Read when nothing (not even a pong reply to a keepalive ping) is
+// received from the service within the idle timeout of the KeepAlivePolicy, which usually means the connection
+// is half-open.  The data channel fails with this error unless the session is resumed by the ReconnectPolicy.
+var ErrConnectionStale = errors.New("connection stale, no data received from service")
+
+// KeepAlivePolicy configures the websocket ping/pong keepalive of the data channel.  A ping is sent every
+// Interval, and the connection is considered stale if no message or pong is received within Interval plus
+// Timeout.
+type KeepAlivePolicy struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// DefaultKeepAlivePolicy is a reasonable KeepAlivePolicy, detecting a dead connection within a minute.
+var DefaultKeepAlivePolicy = KeepAlivePolicy{
+	Interval: 30 * time.Second,
+	Timeout:  30 * time.Second,
+}
+
+// idleTimeout returns the maximum time to wait for data from the service, or 0 if keepalive is disabled.
+func (c *SsmDataChannel) idleTimeout() time.Duration {
+	if c.KeepAlivePolicy == nil || c.KeepAlivePolicy.Interval <= 0 {
+		return 0
+	}
+	return c.KeepAlivePolicy.Interval + c.KeepAlivePolicy.Timeout
+}
+
+// setConn makes ws the active websocket connection, extending the read deadline for each pong received
+// if keepalive is enabled.
+func (c *SsmDataChannel) setConn(ws *websocket.Conn) {
+	if idle := c.idleTimeout(); idle > 0 {
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(idle))
+		})
+	}
+
+	c.mu.Lock()
+	c.ws = ws
+	c.mu.Unlock()
+}
+
+// processKeepAlive sends a ping over the active websocket connection every policy interval, until done is closed.
+func (c *SsmDataChannel) processKeepAlive(p KeepAlivePolicy, done <-chan struct{}) {
+	t := time.NewTicker(p.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		c.mu.Lock()
+		ws := c.ws
+		skip := c.reconnecting || c.err != nil
+		c.mu.Unlock()
+
+		if ws == nil || skip {
+			continue
+		}
+
+		// WriteControl is safe to call concurrently with the other websocket write methods
+		if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(p.Timeout)); err != nil {
+			c.logger().Debug("keepalive ping failed", zap.Error(err))
+		}
+	}
+}
+
+// isTimeout returns true if the error is a network timeout, caused by an expired read deadline.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
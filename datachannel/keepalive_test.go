@@ -0,0 +1,87 @@
+package datachannel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/alexbacchin/ssm-session-client/datachannel/ssmtest"
+)
+
+var testKeepAlivePolicy = &datachannel.KeepAlivePolicy{Interval: 50 * time.Millisecond, Timeout: 50 * time.Millisecond}
+
+func TestKeepAliveStale(t *testing.T) {
+	srv := ssmtest.NewServer(nil)
+	defer srv.Close()
+
+	c := openTestChannel(t, srv, func(c *datachannel.SsmDataChannel) { c.KeepAlivePolicy = testKeepAlivePolicy })
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is received once the pings are not answered
+	srv.LastSession().IgnorePings()
+	start := time.Now()
+
+	_, err := c.ReadOutputContext(ctx, make([]byte, 1024))
+	if !errors.Is(err, datachannel.ErrConnectionStale) {
+		t.Fatalf("expected ErrConnectionStale, got %v", err)
+	}
+
+	// the idle timeout is 100ms, a read started just before a pong could wait up to twice as long
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the stale connection was detected after %v", elapsed)
+	}
+
+	if _, err = c.Write([]byte("hello")); !errors.Is(err, datachannel.ErrConnectionStale) {
+		t.Errorf("expected ErrConnectionStale writing to the failed channel, got %v", err)
+	}
+}
+
+func TestKeepAlivePong(t *testing.T) {
+	srv := ssmtest.NewServer(nil)
+	defer srv.Close()
+
+	c := openTestChannel(t, srv, func(c *datachannel.SsmDataChannel) { c.KeepAlivePolicy = testKeepAlivePolicy })
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.WaitForHandshakeCompleteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	readCh := make(chan result, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, err := c.ReadOutputContext(ctx, buf)
+		readCh <- result{buf[:n], err}
+	}()
+
+	// the session is idle for many times the idle timeout, the pongs keep the connection alive
+	select {
+	case r := <-readCh:
+		t.Fatalf("the read returned %q while the session was idle: %v", r.data, r.err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := <-readCh; r.err != nil || string(r.data) != "hello" {
+		t.Errorf("got output %q: %v", r.data, r.err)
+	}
+}
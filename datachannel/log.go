@@ -0,0 +1,54 @@
+package datachannel
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// The field keys of the structured log entries written by the data channel, so applications can route the
+// protocol events of each session.
+const (
+	LogKeySessionID   = "sessionId"
+	LogKeyTarget      = "target"
+	LogKeySequence    = "seq"
+	LogKeyMessageType = "messageType"
+	LogKeyPayloadType = "payloadType"
+)
+
+var nopLogger = zap.NewNop()
+
+// sessionLogger holds the Logger with the session fields, which is replaced once the session ID is known.
+type sessionLogger struct {
+	l atomic.Pointer[zap.Logger]
+}
+
+// logger returns the data channel Logger with the target and session ID fields, or a no-op logger if the Logger
+// field is not set.
+func (c *SsmDataChannel) logger() *zap.Logger {
+	if l := c.log.l.Load(); l != nil {
+		return l
+	}
+
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return nopLogger
+}
+
+// setLogFields adds the session fields to the data channel Logger, called when the target and session ID change.
+func (c *SsmDataChannel) setLogFields(target, sessionID string) {
+	if c.Logger == nil {
+		return
+	}
+	c.log.l.Store(c.Logger.With(zap.String(LogKeyTarget, target), zap.String(LogKeySessionID, sessionID)))
+}
+
+// messageFields returns the log fields describing the message, followed by the extra fields.
+func messageFields(m *AgentMessage, fields ...zap.Field) []zap.Field {
+	return append([]zap.Field{
+		zap.Int64(LogKeySequence, m.SequenceNumber),
+		zap.String(LogKeyMessageType, string(m.MessageType)),
+		zap.Stringer(LogKeyPayloadType, m.PayloadType),
+	}, fields...)
+}
@@ -1,94 +1,228 @@
 package datachannel
 
 import (
-	"container/list"
 	"errors"
+	"sort"
 	"sync"
 )
 
-var ErrBufferFull = errors.New("buffer full")
+const (
+	// the default limits of the outbound send window and inbound receive window
+	sendWindowMessages    = 512
+	sendWindowBytes       = 1024 * 1024
+	receiveWindowMessages = 1024
+)
+
+var (
+	// ErrBufferFull is the error returned when an inbound message is outside the receive window of the reorder buffer.
+	ErrBufferFull = errors.New("buffer full")
+	// ErrBufferClosed is the error returned when adding to a MessageBuffer which has been closed.
+	ErrBufferClosed = errors.New("buffer closed")
+)
 
+// MessageBuffer is the send window of outbound messages which have not been acknowledged by the agent.  The
+// window is bounded by message count and payload bytes, Add blocks until acknowledgements free enough space
+// for the message.  Add also blocks while the buffer is paused, which is used to honour PausePublication.  Put
+// buffers a message without waiting, for the control responses sent while handling messages from the agent,
+// which must not wait for the acknowledgements they would be handled with.
 type MessageBuffer interface {
 	Len() int
+	Bytes() int
 	Add(msg *AgentMessage) error
+	Put(msg *AgentMessage) error
 	Remove(seqNum int64)
 	Get(seqNum int64) *AgentMessage
-	Next() *AgentMessage
+	Messages() []*AgentMessage
+	SetPaused(paused bool)
+	Close()
 }
 
 type messageBuffer struct {
-	mu     sync.RWMutex
-	size   int
-	buf    *list.List
-	seqMap map[int64]*list.Element
-	cursor *list.Element
+	mu       sync.Mutex
+	cond     *sync.Cond
+	maxCount int
+	maxBytes int
+	bytes    int
+	msgs     map[int64]*AgentMessage
+	paused   bool
+	closed   bool
 }
 
 func (m *messageBuffer) Len() int {
-	return m.buf.Len()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.msgs)
 }
 
+func (m *messageBuffer) Bytes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+// Add puts the message in the send window, blocking while the window is paused or has no space for the message.
+// Adding a message which is already buffered (re-sent message) does nothing.
 func (m *messageBuffer) Add(msg *AgentMessage) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if m.Len() == m.size {
-		return ErrBufferFull
+	if _, ok := m.msgs[msg.SequenceNumber]; ok {
+		return nil
+	}
+
+	sz := len(msg.Payload)
+	for !m.closed && (m.paused || !m.fits(sz)) {
+		m.cond.Wait()
 	}
 
-	el := m.buf.PushBack(msg)
-	m.seqMap[msg.SequenceNumber] = el
+	if m.closed {
+		return ErrBufferClosed
+	}
+
+	m.msgs[msg.SequenceNumber] = msg
+	m.bytes += sz
+	return nil
+}
+
+// Put puts the message in the send window without waiting for space in the window, or for the end of a pause.
+// Putting a message which is already buffered does nothing.
+func (m *messageBuffer) Put(msg *AgentMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrBufferClosed
+	}
 
+	if _, ok := m.msgs[msg.SequenceNumber]; !ok {
+		m.msgs[msg.SequenceNumber] = msg
+		m.bytes += len(msg.Payload)
+	}
 	return nil
 }
 
+// fits reports if a payload of the given size has space in the window.  An empty window always accepts a
+// message, so payloads larger than the byte limit can still be sent.
+func (m *messageBuffer) fits(sz int) bool {
+	if len(m.msgs) < 1 {
+		return true
+	}
+	return len(m.msgs) < m.maxCount && m.bytes+sz <= m.maxBytes
+}
+
 func (m *messageBuffer) Remove(seqNum int64) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if v, ok := m.seqMap[seqNum]; ok {
-		if v != nil {
-			m.buf.Remove(v)
-		}
-		delete(m.seqMap, seqNum)
+	if v, ok := m.msgs[seqNum]; ok {
+		m.bytes -= len(v.Payload)
+		delete(m.msgs, seqNum)
+		m.cond.Broadcast()
 	}
 }
 
 func (m *messageBuffer) Get(seqNum int64) *AgentMessage {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.msgs[seqNum]
+}
+
+// Messages returns a snapshot of the buffered messages, ordered by sequence number.
+func (m *messageBuffer) Messages() []*AgentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if v, ok := m.seqMap[seqNum]; ok {
-		if v != nil {
-			return v.Value.(*AgentMessage)
-		}
+	msgs := make([]*AgentMessage, 0, len(m.msgs))
+	for _, v := range m.msgs {
+		msgs = append(msgs, v)
 	}
-	return nil
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].SequenceNumber < msgs[j].SequenceNumber
+	})
+	return msgs
+}
+
+// SetPaused blocks (or unblocks) callers of Add, regardless of the space available in the window.
+func (m *messageBuffer) SetPaused(paused bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.paused = paused
+	m.cond.Broadcast()
+}
+
+// Close unblocks all callers waiting in Add, which will return ErrBufferClosed.
+func (m *messageBuffer) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.cond.Broadcast()
+}
+
+// NewMessageBuffer creates a MessageBuffer which holds at most maxCount messages, and maxBytes of payload data.
+func NewMessageBuffer(maxCount, maxBytes int) *messageBuffer {
+	mb := new(messageBuffer)
+	mb.cond = sync.NewCond(&mb.mu)
+	mb.maxCount = maxCount
+	mb.maxBytes = maxBytes
+	mb.msgs = make(map[int64]*AgentMessage)
+
+	return mb
 }
 
-func (m *messageBuffer) Next() *AgentMessage {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// reorderBuffer holds inbound messages received ahead of the next expected sequence number, so they can be
+// processed in order.  Messages within the receive window are never dropped.
+type reorderBuffer struct {
+	mu     sync.Mutex
+	window int64
+	next   int64
+	msgs   map[int64]*AgentMessage
+}
 
-	var el *list.Element
-	if m.cursor == nil {
-		el = m.buf.Front()
-	} else {
-		el = m.cursor.Next()
+func newReorderBuffer(window int) *reorderBuffer {
+	return &reorderBuffer{
+		window: int64(window),
+		msgs:   make(map[int64]*AgentMessage),
 	}
-	m.cursor = el
+}
+
+// Add buffers the message for in-order processing.  Duplicate messages (already buffered, or already processed)
+// are ignored.  ErrBufferFull is returned if the message is beyond the receive window, the message is not
+// buffered and should not be acknowledged, so it is re-sent by the agent.
+func (r *reorderBuffer) Add(msg *AgentMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	if el != nil {
-		return el.Value.(*AgentMessage)
+	if msg.SequenceNumber < r.next {
+		return nil
+	}
+
+	if msg.SequenceNumber >= r.next+r.window {
+		return ErrBufferFull
+	}
+
+	if _, ok := r.msgs[msg.SequenceNumber]; !ok {
+		// the payload of an unmarshaled message refers to the caller's read buffer, keep a copy
+		msg.Payload = append([]byte(nil), msg.Payload...)
+		r.msgs[msg.SequenceNumber] = msg
 	}
 	return nil
 }
 
-func NewMessageBuffer(size int) *messageBuffer {
-	mb := new(messageBuffer)
-	mb.size = size
-	mb.buf = list.New()
-	mb.seqMap = make(map[int64]*list.Element)
+// Next removes and returns the message with the next expected sequence number, or nil if that message has not
+// been received yet.
+func (r *reorderBuffer) Next() *AgentMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return mb
+	msg, ok := r.msgs[r.next]
+	if !ok {
+		return nil
+	}
+
+	delete(r.msgs, r.next)
+	r.next++
+	return msg
 }
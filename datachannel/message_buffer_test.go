@@ -0,0 +1,71 @@
+package datachannel
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMessageBufferPutDoesNotWait(t *testing.T) {
+	buf := NewMessageBuffer(1, 1024)
+	buf.SetPaused(true)
+
+	msg := NewAgentMessage()
+	msg.SequenceNumber = 0
+	msg.PayloadType = HandshakeResponse
+	msg.Payload = []byte("{}")
+
+	done := make(chan error, 1)
+	go func() { done <- buf.Put(msg) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Put waited for the paused window")
+	}
+
+	// the window is full, and still paused
+	msg = NewAgentMessage()
+	msg.SequenceNumber = 1
+	msg.PayloadType = EncChallengeResponse
+	if err := buf.Put(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 2 || buf.Bytes() != 2 {
+		t.Errorf("unexpected buffer size %d messages, %d bytes", buf.Len(), buf.Bytes())
+	}
+
+	buf.Remove(0)
+	buf.Remove(1)
+	if buf.Len() != 0 || buf.Bytes() != 0 {
+		t.Errorf("unexpected buffer size %d messages, %d bytes", buf.Len(), buf.Bytes())
+	}
+
+	buf.Close()
+	if err := buf.Put(msg); !errors.Is(err, ErrBufferClosed) {
+		t.Errorf("expected ErrBufferClosed, got %v", err)
+	}
+}
+
+func TestMessageBufferAddWaitsWhilePaused(t *testing.T) {
+	buf := NewMessageBuffer(sendWindowMessages, sendWindowBytes)
+	buf.SetPaused(true)
+
+	done := make(chan error, 1)
+	go func() { done <- buf.Add(NewAgentMessage()) }()
+
+	select {
+	case <-done:
+		t.Fatal("Add did not wait for the end of the pause")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	buf.SetPaused(false)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+package datachannel
+
+import (
+	"github.com/xtaci/smux"
+)
+
+// muxWriteSize is the max payload size of a single message sent by a muxConn, which matches the chunk size
+// used by ReadFrom.
+const muxWriteSize = 1536
+
+// SupportsMultiplexing returns true if the remote agent reported a version which is capable of carrying
+// multiple port forwarding connections over a single session using smux.  Only valid after the handshake
+// has completed.
+func (c *SsmDataChannel) SupportsMultiplexing() bool {
+	return c.Supports(FeatureMultiplexing)
+}
+
+// NewMuxSession starts the client side of an smux session over the data channel.  Each stream opened on the
+// returned session is carried to the agent as an independent connection to the remote port.  Closing the
+// returned session does not close the data channel.
+func (c *SsmDataChannel) NewMuxSession() (*smux.Session, error) {
+	cfg := smux.DefaultConfig()
+	if c.Supports(FeatureMuxKeepAliveDisabled) {
+		// newer agents drop smux keepalive, otherwise it breaks the Session Manager idle timeout
+		cfg.KeepAliveDisabled = true
+	}
+
+	return smux.Client(&muxConn{c: c}, cfg)
+}
+
+// muxConn adapts the message-oriented data channel to the io.ReadWriteCloser stream expected by smux.
+type muxConn struct {
+	c *SsmDataChannel
+}
+
+// Read returns data from the payloads of incoming output stream messages.  Payloads larger than the provided
+// []byte are returned over multiple calls.
+func (m *muxConn) Read(data []byte) (int, error) {
+	return m.c.ReadOutput(data)
+}
+
+// Write sends the data to the agent as one or more input stream data messages.
+func (m *muxConn) Write(data []byte) (int, error) {
+	var n int
+
+	for len(data) > 0 {
+		sz := len(data)
+		if sz > muxWriteSize {
+			sz = muxWriteSize
+		}
+
+		if _, err := m.c.Write(data[:sz]); err != nil {
+			return n, err
+		}
+
+		n += sz
+		data = data[sz:]
+	}
+	return n, nil
+}
+
+// Close is a no-op, the lifecycle of the data channel is managed by the caller which created the mux session.
+func (m *muxConn) Close() error {
+	return nil
+}
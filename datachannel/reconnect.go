@@ -0,0 +1,157 @@
+package datachannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"go.uber.org/zap"
+)
+
+// ErrResumeUnsupported is the error returned by Reconnect if the data channel was not opened using the
+// StartSession API, so there is no session which can be resumed.
+var ErrResumeUnsupported = errors.New("session can not be resumed")
+
+// ReconnectPolicy configures the automatic reconnection of the data channel when the websocket connection
+// is lost.  MaxAttempts is the number of ResumeSession attempts before giving up, the delay between attempts
+// starts at Backoff and doubles after each failure, up to MaxBackoff.
+type ReconnectPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// DefaultReconnectPolicy is the policy used by Reconnect if the data channel ReconnectPolicy field is not set.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	MaxAttempts: 5,
+	Backoff:     time.Second,
+	MaxBackoff:  30 * time.Second,
+}
+
+// Reconnect calls the SSM ResumeSession API and re-opens the data channel using the new stream URL and token.
+// Any outbound messages which have not been acknowledged by the agent are re-sent after the data channel opens.
+func (c *SsmDataChannel) Reconnect() error {
+	return c.ReconnectContext(context.Background())
+}
+
+// ReconnectContext is Reconnect with a context, which bounds the ResumeSession attempts and the delay between
+// them.  The context error is returned if the context is done before the session is resumed.
+func (c *SsmDataChannel) ReconnectContext(ctx context.Context) error {
+	c.mu.Lock()
+	client, sessionID, resolver := c.ssmClient, c.sessionID, c.resolver
+	c.mu.Unlock()
+
+	if client == nil || sessionID == "" {
+		return ErrResumeUnsupported
+	}
+
+	p := c.ReconnectPolicy
+	if p == nil {
+		p = &DefaultReconnectPolicy
+	}
+
+	c.mu.Lock()
+	c.reconnecting = true
+	if c.ws != nil {
+		_ = c.ws.Close()
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.reconnecting = false
+		c.mu.Unlock()
+	}()
+
+	var err error
+	backoff := p.Backoff
+	for i := 0; i < p.MaxAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+
+			if backoff *= 2; p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+				backoff = p.MaxBackoff
+			}
+		}
+
+		if err = c.resumeSession(ctx, client, sessionID, resolver); err == nil {
+			c.logger().Info("resumed session")
+			c.stats.add(&c.stats.reconnects, 1)
+			return c.replayOutboundQueue()
+		}
+		c.logger().Info("resume session attempt failed", zap.Int("attempt", i+1), zap.Int("maxAttempts", p.MaxAttempts), zap.Error(err))
+	}
+
+	if err == nil {
+		err = errors.New("no reconnect attempts allowed")
+	}
+	return fmt.Errorf("unable to resume session %s: %w", sessionID, err)
+}
+
+// canReconnect returns true if an error reading from the websocket should trigger an automatic reconnect.
+func (c *SsmDataChannel) canReconnect() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ReconnectPolicy != nil && c.ReconnectPolicy.MaxAttempts > 0 && !c.closed && !c.channelClosed && c.err == nil
+}
+
+func (c *SsmDataChannel) resumeSession(ctx context.Context, client *ssm.Client, sessionID string, resolver *SSMMessagesResover) error {
+	out, err := client.ResumeSession(ctx, &ssm.ResumeSessionInput{
+		SessionId: aws.String(sessionID),
+	})
+	if err != nil {
+		return err
+	}
+
+	// reuse the endpoint override logic, which works on the StartSession output
+	startOut := &ssm.StartSessionOutput{
+		SessionId:  out.SessionId,
+		StreamUrl:  out.StreamUrl,
+		TokenValue: out.TokenValue,
+	}
+	if err = StreamEndpointOverride(resolver, startOut); err != nil {
+		return err
+	}
+
+	ws, _, err := c.dialer().DialContext(ctx, *startOut.StreamUrl, nil) //nolint:bodyclose
+	if err != nil {
+		return err
+	}
+	c.setConn(ws)
+
+	if err = c.openDataChannel(*startOut.TokenValue); err != nil {
+		_ = ws.Close()
+		return err
+	}
+	return nil
+}
+
+// replayOutboundQueue re-sends all unacknowledged messages in sequence number order.
+func (c *SsmDataChannel) replayOutboundQueue() error {
+	if c.outMsgBuf == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, m := range c.outMsgBuf.Messages() {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		if err = c.writeMessage(m, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
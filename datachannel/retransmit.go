@@ -0,0 +1,229 @@
+package datachannel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrMaxRetransmits is the error wrapped by RetransmitError, for use with errors.Is().
+var ErrMaxRetransmits = errors.New("maximum retransmit attempts exceeded")
+
+// RetransmitError is returned when an outbound message is not acknowledged by the agent after the maximum
+// number of retransmission attempts allowed by the RetransmitPolicy.
+type RetransmitError struct {
+	SequenceNumber int64
+	Attempts       int
+}
+
+func (e *RetransmitError) Error() string {
+	return fmt.Sprintf("message %d not acknowledged after %d attempts", e.SequenceNumber, e.Attempts)
+}
+
+func (e *RetransmitError) Unwrap() error {
+	return ErrMaxRetransmits
+}
+
+// RetransmitPolicy configures the retransmission of unacknowledged outbound messages.  The retransmission
+// timeout is calculated from the measured round trip time of acknowledged messages, bounded by MinRTO and
+// MaxRTO, starting at InitialRTO before any round trip time is measured.  Each retransmission of a message
+// doubles its timeout, up to MaxBackoff.  MaxAttempts is the number of retransmissions of a single message
+// allowed before the data channel fails with a RetransmitError.
+type RetransmitPolicy struct {
+	InitialRTO  time.Duration
+	MinRTO      time.Duration
+	MaxRTO      time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+}
+
+// DefaultRetransmitPolicy is the policy used if the data channel RetransmitPolicy field is not set.
+var DefaultRetransmitPolicy = RetransmitPolicy{
+	InitialRTO:  500 * time.Millisecond,
+	MinRTO:      100 * time.Millisecond,
+	MaxRTO:      3 * time.Second,
+	MaxBackoff:  10 * time.Second,
+	MaxAttempts: 30,
+}
+
+// clock is the source of time used by the retransmitter, replaceable for testing.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// pendingMsg is the retransmission state of an unacknowledged message.
+type pendingMsg struct {
+	sentAt   time.Time
+	deadline time.Time
+	attempts int
+}
+
+// retransmitter keeps per-message retransmission timers for sent messages, and maintains the smoothed round
+// trip time estimate used to calculate the retransmission timeout (RFC 6298).
+type retransmitter struct {
+	mu      sync.Mutex
+	policy  RetransmitPolicy
+	clock   clock
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	pending map[int64]*pendingMsg
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newRetransmitter(policy RetransmitPolicy, clk clock) *retransmitter {
+	return &retransmitter{
+		policy:  policy,
+		clock:   clk,
+		rto:     policy.InitialRTO,
+		pending: make(map[int64]*pendingMsg),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// sent starts the retransmission timer for a message.  Calling sent for a message which is already
+// pending has no effect, the timer is managed by due().
+func (r *retransmitter) sent(seqNum int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.pending[seqNum]; ok {
+		return
+	}
+
+	now := r.clock.Now()
+	r.pending[seqNum] = &pendingMsg{sentAt: now, deadline: now.Add(r.rto)}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// acked stops the retransmission timer for a message, and updates the round trip time estimate.  Per Karn's
+// algorithm, retransmitted messages do not provide a round trip time sample.  The round trip time sample is
+// returned, the bool return value is false if the message did not provide a sample.
+func (r *retransmitter) acked(seqNum int64) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.pending[seqNum]
+	if !ok {
+		return 0, false
+	}
+	delete(r.pending, seqNum)
+
+	if p.attempts > 0 {
+		return 0, false
+	}
+
+	rtt := r.clock.Now().Sub(p.sentAt)
+	r.updateRTO(rtt)
+	return rtt, true
+}
+
+// smoothedRTT returns the current smoothed round trip time estimate.
+func (r *retransmitter) smoothedRTT() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.srtt
+}
+
+func (r *retransmitter) updateRTO(rtt time.Duration) {
+	if r.srtt == 0 {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+	} else {
+		delta := r.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		r.rttvar = (3*r.rttvar + delta) / 4
+		r.srtt = (7*r.srtt + rtt) / 8
+	}
+
+	r.rto = r.srtt + 4*r.rttvar
+	if r.rto < r.policy.MinRTO {
+		r.rto = r.policy.MinRTO
+	}
+	if r.policy.MaxRTO > 0 && r.rto > r.policy.MaxRTO {
+		r.rto = r.policy.MaxRTO
+	}
+}
+
+// due returns the sequence numbers of the messages whose retransmission timer has expired, and restarts
+// their timers with a doubled timeout.  A RetransmitError is returned if any message has been retransmitted
+// the maximum number of times.
+func (r *retransmitter) due() ([]int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	var seqs []int64
+
+	for seq, p := range r.pending {
+		if now.Before(p.deadline) {
+			continue
+		}
+
+		if p.attempts >= r.policy.MaxAttempts {
+			return nil, &RetransmitError{SequenceNumber: seq, Attempts: p.attempts}
+		}
+		p.attempts++
+
+		backoff := r.rto
+		for i := 0; i < p.attempts; i++ {
+			if backoff *= 2; r.policy.MaxBackoff > 0 && backoff > r.policy.MaxBackoff {
+				backoff = r.policy.MaxBackoff
+				break
+			}
+		}
+		p.deadline = now.Add(backoff)
+
+		seqs = append(seqs, seq)
+	}
+	return seqs, nil
+}
+
+// nextTimeout returns the time until the earliest retransmission timer expires.  The bool return value is
+// false if there are no pending messages.
+func (r *retransmitter) nextTimeout() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var next time.Time
+	for _, p := range r.pending {
+		if next.IsZero() || p.deadline.Before(next) {
+			next = p.deadline
+		}
+	}
+
+	if next.IsZero() {
+		return 0, false
+	}
+
+	if d := next.Sub(r.clock.Now()); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// stop signals the retransmission loop to exit.
+func (r *retransmitter) stop() {
+	r.once.Do(func() { close(r.done) })
+}
@@ -0,0 +1,212 @@
+package datachannel
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only moves forward with Advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward, firing the expired timers.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// Waiters returns the number of timers which have not fired.
+func (c *fakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+var testRetransmitPolicy = RetransmitPolicy{
+	InitialRTO:  500 * time.Millisecond,
+	MinRTO:      100 * time.Millisecond,
+	MaxRTO:      3 * time.Second,
+	MaxBackoff:  time.Second,
+	MaxAttempts: 3,
+}
+
+// ack sends the message, and acknowledges it after the round trip time.
+func ack(t *testing.T, r *retransmitter, clk *fakeClock, seq int64, rtt time.Duration) {
+	t.Helper()
+	r.sent(seq)
+	clk.Advance(rtt)
+	if sample, ok := r.acked(seq); !ok || sample != rtt {
+		t.Fatalf("unexpected round trip time sample %v (%v)", sample, ok)
+	}
+}
+
+func TestRetransmitterRTO(t *testing.T) {
+	clk := newFakeClock()
+	r := newRetransmitter(testRetransmitPolicy, clk)
+
+	if r.rto != testRetransmitPolicy.InitialRTO {
+		t.Fatalf("unexpected initial RTO %v", r.rto)
+	}
+
+	// the first sample sets the smoothed RTT, and an RTT variation of half the sample
+	ack(t, r, clk, 1, 200*time.Millisecond)
+	if r.smoothedRTT() != 200*time.Millisecond || r.rttvar != 100*time.Millisecond || r.rto != 600*time.Millisecond {
+		t.Errorf("unexpected estimate srtt %v, rttvar %v, rto %v", r.srtt, r.rttvar, r.rto)
+	}
+
+	// srtt = 7/8 * 200ms + 1/8 * 100ms, rttvar = 3/4 * 100ms + 1/4 * |200ms - 100ms|
+	ack(t, r, clk, 2, 100*time.Millisecond)
+	if r.smoothedRTT() != 187500*time.Microsecond || r.rttvar != 100*time.Millisecond || r.rto != 587500*time.Microsecond {
+		t.Errorf("unexpected estimate srtt %v, rttvar %v, rto %v", r.srtt, r.rttvar, r.rto)
+	}
+
+	// a steady round trip time converges towards the MinRTO bound
+	for seq := int64(3); seq < 100; seq++ {
+		ack(t, r, clk, seq, 10*time.Millisecond)
+	}
+	if r.rto != testRetransmitPolicy.MinRTO {
+		t.Errorf("RTO %v not bounded by MinRTO", r.rto)
+	}
+
+	r = newRetransmitter(testRetransmitPolicy, clk)
+	ack(t, r, clk, 1, 2*time.Second)
+	if r.rto != testRetransmitPolicy.MaxRTO {
+		t.Errorf("RTO %v not bounded by MaxRTO", r.rto)
+	}
+}
+
+func TestRetransmitterKarn(t *testing.T) {
+	clk := newFakeClock()
+	r := newRetransmitter(testRetransmitPolicy, clk)
+
+	r.sent(1)
+	clk.Advance(testRetransmitPolicy.InitialRTO)
+	if seqs, err := r.due(); err != nil || len(seqs) != 1 {
+		t.Fatalf("unexpected retransmits %v: %v", seqs, err)
+	}
+
+	// the acknowledgement may be for either transmission, it is not a round trip time sample
+	clk.Advance(10 * time.Millisecond)
+	if _, ok := r.acked(1); ok {
+		t.Error("round trip time sampled from a retransmitted message")
+	}
+	if r.rto != testRetransmitPolicy.InitialRTO {
+		t.Errorf("RTO changed to %v", r.rto)
+	}
+}
+
+func TestRetransmitterBackoff(t *testing.T) {
+	clk := newFakeClock()
+	r := newRetransmitter(testRetransmitPolicy, clk)
+
+	r.sent(1)
+	if d, ok := r.nextTimeout(); !ok || d != testRetransmitPolicy.InitialRTO {
+		t.Fatalf("unexpected timeout %v (%v)", d, ok)
+	}
+
+	// the timeout doubles with each retransmission (500ms to 1s), and is then capped by MaxBackoff
+	for attempt := 1; attempt <= testRetransmitPolicy.MaxAttempts; attempt++ {
+		d, _ := r.nextTimeout()
+		clk.Advance(d)
+
+		seqs, err := r.due()
+		if err != nil || len(seqs) != 1 || seqs[0] != 1 {
+			t.Fatalf("attempt %d: unexpected retransmits %v: %v", attempt, seqs, err)
+		}
+
+		if d, _ = r.nextTimeout(); d != testRetransmitPolicy.MaxBackoff {
+			t.Errorf("attempt %d: timeout %v, want %v", attempt, d, testRetransmitPolicy.MaxBackoff)
+		}
+	}
+
+	// the message is not due before its timer expires
+	clk.Advance(testRetransmitPolicy.MaxBackoff / 2)
+	if seqs, err := r.due(); err != nil || len(seqs) != 0 {
+		t.Fatalf("unexpected retransmits %v: %v", seqs, err)
+	}
+
+	clk.Advance(testRetransmitPolicy.MaxBackoff / 2)
+	_, err := r.due()
+
+	var rtxErr *RetransmitError
+	if !errors.As(err, &rtxErr) || !errors.Is(err, ErrMaxRetransmits) {
+		t.Fatalf("expected a RetransmitError, got %v", err)
+	}
+	if rtxErr.SequenceNumber != 1 || rtxErr.Attempts != testRetransmitPolicy.MaxAttempts {
+		t.Errorf("unexpected error %+v", rtxErr)
+	}
+}
+
+func TestProcessOutboundQueueStopsWhilePaused(t *testing.T) {
+	clk := newFakeClock()
+	c := &SsmDataChannel{pausePub: true}
+	c.rtx = newRetransmitter(testRetransmitPolicy, clk)
+	c.rtx.sent(1)
+	<-c.rtx.wake
+
+	done := make(chan struct{})
+	go func() {
+		c.processOutboundQueue()
+		close(done)
+	}()
+
+	waitForWaiters := func() {
+		for deadline := time.Now().Add(time.Second); clk.Waiters() != 1; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("processOutboundQueue is not waiting")
+			}
+		}
+	}
+
+	// the retransmission timer expires, then the loop waits for the end of the pause
+	waitForWaiters()
+	clk.Advance(testRetransmitPolicy.InitialRTO)
+	waitForWaiters()
+
+	c.rtx.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("processOutboundQueue did not stop while paused")
+	}
+}
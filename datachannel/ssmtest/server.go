@@ -0,0 +1,399 @@
+// Package ssmtest provides an in-process fake of the AWS SSM session APIs and the ssmmessages websocket
+// endpoint, with the remote end of the session played by a fake SSM agent.  It allows the data channel, and
+// the shell, SSH and port forwarding flows built on it, to be exercised without AWS.
+//
+// The fake agent implements the parts of the agent protocol used by the data channel: the OpenDataChannel token
+// check, acknowledgement and retransmission of messages, in-order delivery of input (input sent before the handshake
+// is held until the session starts), the handshake request and
+// complete exchange, PausePublication and StartPublication, ChannelClosed, and the TerminateSession and
+// DisconnectToPort flags.  Data sent by the client is passed to a Handler (Echo by default), port sessions are
+// multiplexed with smux when both the client and agent versions support it, like the real agent.
+//
+// Faults can be injected in the messages exchanged with the client (drops, reordering, duplicates and delays),
+// to test the recovery of the data channel.
+package ssmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultAgentVersion is the agent version reported in the handshake if Options.AgentVersion is not set,
+	// new enough for port sessions to be multiplexed.
+	DefaultAgentVersion = "3.3.1142.0"
+
+	// session types reported in the handshake request
+	SessionTypeShell = "Standard_Stream"
+	SessionTypePort  = "Port"
+
+	defaultRetransmitInterval = 100 * time.Millisecond
+	dataChannelPath           = "/v1/data-channel/"
+)
+
+// Handler processes a stream of data from the client.  Reading from the stream returns the data sent by the
+// client, and data written to the stream is sent to the client.  A shell session has a single stream, a port
+// session has a stream per forwarded connection.  The handler must keep reading the stream, otherwise the
+// delivery of messages from the client (and the acknowledgements) stalls.
+type Handler func(rw io.ReadWriter)
+
+// Echo is a Handler which sends all data received from the client back to the client.
+func Echo(rw io.ReadWriter) {
+	_, _ = io.Copy(rw, rw)
+}
+
+// Faults configures the faults injected by the fake agent.  Drop is the probability that a message (in either
+// direction) is discarded, Duplicate and Reorder are the probabilities that a message sent to the client is sent
+// twice, or held back and sent after the next message.  Each message sent to the client is delayed by a random
+// duration up to Delay.  Seed makes the injected faults repeatable.
+type Faults struct {
+	Drop      float64
+	Duplicate float64
+	Reorder   float64
+	Delay     time.Duration
+	Seed      int64
+}
+
+// Options configures the fake agent.  If SessionType is not set, it is selected from the document name used to
+// start the session: SessionTypePort for port forwarding and SSH documents, otherwise SessionTypeShell.  Messages
+// not acknowledged by the client are retransmitted every RetransmitInterval.  Documents are the documents returned
+// by the DescribeDocument API, by name.
+type Options struct {
+	AgentVersion       string
+	SessionType        string
+	CustomerMessage    string
+	Handler            Handler
+	Faults             Faults
+	RetransmitInterval time.Duration
+	Documents          map[string]Document
+}
+
+// Document is a document returned by the DescribeDocument API of the fake server.  Type is the document type,
+// "Session" if not set.
+type Document struct {
+	Type       string
+	Parameters []DocumentParameter
+}
+
+// DocumentParameter is a parameter declared by a Document, a nil DefaultValue makes the parameter required.  Type
+// is "String" or "StringList", "String" if not set.
+type DocumentParameter struct {
+	Name         string
+	Type         string
+	DefaultValue *string
+}
+
+// Server is the fake SSM API and ssmmessages endpoint.  The SSM API (StartSession, ResumeSession,
+// TerminateSession and DescribeDocument) is served at URL, use AWSConfig to create clients for it.
+type Server struct {
+	URL string
+
+	opts Options
+	srv  *httptest.Server
+
+	mu       sync.Mutex
+	sessions []*Session
+	rnd      *rand.Rand
+}
+
+// NewServer starts a Server, which should be closed when finished.  A nil Options uses the defaults.
+func NewServer(opts *Options) *Server {
+	s := new(Server)
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	if s.opts.AgentVersion == "" {
+		s.opts.AgentVersion = DefaultAgentVersion
+	}
+
+	if s.opts.Handler == nil {
+		s.opts.Handler = Echo
+	}
+
+	if s.opts.RetransmitInterval <= 0 {
+		s.opts.RetransmitInterval = defaultRetransmitInterval
+	}
+
+	seed := s.opts.Faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s.rnd = rand.New(rand.NewSource(seed)) //nolint:gosec // fault injection doesn't need a secure source
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(dataChannelPath, s.handleDataChannel)
+	mux.HandleFunc("/", s.handleAPI)
+
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server, and all sessions.
+func (s *Server) Close() {
+	for _, sess := range s.Sessions() {
+		sess.close()
+	}
+	s.srv.Close()
+}
+
+// AWSConfig returns an aws.Config which sends the SSM API requests to the Server.
+func (s *Server) AWSConfig() aws.Config {
+	return aws.Config{
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+		BaseEndpoint: aws.String(s.URL),
+	}
+}
+
+// StartSession creates a session without calling the SSM API, the StreamUrl and TokenValue of the output can be
+// used with the data channel StartSessionFromDataChannelURL method.
+func (s *Server) StartSession(in *ssm.StartSessionInput) *ssm.StartSessionOutput {
+	sess := s.newSession(in)
+	return &ssm.StartSessionOutput{
+		SessionId:  aws.String(sess.id),
+		StreamUrl:  aws.String(sess.streamURL()),
+		TokenValue: aws.String(sess.token),
+	}
+}
+
+// Sessions returns all sessions created by the server, in the order they were started.
+func (s *Server) Sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Session(nil), s.sessions...)
+}
+
+// LastSession returns the most recently started session, or nil if no session has been started.
+func (s *Server) LastSession() *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.sessions) < 1 {
+		return nil
+	}
+	return s.sessions[len(s.sessions)-1]
+}
+
+func (s *Server) session(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sess := range s.sessions {
+		if sess.id == id {
+			return sess
+		}
+	}
+	return nil
+}
+
+func (s *Server) newSession(in *ssm.StartSessionInput) *Session {
+	sessionType := s.opts.SessionType
+	if sessionType == "" {
+		sessionType = SessionTypeShell
+		doc := aws.ToString(in.DocumentName)
+		if strings.Contains(doc, "PortForwarding") || strings.Contains(doc, "SSH") {
+			sessionType = SessionTypePort
+		}
+	}
+
+	sess := newSession(s, in, sessionType)
+
+	s.mu.Lock()
+	s.sessions = append(s.sessions, sess)
+	s.mu.Unlock()
+
+	go sess.processRetransmits()
+	return sess
+}
+
+// chance returns true with the given probability.
+func (s *Server) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rnd.Float64() < p
+}
+
+// delay returns a random duration up to the Delay fault.
+func (s *Server) delay() time.Duration {
+	if s.opts.Faults.Delay <= 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.rnd.Int63n(int64(s.opts.Faults.Delay)))
+}
+
+// handleAPI serves the SSM API actions used by the session client, using the AWS JSON 1.1 protocol.
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+
+	var out interface{}
+	switch target {
+	case "AmazonSSM.StartSession":
+		in := new(startSessionRequest)
+		if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+			apiError(w, "ValidationException", err.Error())
+			return
+		}
+
+		so := s.StartSession(&ssm.StartSessionInput{
+			Target:       aws.String(in.Target),
+			DocumentName: in.DocumentName,
+			Parameters:   in.Parameters,
+			Reason:       in.Reason,
+		})
+		out = &sessionResponse{SessionID: *so.SessionId, StreamURL: *so.StreamUrl, TokenValue: *so.TokenValue}
+	case "AmazonSSM.ResumeSession":
+		in := new(sessionRequest)
+		if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+			apiError(w, "ValidationException", err.Error())
+			return
+		}
+
+		sess := s.session(in.SessionID)
+		if sess == nil || sess.isTerminated() {
+			apiError(w, "DoesNotExistException", fmt.Sprintf("session %s does not exist", in.SessionID))
+			return
+		}
+		out = &sessionResponse{SessionID: sess.id, StreamURL: sess.streamURL(), TokenValue: sess.newToken()}
+	case "AmazonSSM.TerminateSession":
+		in := new(sessionRequest)
+		if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+			apiError(w, "ValidationException", err.Error())
+			return
+		}
+
+		if sess := s.session(in.SessionID); sess != nil {
+			sess.terminate()
+		}
+		out = &sessionResponse{SessionID: in.SessionID}
+	case "AmazonSSM.DescribeDocument":
+		in := new(describeDocumentRequest)
+		if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+			apiError(w, "ValidationException", err.Error())
+			return
+		}
+
+		doc, ok := s.opts.Documents[in.Name]
+		if !ok {
+			apiError(w, "InvalidDocument", fmt.Sprintf("document %s does not exist", in.Name))
+			return
+		}
+		out = newDescribeDocumentResponse(in.Name, &doc)
+	default:
+		apiError(w, "UnknownOperationException", fmt.Sprintf("unsupported operation %q", target))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleDataChannel serves the ssmmessages websocket connection of a session.
+func (s *Server) handleDataChannel(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(strings.TrimPrefix(r.URL.Path, dataChannelPath))
+	if sess == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	up := websocket.Upgrader{}
+	ws, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	sess.serve(r.Context(), ws)
+}
+
+func apiError(w http.ResponseWriter, code, msg string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": msg})
+}
+
+type startSessionRequest struct {
+	Target       string
+	DocumentName *string
+	Parameters   map[string][]string
+	Reason       *string
+}
+
+type describeDocumentRequest struct {
+	Name string
+}
+
+type describeDocumentResponse struct {
+	Document struct {
+		Name         string
+		DocumentType string
+		Parameters   []DocumentParameter
+	}
+}
+
+func newDescribeDocumentResponse(name string, doc *Document) *describeDocumentResponse {
+	out := new(describeDocumentResponse)
+	out.Document.Name = name
+	out.Document.DocumentType = doc.Type
+	if out.Document.DocumentType == "" {
+		out.Document.DocumentType = "Session"
+	}
+
+	for _, p := range doc.Parameters {
+		if p.Type == "" {
+			p.Type = "String"
+		}
+		out.Document.Parameters = append(out.Document.Parameters, p)
+	}
+	return out
+}
+
+type sessionRequest struct {
+	SessionID string `json:"SessionId"`
+}
+
+type sessionResponse struct {
+	SessionID  string `json:"SessionId"`
+	StreamURL  string `json:"StreamUrl,omitempty"`
+	TokenValue string `json:",omitempty"`
+}
+
+// openDataChannelInput is the first (text) message sent by the client on the websocket connection.
+type openDataChannelInput struct {
+	MessageSchemaVersion string
+	RequestID            string `json:"RequestId"`
+	TokenValue           string
+}
+
+func newID() string {
+	return uuid.NewString()
+}
+
+func sortedKeys(m map[int64][]byte) []int64 {
+	keys := make([]int64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
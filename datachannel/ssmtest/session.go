@@ -0,0 +1,669 @@
+package ssmtest
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/gorilla/websocket"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// maxPayloadSize is the largest payload sent to the client in a single message, the data channel read
+	// buffers are sized for messages of this size
+	maxPayloadSize = 1024
+
+	// versions required to multiplex port sessions
+	// REF: https://github.com/aws/amazon-ssm-agent/blob/mainline/agent/session/plugins/port/port.go
+	muxMinAgentVersion  = "3.0.196.0"
+	muxMinClientVersion = "1.1.70"
+)
+
+// Session is the fake agent side of a session started on the Server.  The methods of Session can be used to
+// inspect what the client has sent, and to send control messages to the client.
+type Session struct {
+	srv         *Server
+	id          string
+	input       ssm.StartSessionInput
+	sessionType string
+	started     time.Time
+	done        chan struct{}
+	closeOnce   sync.Once
+
+	mu         sync.Mutex
+	token      string
+	ws         *websocket.Conn
+	seqNum     int64
+	pending    map[int64][]byte
+	held       [][]byte
+	expected   int64
+	inbound    map[int64]*datachannel.AgentMessage
+	handshake  *datachannel.HandshakeResponsePayload
+	opened     bool
+	rows, cols uint32
+	flags      []datachannel.PayloadTypeFlag
+	terminated bool
+	in         *io.PipeWriter
+	early      [][]byte // input received before the stream started
+	dropInput  bool     // the messages of the client are lost until Disconnect
+	noPong     bool     // the pings of the client are not answered
+	mux        *smux.Session
+
+	writeMu sync.Mutex
+}
+
+func newSession(srv *Server, in *ssm.StartSessionInput, sessionType string) *Session {
+	return &Session{
+		srv:         srv,
+		id:          newID(),
+		input:       *in,
+		sessionType: sessionType,
+		started:     time.Now(),
+		done:        make(chan struct{}),
+		token:       newID(),
+		pending:     make(map[int64][]byte),
+		inbound:     make(map[int64]*datachannel.AgentMessage),
+	}
+}
+
+// ID returns the session ID.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Input returns the StartSession API input used to start the session.
+func (s *Session) Input() *ssm.StartSessionInput {
+	in := s.input
+	return &in
+}
+
+// Handshake returns the HandshakeResponse sent by the client, or nil if the handshake has not been received.
+func (s *Session) Handshake() *datachannel.HandshakeResponsePayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handshake
+}
+
+// TerminalSize returns the last terminal size sent by the client.
+func (s *Session) TerminalSize() (rows, cols uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rows, s.cols
+}
+
+// Flags returns the flag messages (like DisconnectToPort) received from the client, in order.
+func (s *Session) Flags() []datachannel.PayloadTypeFlag {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]datachannel.PayloadTypeFlag(nil), s.flags...)
+}
+
+// Terminated returns true if the session was terminated by the client (using the TerminateSession flag or API).
+func (s *Session) Terminated() bool {
+	return s.isTerminated()
+}
+
+// Connected returns true if the client has a websocket connection open for the session.
+func (s *Session) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ws != nil
+}
+
+// Unacknowledged returns the number of messages sent to the client which have not been acknowledged.
+func (s *Session) Unacknowledged() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Send sends the data to the client as output, outside any Handler stream.
+func (s *Session) Send(data []byte) {
+	for len(data) > 0 {
+		sz := len(data)
+		if sz > maxPayloadSize {
+			sz = maxPayloadSize
+		}
+
+		s.sendReliable(datachannel.Output, data[:sz])
+		data = data[sz:]
+	}
+}
+
+// SendPayload sends an output stream message with the payload type and payload, like the StdErr output or a Flag.
+func (s *Session) SendPayload(payloadType datachannel.PayloadType, payload []byte) {
+	s.sendReliable(payloadType, payload)
+}
+
+// SendMessage sends a message of the given type outside the output stream (not retransmitted), like the
+// agent_session_state message.
+func (s *Session) SendMessage(messageType datachannel.MessageType, payload []byte) {
+	s.write(s.marshal(messageType, 0, datachannel.Data, datachannel.Undefined, payload))
+}
+
+// PausePublication asks the client to stop sending messages.
+func (s *Session) PausePublication() {
+	s.write(s.marshal(datachannel.PausePublication, 0, datachannel.Data, datachannel.Undefined, nil))
+}
+
+// StartPublication allows the client to send messages after PausePublication.
+func (s *Session) StartPublication() {
+	s.write(s.marshal(datachannel.StartPublication, 0, datachannel.Data, datachannel.Undefined, nil))
+}
+
+// CloseChannel sends the ChannelClosed message to the client, with the output as the final session output.
+func (s *Session) CloseChannel(output string) {
+	payload, _ := json.Marshal(&datachannel.ChannelClosedPayload{
+		MessageType:   string(datachannel.ChannelClosed),
+		MessageID:     newID(),
+		SessionID:     s.id,
+		SchemaVersion: 1,
+		CreatedDate:   time.Now().UTC().Format(time.RFC3339),
+		Output:        output,
+	})
+
+	s.write(s.marshal(datachannel.ChannelClosed, 0, datachannel.Data, datachannel.Undefined, payload))
+}
+
+// DropInput discards the messages received from the client, as if lost on a broken connection, until
+// Disconnect closes the connection.  The messages are not acknowledged, so the client must send them again.
+func (s *Session) DropInput() {
+	s.mu.Lock()
+	s.dropInput = true
+	s.mu.Unlock()
+}
+
+// IgnorePings stops answering the websocket pings of the client with a pong, like a half-open connection.
+func (s *Session) IgnorePings() {
+	s.mu.Lock()
+	s.noPong = true
+	s.mu.Unlock()
+}
+
+// Disconnect closes the websocket connection of the session, without closing the session.  The client can
+// resume the session using the ResumeSession API.
+func (s *Session) Disconnect() {
+	s.mu.Lock()
+	ws := s.ws
+	s.ws = nil
+	s.dropInput = false
+	s.mu.Unlock()
+
+	if ws != nil {
+		_ = ws.Close()
+	}
+}
+
+func (s *Session) streamURL() string {
+	return strings.Replace(s.srv.URL, "http", "ws", 1) + dataChannelPath + s.id + "?role=publish_subscribe"
+}
+
+// newToken replaces the session token, for ResumeSession.
+func (s *Session) newToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = newID()
+	return s.token
+}
+
+func (s *Session) isTerminated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.terminated
+}
+
+// serve runs the agent protocol over a websocket connection, until the connection is closed.
+func (s *Session) serve(ctx context.Context, ws *websocket.Conn) {
+	defer ws.Close()
+
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return
+	}
+
+	in := new(openDataChannelInput)
+	_ = json.Unmarshal(data, in)
+
+	s.mu.Lock()
+	valid := in.TokenValue != "" && in.TokenValue == s.token && !s.terminated
+	if valid {
+		if s.ws != nil {
+			_ = s.ws.Close()
+		}
+		s.ws = ws
+	}
+	resumed := s.opened
+	s.opened = true
+	s.mu.Unlock()
+
+	if !valid {
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid token")
+		_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		return
+	}
+
+	ws.SetPingHandler(func(data string) error {
+		s.mu.Lock()
+		noPong := s.noPong
+		s.mu.Unlock()
+
+		if !noPong {
+			_ = ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		}
+		return nil
+	})
+
+	if resumed {
+		s.retransmit()
+	} else {
+		s.sendHandshakeRequest()
+	}
+
+	for ctx.Err() == nil {
+		_, data, err = ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		s.receive(data)
+	}
+
+	s.mu.Lock()
+	if s.ws == ws {
+		s.ws = nil
+	}
+	s.mu.Unlock()
+}
+
+// receive handles a message from the client.
+func (s *Session) receive(data []byte) {
+	m := new(datachannel.AgentMessage)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	drop := s.dropInput
+	s.mu.Unlock()
+
+	if drop || s.srv.chance(s.srv.opts.Faults.Drop) {
+		return
+	}
+
+	//nolint:exhaustive // the client only sends these message types
+	switch m.MessageType {
+	case datachannel.Acknowledge:
+		ack := new(datachannel.AcknowledgeContent)
+		if err := json.Unmarshal(m.Payload, ack); err != nil {
+			return
+		}
+
+		if ack.AcknowledgedMessageType != datachannel.OutputStreamData {
+			// the client also acknowledges control and acknowledge messages, which are not retransmitted
+			return
+		}
+
+		s.mu.Lock()
+		delete(s.pending, ack.AcknowledgedMessageSequenceNumber)
+		s.mu.Unlock()
+	case datachannel.InputStreamData:
+		s.sendAcknowledge(m)
+
+		for _, msg := range s.reorder(m) {
+			s.process(msg)
+		}
+	}
+}
+
+// reorder buffers the message, and returns the messages which can be processed in sequence order.
+func (s *Session) reorder(m *datachannel.AgentMessage) []*datachannel.AgentMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.SequenceNumber < s.expected {
+		return nil
+	}
+	s.inbound[m.SequenceNumber] = m
+
+	var msgs []*datachannel.AgentMessage
+	for {
+		next, ok := s.inbound[s.expected]
+		if !ok {
+			return msgs
+		}
+
+		delete(s.inbound, s.expected)
+		s.expected++
+		msgs = append(msgs, next)
+	}
+}
+
+// process handles an input message from the client, in sequence order.
+func (s *Session) process(m *datachannel.AgentMessage) {
+	//nolint:exhaustive // the client only sends these payload types
+	switch m.PayloadType {
+	case datachannel.HandshakeResponse:
+		res := new(datachannel.HandshakeResponsePayload)
+		if err := json.Unmarshal(m.Payload, res); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.handshake = res
+		s.mu.Unlock()
+
+		payload, _ := json.Marshal(&datachannel.HandshakeCompletePayload{
+			HandshakeTimeToComplete: time.Since(s.started),
+			CustomerMessage:         s.srv.opts.CustomerMessage,
+		})
+		s.sendReliable(datachannel.HandshakeComplete, payload)
+		s.startStream()
+	case datachannel.Output:
+		s.mu.Lock()
+		in := s.in
+		if in == nil {
+			// input sent before the handshake is delivered in order once the stream starts
+			s.early = append(s.early, m.Payload)
+		}
+		s.mu.Unlock()
+
+		if in != nil {
+			_, _ = in.Write(m.Payload)
+		}
+	case datachannel.Size:
+		size := make(map[string]uint32)
+		if err := json.Unmarshal(m.Payload, &size); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.rows, s.cols = size["rows"], size["cols"]
+		s.mu.Unlock()
+	case datachannel.Flag:
+		if len(m.Payload) < 4 {
+			return
+		}
+		flag := datachannel.PayloadTypeFlag(binary.BigEndian.Uint32(m.Payload))
+
+		s.mu.Lock()
+		s.flags = append(s.flags, flag)
+		s.mu.Unlock()
+
+		//nolint:exhaustive // ConnectToPortError is only sent by the agent
+		switch flag {
+		case datachannel.TerminateSession:
+			s.terminate()
+		case datachannel.DisconnectToPort:
+			// the agent closes the connection to the port, and opens a new one for the next client connection
+			s.startStream()
+		}
+	}
+}
+
+// startStream starts the Handler for the session data.  Port sessions are multiplexed, with a Handler per
+// stream, if both the agent and the client support it.
+func (s *Session) startStream() {
+	pr, pw := io.Pipe()
+	conn := &pipeConn{r: pr, s: s}
+
+	s.mu.Lock()
+	if s.in != nil {
+		_ = s.in.Close()
+	}
+	s.in = pw
+	early := s.early
+	s.early = nil
+	clientVersion := ""
+	if s.handshake != nil {
+		clientVersion = s.handshake.ClientVersion
+	}
+	s.mu.Unlock()
+
+	// the Handler is started first, the writes block until the stream is read
+	defer func() {
+		for _, data := range early {
+			_, _ = pw.Write(data)
+		}
+	}()
+
+	if s.sessionType == SessionTypePort && datachannel.VersionAfter(s.srv.opts.AgentVersion, muxMinAgentVersion) &&
+		datachannel.VersionAfter(clientVersion, muxMinClientVersion) {
+		cfg := smux.DefaultConfig()
+		cfg.KeepAliveDisabled = true
+
+		mux, err := smux.Server(conn, cfg)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.mux != nil {
+			_ = s.mux.Close()
+		}
+		s.mux = mux
+		s.mu.Unlock()
+
+		go func() {
+			for {
+				st, err := mux.AcceptStream()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					s.srv.opts.Handler(st)
+					_ = st.Close()
+				}()
+			}
+		}()
+		return
+	}
+
+	go func() {
+		s.srv.opts.Handler(conn)
+		if s.sessionType == SessionTypeShell && !s.isTerminated() {
+			// the shell exited
+			s.CloseChannel("")
+		}
+	}()
+}
+
+// terminate ends the session, closing the client connection and the Handler streams.
+func (s *Session) terminate() {
+	s.mu.Lock()
+	already := s.terminated
+	s.terminated = true
+	s.mu.Unlock()
+
+	if !already {
+		s.CloseChannel("")
+	}
+	s.close()
+}
+
+func (s *Session) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	s.mu.Lock()
+	in, mux := s.in, s.mux
+	s.mu.Unlock()
+
+	if in != nil {
+		_ = in.Close()
+	}
+
+	if mux != nil {
+		_ = mux.Close()
+	}
+	s.Disconnect()
+}
+
+func (s *Session) sendHandshakeRequest() {
+	props := make(map[string]string)
+	for k, v := range s.input.Parameters {
+		if len(v) > 0 {
+			props[k] = v[0]
+		}
+	}
+
+	payload, _ := json.Marshal(&datachannel.HandshakeRequestPayload{
+		AgentVersion: s.srv.opts.AgentVersion,
+		RequestedClientActions: []datachannel.RequestedClientAction{
+			{
+				ActionType: datachannel.SessionType,
+				ActionParameters: &datachannel.SessionTypeRequest{
+					SessionType: s.sessionType,
+					Properties:  props,
+				},
+			},
+		},
+	})
+	s.sendReliable(datachannel.HandshakeRequest, payload)
+}
+
+func (s *Session) sendAcknowledge(m *datachannel.AgentMessage) {
+	payload, _ := json.Marshal(&datachannel.AcknowledgeContent{
+		AcknowledgedMessageType:           m.MessageType,
+		AcknowledgedMessageID:             newID(),
+		AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+
+	s.transmit(s.marshal(datachannel.Acknowledge, m.SequenceNumber, datachannel.Ack, datachannel.Undefined, payload))
+}
+
+// sendReliable sends an output stream message, which is retransmitted until acknowledged by the client.
+func (s *Session) sendReliable(payloadType datachannel.PayloadType, payload []byte) {
+	s.mu.Lock()
+	seq := s.seqNum
+	s.seqNum++
+	data := s.marshal(datachannel.OutputStreamData, seq, datachannel.Data, payloadType, payload)
+	s.pending[seq] = data
+	s.mu.Unlock()
+
+	s.transmit(data)
+}
+
+func (s *Session) marshal(mt datachannel.MessageType, seq int64, flags datachannel.AgentMessageFlag, pt datachannel.PayloadType, payload []byte) []byte {
+	m := datachannel.NewAgentMessage()
+	m.MessageType = mt
+	m.SequenceNumber = seq
+	m.Flags = flags
+	m.PayloadType = pt
+	m.Payload = append([]byte(nil), payload...)
+
+	data, _ := m.MarshalBinary()
+	return data
+}
+
+// transmit sends a message to the client, applying the configured faults.
+func (s *Session) transmit(data []byte) {
+	f := s.srv.opts.Faults
+
+	if s.srv.chance(f.Drop) {
+		return
+	}
+
+	if s.srv.chance(f.Reorder) {
+		s.mu.Lock()
+		s.held = append(s.held, data)
+		s.mu.Unlock()
+		return
+	}
+
+	send := func() {
+		s.write(data)
+		if s.srv.chance(f.Duplicate) {
+			s.write(data)
+		}
+		s.releaseHeld()
+	}
+
+	if d := s.srv.delay(); d > 0 {
+		time.AfterFunc(d, send)
+		return
+	}
+	send()
+}
+
+// releaseHeld sends the messages held back by the Reorder fault.
+func (s *Session) releaseHeld() {
+	s.mu.Lock()
+	held := s.held
+	s.held = nil
+	s.mu.Unlock()
+
+	for _, data := range held {
+		s.write(data)
+	}
+}
+
+func (s *Session) write(data []byte) {
+	s.mu.Lock()
+	ws := s.ws
+	s.mu.Unlock()
+
+	if ws == nil {
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// processRetransmits re-sends unacknowledged messages every RetransmitInterval, until the session is closed.
+func (s *Session) processRetransmits() {
+	t := time.NewTicker(s.srv.opts.RetransmitInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.retransmit()
+		}
+	}
+}
+
+func (s *Session) retransmit() {
+	s.mu.Lock()
+	msgs := make([][]byte, 0, len(s.pending))
+	for _, seq := range sortedKeys(s.pending) {
+		msgs = append(msgs, s.pending[seq])
+	}
+	s.mu.Unlock()
+
+	for _, data := range msgs {
+		s.transmit(data)
+	}
+	s.releaseHeld()
+}
+
+// pipeConn is a Handler stream (or the smux connection) for the session data.  Reads return the data sent by
+// the client, writes send output to the client.
+type pipeConn struct {
+	r *io.PipeReader
+	s *Session
+}
+
+func (c *pipeConn) Read(data []byte) (int, error) {
+	return c.r.Read(data)
+}
+
+func (c *pipeConn) Write(data []byte) (int, error) {
+	c.s.Send(data)
+	return len(data), nil
+}
+
+func (c *pipeConn) Close() error {
+	return c.r.Close()
+}
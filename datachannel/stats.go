@@ -0,0 +1,180 @@
+package datachannel
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of the latency histograms in Stats.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// Stats is a snapshot of the statistics of a data channel.  Message counts include all message types (like
+// acknowledgements and retransmissions), byte counts are the session data (the payload of Output messages,
+// before encryption).  PausedTime is the total time publication was paused by the agent, including the current
+// pause.  Unacknowledged and SmoothedRTT are the current size of the send window, and the round trip time
+// estimate used for retransmissions.
+type Stats struct {
+	SessionID        string
+	TargetID         string
+	Closed           bool
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
+	Retransmits      uint64
+	Reconnects       uint64
+	Pauses           uint64
+	PausedTime       time.Duration
+	Unacknowledged   int
+	SmoothedRTT      time.Duration
+	AckLatency       Histogram
+	PauseDuration    Histogram
+}
+
+// Histogram is a snapshot of a latency distribution.  Counts holds the cumulative number of observations less
+// than or equal to each of the Bounds, the number of observations above the last bound is Count minus the last
+// value of Counts.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// histogram collects the observations of a Histogram, counts are per bucket (not cumulative) with an extra
+// bucket for the observations above the last bound.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(LatencyBuckets)+1)
+	}
+
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Bounds: LatencyBuckets,
+		Counts: make([]uint64, len(LatencyBuckets)),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+
+	var total uint64
+	for i := range s.Counts {
+		if h.counts != nil {
+			total += h.counts[i]
+		}
+		s.Counts[i] = total
+	}
+	return s
+}
+
+// channelStats holds the statistics of a data channel, guarded by its own mutex so updates don't contend with
+// the data channel state.
+type channelStats struct {
+	mu               sync.Mutex
+	messagesSent     uint64
+	messagesReceived uint64
+	bytesSent        uint64
+	bytesReceived    uint64
+	retransmits      uint64
+	reconnects       uint64
+	pauses           uint64
+	pausedTime       time.Duration
+	pausedAt         time.Time
+	ackLatency       histogram
+	pauseDuration    histogram
+}
+
+func (s *channelStats) add(counter *uint64, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*counter += uint64(n)
+}
+
+func (s *channelStats) observeAck(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackLatency.observe(rtt)
+}
+
+// setPaused records the start or end of a pause of publication.
+func (s *channelStats) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case paused && s.pausedAt.IsZero():
+		s.pauses++
+		s.pausedAt = time.Now()
+	case !paused && !s.pausedAt.IsZero():
+		d := time.Since(s.pausedAt)
+		s.pausedTime += d
+		s.pauseDuration.observe(d)
+		s.pausedAt = time.Time{}
+	}
+}
+
+// Stats returns a snapshot of the data channel statistics.
+func (c *SsmDataChannel) Stats() Stats {
+	c.mu.Lock()
+	st := Stats{
+		SessionID: c.sessionID,
+		TargetID:  c.targetID,
+		Closed:    c.closed || c.channelClosed || c.err != nil,
+	}
+	c.mu.Unlock()
+
+	if c.outMsgBuf != nil {
+		st.Unacknowledged = c.outMsgBuf.Len()
+	}
+
+	if c.rtx != nil {
+		st.SmoothedRTT = c.rtx.smoothedRTT()
+	}
+
+	s := &c.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st.MessagesSent = s.messagesSent
+	st.MessagesReceived = s.messagesReceived
+	st.BytesSent = s.bytesSent
+	st.BytesReceived = s.bytesReceived
+	st.Retransmits = s.retransmits
+	st.Reconnects = s.reconnects
+	st.Pauses = s.pauses
+	st.PausedTime = s.pausedTime
+	if !s.pausedAt.IsZero() {
+		st.PausedTime += time.Since(s.pausedAt)
+	}
+	st.AckLatency = s.ackLatency.snapshot()
+	st.PauseDuration = s.pauseDuration.snapshot()
+	return st
+}
@@ -0,0 +1,227 @@
+package datachannel
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// TraceInbound and TraceOutbound are the TraceRecord.Direction values of messages received from, and sent
+	// to, the agent.
+	TraceInbound  = "in"
+	TraceOutbound = "out"
+
+	// DefaultTracePayloadLimit is the number of payload bytes kept in a trace record if the TraceOptions do not
+	// set a limit.
+	DefaultTracePayloadLimit = 256
+)
+
+// TraceOptions configures the payload data written by a Tracer.  PayloadLimit is the maximum number of payload
+// bytes in a record (0 uses DefaultTracePayloadLimit, a negative value omits all payloads).  The payloads of
+// session data messages (terminal and port data, stderr output, the ChannelClosed message holding the final
+// output, and the encryption challenge) are redacted, unless IncludeData is set.
+type TraceOptions struct {
+	PayloadLimit int
+	IncludeData  bool
+}
+
+// TraceRecord is a single line of a protocol trace, describing one message sent or received on the data channel.
+// Payloads which are valid UTF-8 (the JSON control messages) are written in the Payload field, other payloads are
+// hex encoded in the PayloadHex field.  The payload digest is omitted from redacted records, as the digest of a
+// short payload (like a keystroke) can be reversed.  A message which could not be decoded is recorded with the
+// decode Error, its FrameLength and the hex encoded header bytes (HeaderHex, with the payload digest zeroed
+// unless the session data is included), along with the header fields the error reports.
+type TraceRecord struct {
+	Time           time.Time        `json:"time"`
+	Direction      string           `json:"dir"`
+	SessionID      string           `json:"sessionId,omitempty"`
+	MessageType    MessageType      `json:"messageType"`
+	SchemaVersion  uint32           `json:"schemaVersion"`
+	CreatedDate    time.Time        `json:"createdDate"`
+	SequenceNumber int64            `json:"seq"`
+	Flags          AgentMessageFlag `json:"flags"`
+	MessageID      string           `json:"messageId"`
+	PayloadType    PayloadType      `json:"payloadType"`
+	PayloadLength  uint32           `json:"payloadLength"`
+	PayloadDigest  string           `json:"payloadDigest,omitempty"`
+	Payload        string           `json:"payload,omitempty"`
+	PayloadHex     string           `json:"payloadHex,omitempty"`
+	Truncated      bool             `json:"truncated,omitempty"`
+	Redacted       bool             `json:"redacted,omitempty"`
+	Error          string           `json:"error,omitempty"`
+	FrameLength    int              `json:"frameLength,omitempty"`
+	HeaderHex      string           `json:"headerHex,omitempty"`
+}
+
+// Tracer writes the messages exchanged on a data channel to an io.Writer as JSON lines, one TraceRecord per
+// message.  A Tracer is safe for concurrent use, and may be shared by multiple data channels.
+type Tracer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	opts TraceOptions
+}
+
+// NewTracer creates a Tracer writing to w.  If w is an io.Closer, it is closed by Tracer.Close().
+func NewTracer(w io.Writer, opts TraceOptions) *Tracer {
+	if opts.PayloadLimit == 0 {
+		opts.PayloadLimit = DefaultTracePayloadLimit
+	}
+	return &Tracer{w: w, opts: opts}
+}
+
+// Trace writes a record for the message.  Errors writing the trace are ignored, a failing trace must not
+// interrupt the session.
+func (t *Tracer) Trace(direction, sessionID string, m *AgentMessage) {
+	t.write(t.record(direction, sessionID, m))
+}
+
+// TraceInvalid writes a record for message data which could not be decoded, with the decode error.
+func (t *Tracer) TraceInvalid(direction, sessionID string, data []byte, decodeErr error) {
+	t.write(t.invalidRecord(direction, sessionID, data, decodeErr))
+}
+
+func (t *Tracer) write(rec *TraceRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, _ = t.w.Write(append(line, '\n'))
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (t *Tracer) record(direction, sessionID string, m *AgentMessage) *TraceRecord {
+	rec := &TraceRecord{
+		Time:           time.Now(),
+		Direction:      direction,
+		SessionID:      sessionID,
+		MessageType:    m.MessageType,
+		SchemaVersion:  m.schemaVersion,
+		CreatedDate:    m.createdDate,
+		SequenceNumber: m.SequenceNumber,
+		Flags:          m.Flags,
+		MessageID:      m.messageID.String(),
+		PayloadType:    m.PayloadType,
+		PayloadLength:  uint32(len(m.Payload)),
+		PayloadDigest:  hex.EncodeToString(m.payloadDigest),
+	}
+
+	payload := m.Payload
+	switch {
+	case len(payload) < 1:
+		return rec
+	case isSessionData(m) && !t.opts.IncludeData, t.opts.PayloadLimit < 0:
+		rec.Redacted = true
+		rec.PayloadDigest = ""
+		return rec
+	case len(payload) > t.opts.PayloadLimit:
+		payload = payload[:t.opts.PayloadLimit]
+		rec.Truncated = true
+	}
+
+	if utf8.Valid(payload) {
+		rec.Payload = string(payload)
+	} else {
+		rec.PayloadHex = hex.EncodeToString(payload)
+	}
+	return rec
+}
+
+func (t *Tracer) invalidRecord(direction, sessionID string, data []byte, decodeErr error) *TraceRecord {
+	rec := &TraceRecord{
+		Time:        time.Now(),
+		Direction:   direction,
+		SessionID:   sessionID,
+		Error:       decodeErr.Error(),
+		FrameLength: len(data),
+	}
+
+	var msgErr *MessageError
+	if errors.As(decodeErr, &msgErr) {
+		rec.MessageType = msgErr.MessageType
+		rec.PayloadType = msgErr.PayloadType
+		rec.SequenceNumber = msgErr.SequenceNumber
+	}
+
+	// the header and the payload length which follows it
+	header := append([]byte(nil), data[:min(len(data), agentMsgHeaderLen+4)]...)
+	if !t.opts.IncludeData {
+		clear(header[min(len(header), payloadDigestOffset):min(len(header), payloadDigestOffset+sha256.Size)])
+	}
+	rec.HeaderHex = hex.EncodeToString(header)
+	return rec
+}
+
+// isSessionData returns true if the message payload carries data of the session, rather than protocol control
+// information.
+func isSessionData(m *AgentMessage) bool {
+	// the channel_closed payload holds the final output of the session
+	if m.MessageType == ChannelClosed {
+		return true
+	}
+
+	if m.MessageType != InputStreamData && m.MessageType != OutputStreamData {
+		return false
+	}
+
+	//nolint:exhaustive // all other payload types are protocol control data
+	switch m.PayloadType {
+	case Output, Error, StdErr, Parameter, EncChallengeRequest, EncChallengeResponse:
+		return true
+	}
+	return false
+}
+
+// TraceReader reads the records of a protocol trace written by a Tracer.
+type TraceReader struct {
+	sc   *bufio.Scanner
+	line int
+}
+
+// NewTraceReader creates a TraceReader reading from r.
+func NewTraceReader(r io.Reader) *TraceReader {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &TraceReader{sc: sc}
+}
+
+// Next returns the next record of the trace, or io.EOF at the end of the trace.  Blank lines are skipped.
+func (r *TraceReader) Next() (*TraceRecord, error) {
+	for r.sc.Scan() {
+		r.line++
+		if len(r.sc.Bytes()) < 1 {
+			continue
+		}
+
+		rec := new(TraceRecord)
+		if err := json.Unmarshal(r.sc.Bytes(), rec); err != nil {
+			return nil, fmt.Errorf("invalid trace record at line %d: %w", r.line, err)
+		}
+		return rec, nil
+	}
+
+	if err := r.sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,134 @@
+package datachannel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestTraceRedaction(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		messageType MessageType
+		payloadType PayloadType
+		redacted    bool
+	}{
+		{"output", OutputStreamData, Output, true},
+		{"input", InputStreamData, Output, true},
+		{"error", OutputStreamData, Error, true},
+		{"stderr", OutputStreamData, StdErr, true},
+		{"channel closed", ChannelClosed, Undefined, true},
+		{"encryption challenge", OutputStreamData, EncChallengeRequest, true},
+		{"handshake request", OutputStreamData, HandshakeRequest, false},
+		{"exit code", OutputStreamData, ExitCode, false},
+		{"acknowledge", Acknowledge, Undefined, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewAgentMessage()
+			m.MessageType = tc.messageType
+			m.PayloadType = tc.payloadType
+			m.Payload = []byte("secret")
+
+			rec := NewTracer(nil, TraceOptions{}).record(TraceInbound, "session-1", m)
+			if rec.Redacted != tc.redacted || (rec.Payload == "secret") == tc.redacted {
+				t.Errorf("unexpected record %+v", rec)
+			}
+
+			rec = NewTracer(nil, TraceOptions{IncludeData: true}).record(TraceInbound, "session-1", m)
+			if rec.Redacted || rec.Payload != "secret" {
+				t.Errorf("payload redacted with IncludeData %+v", rec)
+			}
+		})
+	}
+}
+
+func TestTraceRedactedRecordHasNoPayloadData(t *testing.T) {
+	m := NewAgentMessage()
+	m.MessageType = InputStreamData
+	m.PayloadType = Output
+	m.Payload = []byte("p")
+	if _, err := m.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []TraceOptions{{}, {IncludeData: true, PayloadLimit: -1}} {
+		line, err := json.Marshal(NewTracer(nil, opts).record(TraceOutbound, "session-1", m))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields := make(map[string]interface{})
+		if err = json.Unmarshal(line, &fields); err != nil {
+			t.Fatal(err)
+		}
+
+		if fields["redacted"] != true {
+			t.Errorf("the record is not redacted: %s", line)
+		}
+
+		for _, k := range []string{"payload", "payloadHex", "payloadDigest"} {
+			if _, ok := fields[k]; ok {
+				t.Errorf("the redacted record has the %s field: %s", k, line)
+			}
+		}
+	}
+
+	rec := NewTracer(nil, TraceOptions{IncludeData: true}).record(TraceOutbound, "session-1", m)
+	if rec.PayloadDigest == "" {
+		t.Error("the digest is missing from the record with the session data")
+	}
+}
+
+func TestTraceInvalid(t *testing.T) {
+	m := NewAgentMessage()
+	m.MessageType = OutputStreamData
+	m.SequenceNumber = 7
+	m.PayloadType = Output
+	m.Payload = []byte("p")
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the payload, so the digest does not match
+	data[len(data)-1] = 'q'
+	decodeErr := new(AgentMessage).UnmarshalBinary(data)
+	if !errors.Is(decodeErr, ErrDigestMismatch) {
+		t.Fatalf("unexpected decode error %v", decodeErr)
+	}
+
+	buf := new(bytes.Buffer)
+	NewTracer(buf, TraceOptions{}).TraceInvalid(TraceInbound, "session-1", data, decodeErr)
+
+	rec, err := NewTraceReader(buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Error != decodeErr.Error() || rec.FrameLength != len(data) || rec.MessageType != OutputStreamData ||
+		rec.SequenceNumber != 7 || rec.SessionID != "session-1" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+
+	header, err := hex.DecodeString(rec.HeaderHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(header) != agentMsgHeaderLen+4 || !bytes.Equal(header[:payloadDigestOffset], data[:payloadDigestOffset]) {
+		t.Errorf("unexpected header %x", header)
+	}
+
+	if !bytes.Equal(header[payloadDigestOffset:payloadDigestOffset+32], make([]byte, 32)) {
+		t.Errorf("the payload digest is not zeroed in the header %x", header)
+	}
+
+	// a message shorter than the header
+	buf.Reset()
+	NewTracer(buf, TraceOptions{}).TraceInvalid(TraceInbound, "", data[:10], new(AgentMessage).UnmarshalBinary(data[:10]))
+	if rec, err = NewTraceReader(buf).Next(); err != nil || rec.FrameLength != 10 || rec.HeaderHex != hex.EncodeToString(data[:10]) {
+		t.Errorf("unexpected record %+v: %v", rec, err)
+	}
+}
@@ -2,6 +2,7 @@ package datachannel
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -32,6 +33,20 @@ const (
 	Ack  AgentMessageFlag = iota
 )
 
+func (f AgentMessageFlag) String() string {
+	switch f {
+	case Data:
+		return "data"
+	case Syn:
+		return "syn"
+	case Fin:
+		return "fin"
+	case Ack:
+		return "ack"
+	}
+	return fmt.Sprintf("flag(%d)", uint64(f))
+}
+
 // PayloadType is the value set in the AgentMessage.PayloadType field to indicate the data format of the Payload field.
 type PayloadType uint32
 
@@ -47,8 +62,33 @@ const (
 	EncChallengeRequest  PayloadType = iota
 	EncChallengeResponse PayloadType = iota
 	Flag                 PayloadType = iota
+	StdErr               PayloadType = iota
+	ExitCode             PayloadType = iota
 )
 
+var payloadTypeNames = map[PayloadType]string{
+	Undefined:            "undefined",
+	Output:               "output",
+	Error:                "error",
+	Size:                 "size",
+	Parameter:            "parameter",
+	HandshakeRequest:     "handshake_request",
+	HandshakeResponse:    "handshake_response",
+	HandshakeComplete:    "handshake_complete",
+	EncChallengeRequest:  "enc_challenge_request",
+	EncChallengeResponse: "enc_challenge_response",
+	Flag:                 "flag",
+	StdErr:               "stderr",
+	ExitCode:             "exit_code",
+}
+
+func (t PayloadType) String() string {
+	if name, ok := payloadTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("payload_type(%d)", uint32(t))
+}
+
 // PayloadTypeFlag is the value set in the Payload of certain messages to indicate certain control operations.
 type PayloadTypeFlag uint32
 
@@ -58,6 +98,18 @@ const (
 	ConnectToPortError PayloadTypeFlag = 3
 )
 
+func (f PayloadTypeFlag) String() string {
+	switch f {
+	case DisconnectToPort:
+		return "disconnect_to_port"
+	case TerminateSession:
+		return "terminate_session"
+	case ConnectToPortError:
+		return "connect_to_port_error"
+	}
+	return fmt.Sprintf("payload_flag(%d)", uint32(f))
+}
+
 // ActionType is used in Handshake to determine action requested by the agent.
 type ActionType string
 
@@ -75,6 +127,22 @@ const (
 	Unsupported ActionStatus = 3
 )
 
+// AcknowledgeContent is the payload of an Acknowledge message, identifying the message being acknowledged.
+type AcknowledgeContent struct {
+	AcknowledgedMessageType           MessageType
+	AcknowledgedMessageID             string `json:"AcknowledgedMessageId"`
+	AcknowledgedMessageSequenceNumber int64
+	IsSequentialMessage               bool
+}
+
+// AgentSessionStatePayload is the payload of an agent_session_state message, sent by the agent when the state
+// of the session changes (like "Connected" or "Terminating").
+type AgentSessionStatePayload struct {
+	SchemaVersion int
+	SessionState  string
+	SessionID     string `json:"SessionId"`
+}
+
 // HandshakeRequestPayload is the data format sent from the agent to initiate a session handshake.
 type HandshakeRequestPayload struct {
 	AgentVersion           string
@@ -93,6 +161,30 @@ type SessionTypeRequest struct {
 	Properties  interface{}
 }
 
+// KMSEncryptionRequest is the ActionParameters of a KMSEncryption action requested as part of the handshake.
+type KMSEncryptionRequest struct {
+	KMSKeyID string `json:"KMSKeyId"`
+}
+
+// KMSEncryptionResponse is the ActionResult of a successful KMSEncryption action, which sends the encrypted
+// data key generated by KMS to the agent, with the SHA-256 digest of the encrypted key.
+type KMSEncryptionResponse struct {
+	KMSCipherTextKey  []byte `json:"KMSCipherTextKey"`
+	KMSCipherTextHash []byte `json:"KMSCipherTextHash"`
+}
+
+// EncryptionChallengeRequest is sent from the agent after a KMSEncryption action to verify the client can
+// decrypt data encrypted by the agent.
+type EncryptionChallengeRequest struct {
+	Challenge []byte `json:"Challenge"`
+}
+
+// EncryptionChallengeResponse is the client response to an EncryptionChallengeRequest, the Challenge field
+// contains the decrypted request challenge, re-encrypted with the client key.
+type EncryptionChallengeResponse struct {
+	Challenge []byte `json:"Challenge"`
+}
+
 // HandshakeResponsePayload is the local client response to the offered handshake request.  The ProcessedClientActions
 // field should have an entry for each RequestedClientActions in the handshake request.
 type HandshakeResponsePayload struct {
@@ -115,6 +207,18 @@ type HandshakeCompletePayload struct {
 	CustomerMessage         string
 }
 
+// HandshakeInfo describes the handshake with the agent, which is done by port forwarding sessions (including
+// ssh), and by sessions requiring KMS encryption.  AgentVersion and RequestedClientActions are reported by the
+// HandshakeRequest, HandshakeTimeToComplete and CustomerMessage by the HandshakeComplete message, after which
+// Complete is set.
+type HandshakeInfo struct {
+	AgentVersion            string
+	RequestedClientActions  []ActionType
+	HandshakeTimeToComplete time.Duration
+	CustomerMessage         string
+	Complete                bool
+}
+
 // ChannelClosedPayload is the payload in a ChannelClosed message send from the agent.
 type ChannelClosedPayload struct {
 	MessageType   string
@@ -0,0 +1,119 @@
+package datachannel
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ClientVersion is the version reported to the remote agent in the HandshakeResponse.  The agent enables
+	// certain features based on this value (must report greater than 1.1.70 to do stream muxing).
+	ClientVersion = "1.2.0.0"
+
+	// REF: https://github.com/aws/session-manager-plugin/blob/mainline/src/config/config.go
+	terminateSessionSupportedAfterAgentVersion = "2.3.722.0"
+	muxSupportedAfterAgentVersion              = "3.0.196.0"
+	muxKeepAliveDisabledAfterAgentVersion      = "3.1.1511.0"
+)
+
+// ErrAgentTooOld is wrapped by the AgentVersionError returned when the agent does not support a feature.
+var ErrAgentTooOld = errors.New("agent version is too old")
+
+// Feature is an optional feature of the session protocol, supported by agents with a version strictly greater
+// than AfterVersion.
+type Feature struct {
+	Name         string
+	AfterVersion string
+}
+
+var (
+	// FeatureTerminateSession is the support of the TerminateSession and DisconnectToPort flags.
+	FeatureTerminateSession = Feature{Name: "terminate session flag", AfterVersion: terminateSessionSupportedAfterAgentVersion}
+
+	// FeatureMultiplexing is the support of multiple port forwarding connections over a single session.
+	FeatureMultiplexing = Feature{Name: "port forwarding multiplexing", AfterVersion: muxSupportedAfterAgentVersion}
+
+	// FeatureMuxKeepAliveDisabled is the agent disabling the smux keepalive of multiplexed sessions.
+	FeatureMuxKeepAliveDisabled = Feature{Name: "multiplexing without keepalive", AfterVersion: muxKeepAliveDisabledAfterAgentVersion}
+)
+
+// AgentVersionError reports a feature which is not supported by the version of the agent.  AgentVersion is empty
+// if the agent did not report its version.
+type AgentVersionError struct {
+	Feature      Feature
+	AgentVersion string
+}
+
+func (e *AgentVersionError) Error() string {
+	version := e.AgentVersion
+	if version == "" {
+		version = "unknown"
+	}
+	return fmt.Sprintf("%v: %s requires an agent version greater than %s, the agent version is %s",
+		ErrAgentTooOld, e.Feature.Name, e.Feature.AfterVersion, version)
+}
+
+func (e *AgentVersionError) Unwrap() error {
+	return ErrAgentTooOld
+}
+
+// Supports returns true if the version reported by the agent in the handshake supports the feature.  Only valid
+// after the handshake has completed, false is returned if the agent version is not known.
+func (c *SsmDataChannel) Supports(f Feature) bool {
+	return VersionAfter(c.AgentVersion(), f.AfterVersion)
+}
+
+// RequireFeature returns an *AgentVersionError if the agent does not support the feature.
+func (c *SsmDataChannel) RequireFeature(f Feature) error {
+	if c.Supports(f) {
+		return nil
+	}
+	return &AgentVersionError{Feature: f, AgentVersion: c.AgentVersion()}
+}
+
+// requireKnownFeature is RequireFeature for features the client uses when the agent version is not known, like
+// the flags sent by sessions without a handshake.
+func (c *SsmDataChannel) requireKnownFeature(f Feature) error {
+	if c.AgentVersion() == "" {
+		return nil
+	}
+	return c.RequireFeature(f)
+}
+
+// VersionAfter returns true if the version is strictly greater than the min version.  Versions are compared as
+// dot-separated integers, missing parts are 0 (so 1.2 is greater than 1.1.70).  Any parse failure, or a missing
+// version, is reported as false.
+func VersionAfter(version, min string) bool {
+	if version == "" {
+		return false
+	}
+
+	v := strings.Split(version, ".")
+	m := strings.Split(min, ".")
+	for i := 0; i < len(v) || i < len(m); i++ {
+		vi, err := versionPart(v, i)
+		if err != nil {
+			return false
+		}
+
+		mi, err := versionPart(m, i)
+		if err != nil {
+			return false
+		}
+
+		if vi != mi {
+			return vi > mi
+		}
+	}
+	return false
+}
+
+// versionPart returns the integer value of part i of the version, 0 if the version has fewer parts.
+func versionPart(parts []string, i int) (int, error) {
+	if i >= len(parts) {
+		return 0, nil
+	}
+	return strconv.Atoi(parts[i])
+}
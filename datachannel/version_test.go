@@ -0,0 +1,24 @@
+package datachannel
+
+import "testing"
+
+func TestVersionAfter(t *testing.T) {
+	for _, tc := range []struct {
+		version, min string
+		after        bool
+	}{
+		{"3.0.197.0", muxSupportedAfterAgentVersion, true},
+		{"3.0.196.0", muxSupportedAfterAgentVersion, false},
+		{"3.0.100.0", muxSupportedAfterAgentVersion, false},
+		{"10.0.0.0", muxSupportedAfterAgentVersion, true},
+		{ClientVersion, "1.1.70", true},
+		{"1.1.70.0", "1.1.70", false},
+		{"3.1", "3.0.196.0", true},
+		{"", muxSupportedAfterAgentVersion, false},
+		{"3.x.0.0", muxSupportedAfterAgentVersion, false},
+	} {
+		if got := VersionAfter(tc.version, tc.min); got != tc.after {
+			t.Errorf("VersionAfter(%q, %q) = %v, want %v", tc.version, tc.min, got, tc.after)
+		}
+	}
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"github.com/alexbacchin/ssm-session-client/cmd"
 	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
 	"go.uber.org/zap"
 )
 
 func main() {
 	logger := config.CreateLogger()
 	zap.ReplaceGlobals(logger)
+	ssmclient.SetLogger(logger)
 	defer logger.Sync() // flushes buffer, if any
 	cmd.Execute()
 }
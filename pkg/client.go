@@ -3,12 +3,12 @@ package pkg
 import (
 	"context"
 	"net/http"
-	"net/url"
 	"os"
 	"fmt"
 
 	"os/user"
 	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
@@ -18,17 +18,31 @@ import (
 	"go.uber.org/zap"
 )
 
-// BuildAWSConfig builds the AWS Config for the given service
+// HttpClient builds the AWS SDK HTTP client with the TLS settings from the config
+func HttpClient() *awshttp.BuildableClient {
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	if tlsConfig == nil {
+		return awshttp.NewBuildableClient()
+	}
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.TLSClientConfig = tlsConfig
+	})
+}
+
+// ProxyHttpClient builds the AWS SDK HTTP client with the TLS and proxy settings from the config
 func ProxyHttpClient() *awshttp.BuildableClient {
 	if config.Flags().ProxyURL == "" {
-		return awshttp.NewBuildableClient()
+		return HttpClient()
 	}
-	client := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
-		proxyURL, err := url.Parse(config.Flags().ProxyURL)
+	client := HttpClient().WithTransportOptions(func(tr *http.Transport) {
+		proxy, err := config.ProxyFunc()
 		if err != nil {
 			zap.S().Fatal(err)
 		}
-		tr.Proxy = http.ProxyURL(proxyURL)
+		tr.Proxy = proxy
 	})
 	return client
 }
@@ -77,6 +91,11 @@ func InitializeClient() {
 			zap.S().Info("SSO login successful")
 		}
 	}
+	if config.Flags().MetricsListen != "" && !config.Flags().UseSSMSessionPlugin {
+		if err := ssmclient.StartMetricsServer(config.Flags().MetricsListen); err != nil {
+			zap.S().Fatal("Error starting metrics server: ", err)
+		}
+	}
 }
 
 func BuildAWSConfig(ctx context.Context, service string) (aws.Config, error) {
@@ -95,11 +114,13 @@ func BuildAWSConfig(ctx context.Context, service string) (aws.Config, error) {
 	if config.Flags().AWSProfile != "" {
 		cfg, err = awsconfig.LoadDefaultConfig(ctx,
 			awsconfig.WithSharedConfigProfile(config.Flags().AWSProfile),
+			awsconfig.WithHTTPClient(HttpClient()),
 			awsconfig.WithLogger(logger),
 			awsconfig.WithClientLogMode((aws.LogRetries | aws.LogRequest)),
 		)
 	} else {
 		cfg, err = awsconfig.LoadDefaultConfig(ctx,
+			awsconfig.WithHTTPClient(HttpClient()),
 			awsconfig.WithLogger(logger),
 			awsconfig.WithClientLogMode(aws.LogRetries|aws.LogRequest),
 		)
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+)
+
+// newTLSServer starts a TLS server with the maximum TLS version, and writes its certificate to a CA bundle.
+func newTLSServer(t *testing.T, maxVersion uint16) (*httptest.Server, string) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = &tls.Config{MaxVersion: maxVersion}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, bundle
+}
+
+// setFlags sets the config flags for the duration of the test.
+func setFlags(t *testing.T, fn func(*config.Config)) {
+	t.Helper()
+	saved := *config.Flags()
+	t.Cleanup(func() { *config.Flags() = saved })
+	fn(config.Flags())
+}
+
+func TestHttpClientTLS(t *testing.T) {
+	srv, bundle := newTLSServer(t, tls.VersionTLS12)
+
+	for _, tc := range []struct {
+		name       string
+		caBundle   string
+		minVersion string
+		err        string
+	}{
+		{name: "system roots", err: "certificate signed by unknown authority"},
+		{name: "ca bundle", caBundle: bundle},
+		{name: "min version", caBundle: bundle, minVersion: "1.3", err: "protocol version"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlags(t, func(f *config.Config) {
+				f.CABundle = tc.caBundle
+				f.TLSMinVersion = tc.minVersion
+			})
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			resp, err := HttpClient().Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/daemon"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+	"go.uber.org/zap"
+)
+
+// daemonStartTimeout is how long a detached daemon has to start listening on its socket.
+const daemonStartTimeout = 10 * time.Second
+
+// daemonSocket returns the path of the control socket of the daemon.
+func daemonSocket() string {
+	if config.Flags().DaemonSocket != "" {
+		return config.Flags().DaemonSocket
+	}
+	return daemon.DefaultSocketPath()
+}
+
+// RunDaemon runs the tunnel daemon on the control socket, until it is shut down by a client or the process
+// receives an interrupt or termination signal.  If detach is configured, the daemon is started in a background
+// process instead, and RunDaemon returns once it is listening.
+func RunDaemon() error {
+	if config.Flags().DaemonDetach {
+		return startDetachedDaemon()
+	}
+
+	if config.Flags().UseSSMSessionPlugin {
+		zap.S().Info("tunnels are not supported by the session manager plugin, using the native client")
+	}
+
+	ssmcfg, err := BuildAWSConfig(context.Background(), "ssm")
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	ssmMessagesCfg, err := BuildAWSConfig(context.Background(), "ssmmessages")
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
+	srv := &daemon.Server{
+		Config: ssmMessagesCfg,
+		ResolveTarget: func(target string) (string, error) {
+			return ssmclient.ResolveTarget(target, ssmcfg)
+		},
+		Logger: zap.L(),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown()
+	}()
+
+	return srv.ListenAndServe(daemonSocket())
+}
+
+// startDetachedDaemon runs the daemon command again in a background process, without the detach flag.
+func startDetachedDaemon() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := make([]string, 0, len(os.Args))
+	for _, arg := range os.Args[1:] {
+		if arg == "--detach" || strings.HasPrefix(arg, "--detach=") {
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmd.SysProcAttr = detachedProcAttr()
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+
+	deadline := time.Now().Add(daemonStartTimeout)
+	for time.Now().Before(deadline) {
+		if c, err := daemon.Dial(daemonSocket()); err == nil {
+			_ = c.Close()
+			zap.S().Infof("daemon started with pid %d, listening on %s", pid, daemonSocket())
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("the daemon (pid %d) did not listen on %s, check the application log", pid, daemonSocket())
+}
+
+// StopDaemon stops all the tunnels of the daemon, and exits it.
+func StopDaemon() error {
+	return withDaemon(func(c *daemon.Client) error {
+		return c.Shutdown()
+	})
+}
+
+// StartTunnel starts a tunnel in the daemon.  If target is empty, the tunnel is the one with the name in the
+// tunnels section of the configuration file, otherwise target is in the target[:remotehost]:port format of the
+// port-forwarding command.
+func StartTunnel(name string, target string, localPort int) error {
+	spec, err := tunnelSpec(name, target, localPort)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
+	// the devbox lookup is done by the client, as it terminates the process on failure
+	if spec.Target == "devbox" {
+		InitializeClient()
+		spec.Target = GetTarget(spec.Target)
+	}
+
+	return withDaemon(func(c *daemon.Client) error {
+		st, err := c.Start(spec)
+		if err != nil {
+			return err
+		}
+
+		if st.State == daemon.StateRunning {
+			zap.S().Infof("tunnel %s listening on %s", st.Name, st.LocalAddress)
+		} else {
+			zap.S().Infof("tunnel %s is %s", st.Name, st.State)
+		}
+		return nil
+	})
+}
+
+func tunnelSpec(name string, target string, localPort int) (*daemon.TunnelSpec, error) {
+	if target == "" {
+		for _, t := range config.Flags().Tunnels {
+			if t.Name == name {
+				return &daemon.TunnelSpec{
+					Name:        t.Name,
+					Target:      t.Target,
+					RemoteHost:  t.RemoteHost,
+					RemotePort:  t.RemotePort,
+					LocalPort:   t.LocalPort,
+					BindAddress: t.BindAddress,
+				}, nil
+			}
+		}
+		return nil, fmt.Errorf("tunnel %q is not configured, give its target", name)
+	}
+
+	t, host, port, err := parsePortForwardingTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	return &daemon.TunnelSpec{
+		Name:        name,
+		Target:      t,
+		RemoteHost:  host,
+		RemotePort:  port,
+		LocalPort:   localPort,
+		BindAddress: config.Flags().TunnelBindAddress,
+	}, nil
+}
+
+// StopTunnel stops a tunnel of the daemon.
+func StopTunnel(name string) error {
+	return withDaemon(func(c *daemon.Client) error {
+		return c.Stop(name)
+	})
+}
+
+// ListTunnels prints the status of the tunnels of the daemon.
+func ListTunnels() error {
+	return withDaemon(func(c *daemon.Client) error {
+		tunnels, err := c.List()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tTARGET\tREMOTE\tLOCAL\tSTATE\tUPTIME\tSENT\tRECEIVED")
+		for _, t := range tunnels {
+			remote := fmt.Sprint(t.RemotePort)
+			if t.RemoteHost != "" {
+				remote = net.JoinHostPort(t.RemoteHost, remote)
+			}
+
+			state := t.State
+			if t.Error != "" {
+				state = fmt.Sprintf("%s (%s)", t.State, t.Error)
+			}
+
+			uptime := (time.Duration(t.UptimeSeconds) * time.Second).String()
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", t.Name, t.InstanceID, remote, t.LocalAddress, state, uptime,
+				t.BytesSent, t.BytesReceived)
+		}
+		return w.Flush()
+	})
+}
+
+// TunnelLogs prints the last log entries of a tunnel of the daemon.
+func TunnelLogs(name string) error {
+	return withDaemon(func(c *daemon.Client) error {
+		logs, err := c.Logs(name, config.Flags().TunnelLogLines)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range logs {
+			line := fmt.Sprintf("%s\t%s\t%s", e.Time.Format(time.RFC3339), strings.ToUpper(e.Level), e.Message)
+			if len(e.Fields) > 0 {
+				fields, _ := json.Marshal(e.Fields)
+				line += "\t" + string(fields)
+			}
+			fmt.Println(line)
+		}
+		return nil
+	})
+}
+
+// withDaemon calls fn with a client connected to the daemon.
+func withDaemon(fn func(*daemon.Client) error) error {
+	c, err := daemon.Dial(daemonSocket())
+	if err != nil {
+		return fmt.Errorf("%w, start it with the daemon run command", err)
+	}
+	defer c.Close()
+
+	return fn(c)
+}
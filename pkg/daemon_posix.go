@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package pkg
+
+import "syscall"
+
+// detachedProcAttr starts the daemon in a new session, so it is not terminated with the terminal.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package pkg
+
+import "syscall"
+
+// DETACHED_PROCESS, not defined by the syscall package
+// REF: https://learn.microsoft.com/en-us/windows/win32/procthread/process-creation-flags
+const detachedProcess = 0x00000008
+
+// detachedProcAttr starts the daemon without a console, in a new process group so it does not receive the Ctrl-C
+// of the console.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
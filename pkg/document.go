@@ -0,0 +1,16 @@
+package pkg
+
+import (
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+	"go.uber.org/zap"
+)
+
+// sessionParameters returns the session document parameters set with the --parameter flags.
+func sessionParameters() map[string][]string {
+	params, err := ssmclient.ParseParameters(config.Flags().Parameters)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	return params
+}
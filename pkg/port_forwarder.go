@@ -11,22 +11,9 @@ import (
 
 // StartSSMPortForwarder starts a port forwarding session using AWS SSM
 func StartSSMPortForwarder(target string, sourcePort int) error {
-	var port int
-	if !strings.Contains(target, ":") {
-		target = target + ":22"
-	}
-	userHost := strings.Split(target, "@")
-	if len(userHost) != 2 || !strings.Contains(userHost[1], ":") {
-		userHost[1] = userHost[1] + ":22"
-	}
-	t, p, err := net.SplitHostPort(userHost[1])
-	if err == nil {
-		port, err = net.LookupPort("tcp", p)
-		if err != nil {
-			zap.S().Fatal(err)
-		}
-	} else {
-		t = target
+	t, host, port, err := parsePortForwardingTarget(target)
+	if err != nil {
+		zap.S().Fatal(err)
 	}
 	if t == "devbox" {
         t = GetTarget(t)
@@ -41,9 +28,12 @@ func StartSSMPortForwarder(target string, sourcePort int) error {
 	}
 
 	in := ssmclient.PortForwardingInput{
-		Target:     tgt,
-		RemotePort: port,
-		LocalPort:  sourcePort,
+		Target:       tgt,
+		RemotePort:   port,
+		LocalPort:    sourcePort,
+		Host:         host,
+		DocumentName: config.Flags().DocumentName,
+		Parameters:   sessionParameters(),
 	}
 	ssmMessagesCfg, err := BuildAWSConfig(context.Background(), "ssmmessages")
 	if err != nil {
@@ -55,3 +45,27 @@ func StartSSMPortForwarder(target string, sourcePort int) error {
 	return ssmclient.PortForwardingSession(ssmMessagesCfg, &in)
 
 }
+
+// parsePortForwardingTarget splits a target:port or target:remotehost:port string into its parts, the port is 22
+// if not set.  An IPv6 remote host must be enclosed in brackets.  A user@ prefix (as in an ssh destination) is
+// ignored, port forwarding does not log in to the target.
+func parsePortForwardingTarget(s string) (target, host string, port int, err error) {
+	if user, rest, ok := strings.Cut(s, "@"); ok && !strings.Contains(user, ":") {
+		s = rest
+	}
+
+	target, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return target, "", 22, nil
+	}
+
+	p := rest
+	if strings.Contains(rest, ":") {
+		if host, p, err = net.SplitHostPort(rest); err != nil {
+			return "", "", 0, err
+		}
+	}
+
+	port, err = net.LookupPort("tcp", p)
+	return target, host, port, err
+}
@@ -0,0 +1,34 @@
+package pkg
+
+import "testing"
+
+func TestParsePortForwardingTarget(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		target string
+		host   string
+		port   int
+	}{
+		{"i-0123456789abcdef0", "i-0123456789abcdef0", "", 22},
+		{"i-0123456789abcdef0:8080", "i-0123456789abcdef0", "", 8080},
+		{"i-0123456789abcdef0:db.internal:5432", "i-0123456789abcdef0", "db.internal", 5432},
+		{"i-0123456789abcdef0:[::1]:443", "i-0123456789abcdef0", "::1", 443},
+		{"ec2-user@i-0123456789abcdef0", "i-0123456789abcdef0", "", 22},
+		{"ec2-user@i-0123456789abcdef0:8080", "i-0123456789abcdef0", "", 8080},
+		{"ec2-user@i-0123456789abcdef0:db.internal:5432", "i-0123456789abcdef0", "db.internal", 5432},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			target, host, port, err := parsePortForwardingTarget(tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target != tc.target || host != tc.host || port != tc.port {
+				t.Errorf("got %q %q %d, want %q %q %d", target, host, port, tc.target, tc.host, tc.port)
+			}
+		})
+	}
+
+	if _, _, _, err := parsePortForwardingTarget("i-0123456789abcdef0:notaport"); err == nil {
+		t.Error("expected an error for an invalid port")
+	}
+}
@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+)
+
+// StartReplay plays a session recording in the terminal, or prints the plain text transcript of the recording
+// if dump is true.
+func StartReplay(file string, opts ssmclient.ReplayOptions, dump bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rec, err := ssmclient.ReadRecording(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	if dump {
+		return ssmclient.DumpRecording(rec, os.Stdout)
+	}
+	return ssmclient.ReplayRecording(rec, opts)
+}
@@ -0,0 +1,30 @@
+package pkg
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+)
+
+func TestStartReplayErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.cast")
+	if err := os.WriteFile(invalid, []byte("not a recording\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := StartReplay(filepath.Join(dir, "missing.cast"), ssmclient.ReplayOptions{}, true)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a not exist error for a missing file, got %v", err)
+	}
+
+	err = StartReplay(invalid, ssmclient.ReplayOptions{}, true)
+	if err == nil || !strings.Contains(err.Error(), "invalid recording header") {
+		t.Errorf("expected an invalid recording error, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+	"go.uber.org/zap"
+)
+
+// StartSSMExec runs a command on the target using AWS SSM, and returns the exit code of the command.  A single
+// argument is the command line run by the shell, several arguments are the command and its arguments.
+func StartSSMExec(target string, args []string) (int, error) {
+	if target == "devbox" {
+		target = GetTarget(target)
+	}
+	ssmcfg, err := BuildAWSConfig(context.Background(), "ssm")
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	tgt, err := ssmclient.ResolveTarget(target, ssmcfg)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
+	ssmMessagesCfg, err := BuildAWSConfig(context.Background(), "ssmmessages")
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
+	if config.Flags().UseSSMSessionPlugin {
+		zap.S().Info("the session manager plugin does not report the exit code of commands, using the native client")
+	}
+
+	var stdin io.Reader
+	if config.Flags().ExecStdin {
+		stdin = os.Stdin
+	}
+
+	return ssmclient.ExecSession(ssmMessagesCfg, &ssmclient.ExecInput{
+		Target:       tgt,
+		Command:      shellCommand(args),
+		DocumentName: config.Flags().DocumentName,
+		Parameters:   sessionParameters(),
+		Stdin:        stdin,
+	})
+}
+
+// shellSafe matches the arguments which need no quoting in a POSIX shell.
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellCommand returns the command line running the command with the arguments, each quoted for a POSIX shell so
+// the command receives them unchanged.  A single argument is returned as is, as a command line.
+func shellCommand(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafe.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestShellCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ls -l /tmp | wc -l"}, "ls -l /tmp | wc -l"},
+		{[]string{"ls", "-l", "/var/log"}, "ls -l /var/log"},
+		{[]string{"echo", "hello world"}, "echo 'hello world'"},
+		{[]string{"echo", "it's"}, `echo 'it'\''s'`},
+		{[]string{"echo", "$HOME", "`id`", "a;b", "*"}, "echo '$HOME' '`id`' 'a;b' '*'"},
+		{[]string{"echo", ""}, "echo ''"},
+		{[]string{"grep", "-e", "user@host:8080/path,x=y+z%"}, "grep -e user@host:8080/path,x=y+z%"},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			if got := shellCommand(tc.args); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShellCommandArguments(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no POSIX shell")
+	}
+
+	// the shell passes each argument to the command unchanged
+	args := []string{"hello world", "it's", "$HOME", "`id`", "a;b", "*", "", "line\nbreak", `back\slash`, `"quoted"`}
+	out, err := exec.Command(sh, "-c", shellCommand(append([]string{"printf", `%s\n`}, args...))).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := strings.Join(args, "\n") + "\n"; string(out) != want {
+		t.Errorf("got arguments %q, want %q", out, want)
+	}
+}
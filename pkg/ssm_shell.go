@@ -2,9 +2,11 @@ package pkg
 
 import (
 	"context"
+	"os"
 
 	"github.com/alexbacchin/ssm-session-client/config"
 	"github.com/alexbacchin/ssm-session-client/ssmclient"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"go.uber.org/zap"
 )
 
@@ -26,9 +28,40 @@ func StartSSMShell(target string) error {
 	if err != nil {
 		zap.S().Fatal(err)
 	}
+	if config.Flags().RecordFile != "" {
+		return startRecordedSSMShell(ssmMessagesCfg, tgt)
+	}
+	in := &ssmclient.ShellInput{
+		Target:       tgt,
+		DocumentName: config.Flags().DocumentName,
+		Parameters:   sessionParameters(),
+	}
+	if config.Flags().UseSSMSessionPlugin {
+		return ssmclient.ShellPluginSessionWithInput(ssmMessagesCfg, in)
+	}
+	return ssmclient.ShellSessionWithInput(ssmMessagesCfg, in)
+
+}
+
+// startRecordedSSMShell starts a shell session recorded to the configured file.  The session manager plugin
+// output can't be captured, so recording always uses the native session client.
+func startRecordedSSMShell(cfg aws.Config, target string) error {
 	if config.Flags().UseSSMSessionPlugin {
-		return ssmclient.ShellPluginSession(ssmMessagesCfg, tgt)
+		zap.S().Info("session recording is not supported by the session manager plugin, using the native client")
+	}
+
+	f, err := os.Create(config.Flags().RecordFile)
+	if err != nil {
+		zap.S().Fatal(err)
 	}
-	return ssmclient.ShellSession(ssmMessagesCfg, tgt)
 
+	rec := ssmclient.NewRecorder(f, config.Flags().RecordInput)
+	defer rec.Close()
+
+	return ssmclient.ShellSessionWithInput(cfg, &ssmclient.ShellInput{
+		Target:       target,
+		DocumentName: config.Flags().DocumentName,
+		Parameters:   sessionParameters(),
+		Recorder:     rec,
+	})
 }
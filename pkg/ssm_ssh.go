@@ -44,8 +44,10 @@ func StartSSHSession(target string) error {
 	}
 
 	in := ssmclient.PortForwardingInput{
-		Target:     tgt,
-		RemotePort: port,
+		Target:       tgt,
+		RemotePort:   port,
+		DocumentName: config.Flags().DocumentName,
+		Parameters:   sessionParameters(),
 	}
 	ssmMessagesCfg, err := BuildAWSConfig(context.Background(), "ssmmessages")
 	if err != nil {
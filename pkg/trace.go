@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"go.uber.org/zap"
+)
+
+// TraceFilter selects the records of a protocol trace, empty fields match all records.  PayloadType matches the
+// payload type name (like "handshake_request") or number.
+type TraceFilter struct {
+	SessionID   string
+	Direction   string
+	MessageType string
+	PayloadType string
+}
+
+// TraceDecodeOptions configures the output of StartTraceDecode.  If JSON is set, the matching records are written
+// as JSON lines (a filtered trace), otherwise as text.  NoPayload removes the payloads (and their digests) from the
+// output.
+type TraceDecodeOptions struct {
+	Filter    TraceFilter
+	JSON      bool
+	NoPayload bool
+}
+
+// StartTraceDecode prints the records of a protocol trace file ("-" reads standard input).
+func StartTraceDecode(file string, opts TraceDecodeOptions) error {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			zap.S().Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	tr := datachannel.NewTraceReader(r)
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		rec, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !opts.Filter.match(rec) {
+			continue
+		}
+
+		if opts.NoPayload && (rec.Payload != "" || rec.PayloadHex != "") {
+			rec.Payload, rec.PayloadHex = "", ""
+			rec.Truncated = false
+			rec.Redacted = true
+		}
+
+		// traces written by older versions have the digest of redacted payloads
+		if opts.NoPayload || rec.Redacted {
+			rec.PayloadDigest = ""
+		}
+
+		if opts.NoPayload {
+			rec.HeaderHex = maskHeaderDigest(rec.HeaderHex)
+		}
+
+		if opts.JSON {
+			err = enc.Encode(rec)
+		} else {
+			_, err = io.WriteString(os.Stdout, formatTraceRecord(rec))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// headerDigestHex and headerDigestHexEnd are the range of the payload digest in the hex encoded message header of an invalid message record.
+const headerDigestHex, headerDigestHexEnd = 80 * 2, (80 + 32) * 2
+
+// maskHeaderDigest zeroes the payload digest in the hex encoded message header.
+func maskHeaderDigest(header string) string {
+	if len(header) <= headerDigestHex {
+		return header
+	}
+
+	end := min(len(header), headerDigestHexEnd)
+	return header[:headerDigestHex] + strings.Repeat("0", end-headerDigestHex) + header[end:]
+}
+
+func (f TraceFilter) match(rec *datachannel.TraceRecord) bool {
+	if f.SessionID != "" && rec.SessionID != f.SessionID {
+		return false
+	}
+
+	if f.Direction != "" && !strings.EqualFold(rec.Direction, f.Direction) {
+		return false
+	}
+
+	if f.MessageType != "" && !strings.EqualFold(string(rec.MessageType), f.MessageType) {
+		return false
+	}
+
+	if f.PayloadType != "" && !strings.EqualFold(rec.PayloadType.String(), f.PayloadType) &&
+		f.PayloadType != strconv.FormatUint(uint64(rec.PayloadType), 10) {
+		return false
+	}
+	return true
+}
+
+// formatTraceRecord formats a record as a summary line, followed by the payload (JSON payloads are indented).
+func formatTraceRecord(rec *datachannel.TraceRecord) string {
+	sb := new(strings.Builder)
+	if rec.Error != "" {
+		fmt.Fprintf(sb, "%s %-3s invalid message len=%d error=%q",
+			rec.Time.Format("2006-01-02T15:04:05.000Z07:00"), rec.Direction, rec.FrameLength, rec.Error)
+		if rec.SessionID != "" {
+			fmt.Fprintf(sb, " session=%s", rec.SessionID)
+		}
+		fmt.Fprintf(sb, "\n    header: %s\n", rec.HeaderHex)
+		return sb.String()
+	}
+
+	fmt.Fprintf(sb, "%s %-3s %-20s seq=%-6d %-22s flags=%-4s len=%-5d id=%s",
+		rec.Time.Format("2006-01-02T15:04:05.000Z07:00"), rec.Direction, rec.MessageType, rec.SequenceNumber,
+		rec.PayloadType, rec.Flags, rec.PayloadLength, rec.MessageID)
+
+	if rec.SessionID != "" {
+		fmt.Fprintf(sb, " session=%s", rec.SessionID)
+	}
+
+	switch {
+	case rec.Redacted:
+		sb.WriteString(" [redacted]")
+	case rec.Truncated:
+		sb.WriteString(" [truncated]")
+	}
+	sb.WriteString("\n")
+
+	switch {
+	case rec.Payload != "":
+		payload := []byte(rec.Payload)
+		indented := new(bytes.Buffer)
+		if !rec.Truncated && json.Indent(indented, payload, "    ", "  ") == nil {
+			payload = indented.Bytes()
+		}
+		fmt.Fprintf(sb, "    %s\n", payload)
+	case rec.PayloadHex != "":
+		fmt.Fprintf(sb, "    hex: %s\n", rec.PayloadHex)
+	}
+	return sb.String()
+}
@@ -0,0 +1,24 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaskHeaderDigest(t *testing.T) {
+	header := strings.Repeat("ab", 120)
+	masked := maskHeaderDigest(header)
+	want := strings.Repeat("ab", 80) + strings.Repeat("0", 64) + strings.Repeat("ab", 8)
+	if masked != want {
+		t.Errorf("got %s", masked)
+	}
+
+	// the header of a message too short to be decoded
+	if masked = maskHeaderDigest(strings.Repeat("ab", 90)); masked != strings.Repeat("ab", 80)+strings.Repeat("0", 20) {
+		t.Errorf("got %s for a short header", masked)
+	}
+
+	if masked = maskHeaderDigest("abcd"); masked != "abcd" {
+		t.Errorf("got %s for a header without the digest", masked)
+	}
+}
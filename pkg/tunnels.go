@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/ssmclient"
+	"go.uber.org/zap"
+)
+
+// StartTunnels runs the tunnels of the configuration file with the given names (all of them if none are given)
+// concurrently, until they all end or the process receives an interrupt or termination signal.  The AWS
+// configuration is loaded once and shared by the tunnels, and the log of each tunnel is named after it.
+func StartTunnels(names []string) error {
+	tunnels, err := selectTunnels(config.Flags().Tunnels, names)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
+	if config.Flags().UseSSMSessionPlugin {
+		zap.S().Info("tunnels are not supported by the session manager plugin, using the native client")
+	}
+
+	ssmcfg, err := BuildAWSConfig(context.Background(), "ssm")
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	ssmMessagesCfg, err := BuildAWSConfig(context.Background(), "ssmmessages")
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
+	inputs := make([]*ssmclient.PortForwardingInput, len(tunnels))
+	for i, t := range tunnels {
+		target := t.Target
+		if target == "devbox" {
+			target = GetTarget(target)
+		}
+
+		tgt, err := ssmclient.ResolveTarget(target, ssmcfg)
+		if err != nil {
+			zap.S().Fatalf("tunnel %s: %v", t.Name, err)
+		}
+
+		inputs[i] = &ssmclient.PortForwardingInput{
+			Target:      tgt,
+			RemotePort:  t.RemotePort,
+			LocalPort:   t.LocalPort,
+			BindAddress: t.BindAddress,
+			Host:        t.RemoteHost,
+			Logger:      zap.L().Named(t.Name),
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(inputs))
+	for i, in := range inputs {
+		wg.Add(1)
+		go func(i int, in *ssmclient.PortForwardingInput) {
+			defer wg.Done()
+			if err := ssmclient.PortForwardingSessionContext(ctx, ssmMessagesCfg, in); err != nil {
+				in.Logger.Error("tunnel failed", zap.Error(err))
+				errs[i] = fmt.Errorf("tunnel %s: %w", tunnels[i].Name, err)
+				return
+			}
+			in.Logger.Info("tunnel closed")
+		}(i, in)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// selectTunnels returns the configured tunnels with the given names, in the order of the names, or all the
+// configured tunnels if no names are given.
+func selectTunnels(configured []config.Tunnel, names []string) ([]config.Tunnel, error) {
+	byName := make(map[string]config.Tunnel, len(configured))
+	for _, t := range configured {
+		if t.Name == "" || t.Target == "" || t.RemotePort < 1 {
+			return nil, fmt.Errorf("tunnel %q: name, target and remote-port are required", t.Name)
+		}
+		if _, ok := byName[t.Name]; ok {
+			return nil, fmt.Errorf("tunnel %q is configured more than once", t.Name)
+		}
+		byName[t.Name] = t
+	}
+
+	if len(names) < 1 {
+		if len(configured) < 1 {
+			return nil, errors.New("no tunnels are configured in the tunnels section of the configuration file")
+		}
+		return configured, nil
+	}
+
+	selected := make([]config.Tunnel, 0, len(names))
+	for _, name := range names {
+		t, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("tunnel %q is not configured", name)
+		}
+		selected = append(selected, t)
+	}
+	return selected, nil
+}
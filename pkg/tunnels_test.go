@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+)
+
+func TestSelectTunnels(t *testing.T) {
+	db := config.Tunnel{Name: "db", Target: "i-0bdb4f892de4bb54c", RemoteHost: "mydb.internal", RemotePort: 5432}
+	cache := config.Tunnel{Name: "cache", Target: "i-0bdb4f892de4bb54c", RemotePort: 6379}
+	admin := config.Tunnel{Name: "admin", Target: "i-0a1b2c3d4e5f67890", RemotePort: 8080}
+	configured := []config.Tunnel{db, cache, admin}
+
+	for _, tc := range []struct {
+		name       string
+		configured []config.Tunnel
+		names      []string
+		want       []config.Tunnel
+		wantErr    string
+	}{
+		{"all", configured, nil, configured, ""},
+		{"by name", configured, []string{"admin", "db"}, []config.Tunnel{admin, db}, ""},
+		{"single", configured, []string{"cache"}, []config.Tunnel{cache}, ""},
+		{"unknown name", configured, []string{"db", "web"}, nil, `tunnel "web" is not configured`},
+		{"none configured", nil, nil, nil, "no tunnels are configured"},
+		{"unknown name none configured", nil, []string{"db"}, nil, `tunnel "db" is not configured`},
+		{"duplicate", []config.Tunnel{db, cache, db}, []string{"cache"}, nil, `tunnel "db" is configured more than once`},
+		{"missing name", []config.Tunnel{db, {Target: "i-0bdb4f892de4bb54c", RemotePort: 22}}, nil, nil, "name, target and remote-port are required"},
+		{"missing target", []config.Tunnel{{Name: "ssh", RemotePort: 22}}, nil, nil, `tunnel "ssh": name, target and remote-port are required`},
+		{"missing remote port", []config.Tunnel{{Name: "ssh", Target: "i-0bdb4f892de4bb54c"}}, nil, nil, `tunnel "ssh": name, target and remote-port are required`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := selectTunnels(tc.configured, tc.names)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
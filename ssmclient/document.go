@@ -0,0 +1,159 @@
+package ssmclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"go.uber.org/zap"
+)
+
+// DefaultShellDocument is the session document used by the SSM service for shell sessions if none is specified.
+const DefaultShellDocument = "SSM-SessionManagerRunShell"
+
+var (
+	// ErrInvalidParameter is the error returned if the session parameters do not match the parameters declared by
+	// the session document.
+	ErrInvalidParameter = errors.New("invalid session document parameter")
+	// ErrNotSessionDocument is the error returned if the document is not a Session document.
+	ErrNotSessionDocument = errors.New("not a session document")
+)
+
+// ParseParameters parses a list of key=value strings into session document parameters.  Repeating a key adds a
+// value to the parameter, for StringList parameters.
+func ParseParameters(params []string) (map[string][]string, error) {
+	if len(params) < 1 {
+		return nil, nil
+	}
+
+	parameters := make(map[string][]string, len(params))
+	for _, p := range params {
+		k, v, ok := strings.Cut(p, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("%w %q, expected key=value", ErrInvalidParameter, p)
+		}
+		parameters[k] = append(parameters[k], v)
+	}
+	return parameters, nil
+}
+
+// ValidateDocumentParameters checks the parameters against the session document, using the SSM DescribeDocument
+// API.  An error is returned if the document is not a Session document, a parameter is not declared by the
+// document, or a parameter without a default value is missing.
+func ValidateDocumentParameters(ctx context.Context, cfg aws.Config, documentName string, parameters map[string][]string) error {
+	declared, err := documentParameters(ctx, cfg, documentName)
+	if err != nil {
+		return err
+	}
+	return checkParameters(documentName, declared, parameters)
+}
+
+// documentParameters returns the parameters declared by the session document, by name.
+func documentParameters(ctx context.Context, cfg aws.Config, documentName string) (map[string]types.DocumentParameter, error) {
+	out, err := ssm.NewFromConfig(cfg).DescribeDocument(ctx, &ssm.DescribeDocumentInput{Name: aws.String(documentName)})
+	if err != nil {
+		return nil, err
+	}
+
+	if out.Document.DocumentType != types.DocumentTypeSession {
+		return nil, fmt.Errorf("%w: %s is a %s document", ErrNotSessionDocument, documentName, out.Document.DocumentType)
+	}
+
+	declared := make(map[string]types.DocumentParameter, len(out.Document.Parameters))
+	for _, p := range out.Document.Parameters {
+		declared[aws.ToString(p.Name)] = p
+	}
+	return declared, nil
+}
+
+func checkParameters(documentName string, declared map[string]types.DocumentParameter, parameters map[string][]string) error {
+	for k, v := range parameters {
+		p, ok := declared[k]
+		if !ok {
+			return fmt.Errorf("%w %q, %s accepts %s", ErrInvalidParameter, k, documentName, parameterNames(declared))
+		}
+
+		if p.Type == types.DocumentParameterTypeString && len(v) > 1 {
+			return fmt.Errorf("%w %q, %s accepts a single value", ErrInvalidParameter, k, documentName)
+		}
+	}
+
+	for k, p := range declared {
+		if _, ok := parameters[k]; !ok && p.DefaultValue == nil {
+			return fmt.Errorf("%w %q, required by %s", ErrInvalidParameter, k, documentName)
+		}
+	}
+	return nil
+}
+
+func parameterNames(declared map[string]types.DocumentParameter) string {
+	if len(declared) < 1 {
+		return "no parameters"
+	}
+
+	names := make([]string, 0, len(declared))
+	for k := range declared {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// sessionInput builds the StartSessionInput for the target with the default document and parameters of the session
+// type, unless the caller set a document or parameters.  In that case the parameters of the caller take precedence
+// over the defaults, default parameters not declared by the document are dropped (logged at debug level), and the
+// parameters are validated against the document.  An empty defaultDocument is the shell document of the SSM service.
+func sessionInput(cfg aws.Config, target, documentName string, parameters map[string][]string,
+	defaultDocument string, defaults map[string][]string) (*ssm.StartSessionInput, error) {
+	in := &ssm.StartSessionInput{Target: aws.String(target)}
+
+	if documentName == "" && len(parameters) < 1 {
+		if defaultDocument != "" {
+			in.DocumentName = aws.String(defaultDocument)
+		}
+		if len(defaults) > 0 {
+			in.Parameters = defaults
+		}
+		return in, nil
+	}
+
+	if documentName == "" {
+		documentName = defaultDocument
+	}
+	if documentName == "" {
+		documentName = DefaultShellDocument
+	}
+
+	declared, err := documentParameters(context.Background(), cfg, documentName)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string][]string, len(defaults)+len(parameters))
+	for k, v := range defaults {
+		if _, ok := declared[k]; !ok {
+			defaultLogger().Debug("dropping the default parameter not declared by the document",
+				zap.String("document", documentName), zap.String("parameter", k))
+			continue
+		}
+		merged[k] = v
+	}
+	for k, v := range parameters {
+		merged[k] = v
+	}
+
+	if err = checkParameters(documentName, declared, merged); err != nil {
+		return nil, err
+	}
+
+	in.DocumentName = aws.String(documentName)
+	if len(merged) > 0 {
+		in.Parameters = merged
+	}
+	return in, nil
+}
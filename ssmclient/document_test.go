@@ -0,0 +1,116 @@
+package ssmclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel/ssmtest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParseParameters(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params []string
+		want   map[string][]string
+	}{
+		{"none", nil, nil},
+		{"single", []string{"portNumber=5432"}, map[string][]string{"portNumber": {"5432"}}},
+		{"list", []string{"commands=ls", "commands=pwd", "dir=/tmp"}, map[string][]string{"commands": {"ls", "pwd"}, "dir": {"/tmp"}}},
+		{"empty value", []string{"shellProfile="}, map[string][]string{"shellProfile": {""}}},
+		{"value with equals", []string{"command=env FOO=bar"}, map[string][]string{"command": {"env FOO=bar"}}},
+		{"spaces around key", []string{" host =db"}, map[string][]string{"host": {"db"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseParameters(tc.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseParametersMalformed(t *testing.T) {
+	for _, p := range []string{"portNumber", "=5432", " =5432", ""} {
+		t.Run(p, func(t *testing.T) {
+			if _, err := ParseParameters([]string{"host=db", p}); !errors.Is(err, ErrInvalidParameter) {
+				t.Errorf("expected ErrInvalidParameter, got %v", err)
+			}
+		})
+	}
+}
+
+// testDocuments are the documents of the fake server.
+var testDocuments = map[string]ssmtest.Document{
+	"Custom-PortForwarding": {Parameters: []ssmtest.DocumentParameter{
+		{Name: "portNumber"},
+		{Name: "localPortNumber", DefaultValue: aws.String("")},
+		{Name: "commands", Type: "StringList", DefaultValue: aws.String("")},
+	}},
+	"Custom-Command": {Type: "Command"},
+}
+
+func TestValidateDocumentParameters(t *testing.T) {
+	srv := ssmtest.NewServer(&ssmtest.Options{Documents: testDocuments})
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name     string
+		document string
+		params   map[string][]string
+		wantErr  error
+	}{
+		{"valid", "Custom-PortForwarding", map[string][]string{"portNumber": {"5432"}}, nil},
+		{"list", "Custom-PortForwarding", map[string][]string{"portNumber": {"5432"}, "commands": {"ls", "pwd"}}, nil},
+		{"unknown parameter", "Custom-PortForwarding", map[string][]string{"portNumber": {"5432"}, "host": {"db"}}, ErrInvalidParameter},
+		{"missing required", "Custom-PortForwarding", map[string][]string{"localPortNumber": {"5432"}}, ErrInvalidParameter},
+		{"multiple string values", "Custom-PortForwarding", map[string][]string{"portNumber": {"5432", "5433"}}, ErrInvalidParameter},
+		{"not a session document", "Custom-Command", nil, ErrNotSessionDocument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateDocumentParameters(context.Background(), srv.AWSConfig(), tc.document, tc.params)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("got error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	if err := ValidateDocumentParameters(context.Background(), srv.AWSConfig(), "Missing", nil); err == nil {
+		t.Error("expected an error for a document which does not exist")
+	}
+}
+
+func TestSessionInputDropsUndeclaredDefaults(t *testing.T) {
+	srv := ssmtest.NewServer(&ssmtest.Options{Documents: testDocuments})
+	defer srv.Close()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	saved := sessionLogger.Load()
+	SetLogger(zap.New(core))
+	t.Cleanup(func() { sessionLogger.Store(saved) })
+
+	defaults := map[string][]string{"portNumber": {"22"}, "host": {"db.internal"}}
+	in, err := sessionInput(srv.AWSConfig(), "i-0123456789abcdef0", "Custom-PortForwarding",
+		map[string][]string{"localPortNumber": {"2222"}}, "AWS-StartPortForwardingSession", defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{"portNumber": {"22"}, "localPortNumber": {"2222"}}
+	if !reflect.DeepEqual(in.Parameters, want) || aws.ToString(in.DocumentName) != "Custom-PortForwarding" {
+		t.Errorf("unexpected session input %s %v", aws.ToString(in.DocumentName), in.Parameters)
+	}
+
+	dropped := logs.FilterMessage("dropping the default parameter not declared by the document").All()
+	if len(dropped) != 1 || dropped[0].ContextMap()["parameter"] != "host" {
+		t.Errorf("unexpected log %v", dropped)
+	}
+}
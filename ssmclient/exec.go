@@ -0,0 +1,109 @@
+package ssmclient
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.uber.org/zap"
+)
+
+// DefaultExecDocument is the session document used by ExecSession if the ExecInput does not set one.
+const DefaultExecDocument = "AWS-StartNonInteractiveCommand"
+
+// ErrNoExitCode is returned by ExecSession when the session ended without the agent reporting the exit code of
+// the command.
+var ErrNoExitCode = errors.New("the agent did not report the exit code of the command")
+
+// ExecInput configures a non-interactive command session.
+// Target is the EC2 instance ID to run the command on.
+// Command is passed to the session document in the "command" parameter, along with any other Parameters.
+// DocumentName is the session document, DefaultExecDocument if not set.  If DocumentName or Parameters are set,
+// the parameters are validated against the document before the session is started.
+// Stdin, if set, is sent to the command.  Stdout and Stderr receive the output of the command (os.Stdout and
+// os.Stderr if not set), the output is only separated if the agent reports the stderr output of the command.
+// Logger receives the log of the session, if not set the Logger from SetLogger is used.
+type ExecInput struct {
+	Target       string
+	Command      string
+	DocumentName string
+	Parameters   map[string][]string
+	Stdin        io.Reader
+	Stdout       io.Writer
+	Stderr       io.Writer
+	Logger       *zap.Logger
+}
+
+func (in *ExecInput) logger() *zap.Logger {
+	if in.Logger != nil {
+		return in.Logger
+	}
+	return defaultLogger()
+}
+
+// ExecSession runs a command on the target with a non-interactive command session, returning when the session
+// ends.  The aws.Config parameter will be used to call the AWS SSM StartSession API, which is used as part of
+// establishing the websocket communication channel.  The exit code of the command is returned, ErrNoExitCode is
+// returned with an exit code of -1 if the agent did not report it.
+func ExecSession(cfg aws.Config, in *ExecInput) (int, error) {
+	// the command is validated with the other parameters for a custom document, as the document must declare it
+	var defaults, parameters map[string][]string
+	command := map[string][]string{"command": {in.Command}}
+	if in.DocumentName == "" && len(in.Parameters) < 1 {
+		defaults = command
+	} else {
+		parameters = make(map[string][]string, len(in.Parameters)+1)
+		for k, v := range in.Parameters {
+			parameters[k] = v
+		}
+		parameters["command"] = command["command"]
+	}
+
+	ssi, err := sessionInput(cfg, in.Target, in.DocumentName, parameters, DefaultExecDocument, defaults)
+	if err != nil {
+		return -1, err
+	}
+
+	c, err := openSession(cfg, ssi, in.logger())
+	if err != nil {
+		return -1, err
+	}
+	defer c.Close()
+
+	log := in.logger().With(zap.String(datachannel.LogKeyTarget, in.Target),
+		zap.String(datachannel.LogKeySessionID, c.SessionID()))
+	// an interrupted command did not succeed
+	installSignalHandler(c, log, signalExitCode)
+
+	stdout := in.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+
+	c.Stderr = in.Stderr
+	if c.Stderr == nil {
+		c.Stderr = os.Stderr
+	}
+
+	if in.Stdin != nil {
+		go func() {
+			if _, err := io.Copy(c, in.Stdin); err != nil {
+				log.Info("error copying stdin to the session", zap.Error(err))
+			}
+		}()
+	}
+
+	// WriteTo returns once the agent closes the channel after the command exits
+	if _, err = c.WriteTo(stdout); err != nil && !errors.Is(err, io.EOF) {
+		return -1, err
+	}
+
+	code, ok := c.ExitCode()
+	if !ok {
+		return -1, ErrNoExitCode
+	}
+	log.Debug("command exited", zap.Int("exitCode", code))
+	return code, nil
+}
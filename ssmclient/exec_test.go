@@ -0,0 +1,81 @@
+package ssmclient
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/alexbacchin/ssm-session-client/datachannel/ssmtest"
+)
+
+func TestExecSession(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		stderr   string
+		exitCode string
+		want     int
+		wantErr  error
+	}{
+		{"success", "", "0", 0, nil},
+		{"failure", "ls: cannot access 'missing'\n", "2", 2, nil},
+		{"no exit code", "", "", -1, ErrNoExitCode},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := ssmtest.NewServer(nil)
+			defer srv.Close()
+
+			stdout := new(syncBuffer)
+			stderr := new(syncBuffer)
+
+			type result struct {
+				code int
+				err  error
+			}
+			resCh := make(chan result, 1)
+			go func() {
+				code, err := ExecSession(srv.AWSConfig(), &ExecInput{
+					Target:  "i-0123456789abcdef0",
+					Command: "ls -l missing",
+					Stdin:   strings.NewReader("input\n"),
+					Stdout:  stdout,
+					Stderr:  stderr,
+				})
+				resCh <- result{code, err}
+			}()
+
+			// the input is echoed to stdout, then the agent reports the stderr and the exit code of the command
+			waitFor(t, 10*time.Second, func() bool { return stdout.String() == "input\n" })
+			sess := srv.LastSession()
+			if tc.stderr != "" {
+				sess.SendPayload(datachannel.StdErr, []byte(tc.stderr))
+			}
+			if tc.exitCode != "" {
+				sess.SendPayload(datachannel.ExitCode, []byte(tc.exitCode))
+			}
+			waitFor(t, 10*time.Second, func() bool { return sess.Unacknowledged() == 0 })
+			sess.CloseChannel("")
+
+			var res result
+			select {
+			case res = <-resCh:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the session did not end when the channel was closed")
+			}
+
+			if res.code != tc.want || !errors.Is(res.err, tc.wantErr) {
+				t.Errorf("got exit code %d and error %v, want %d and %v", res.code, res.err, tc.want, tc.wantErr)
+			}
+
+			if stdout.String() != "input\n" || stderr.String() != tc.stderr {
+				t.Errorf("got stdout %q and stderr %q", stdout.String(), stderr.String())
+			}
+
+			params := sess.Input().Parameters
+			if doc := sess.Input().DocumentName; doc == nil || *doc != DefaultExecDocument || params["command"][0] != "ls -l missing" {
+				t.Errorf("unexpected session input %v %v", sess.Input().DocumentName, params)
+			}
+		})
+	}
+}
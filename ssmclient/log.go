@@ -0,0 +1,23 @@
+package ssmclient
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+var sessionLogger atomic.Pointer[zap.Logger]
+
+// SetLogger sets the Logger used by the session functions, and the data channels they open, unless the session
+// input sets its own (like the Logger field of PortForwardingInput).  Nothing is logged until a Logger is set.
+func SetLogger(l *zap.Logger) {
+	sessionLogger.Store(l)
+}
+
+// defaultLogger returns the Logger set with SetLogger, or a no-op logger.
+func defaultLogger() *zap.Logger {
+	if l := sessionLogger.Load(); l != nil {
+		return l
+	}
+	return zap.NewNop()
+}
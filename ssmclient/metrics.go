@@ -0,0 +1,233 @@
+package ssmclient
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"go.uber.org/zap"
+)
+
+const metricsPrefix = "ssm_session_client_"
+
+// sessions is the registry of the data channels opened by this process, reported by the metrics server.  Data
+// channels are only registered while the metrics server runs.
+var sessions = &sessionRegistry{channels: make(map[*datachannel.SsmDataChannel]struct{})}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	enabled  bool
+	channels map[*datachannel.SsmDataChannel]struct{}
+}
+
+// enable starts registering data channels.
+func (r *sessionRegistry) enable() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enabled = true
+}
+
+// add registers the data channel if the registry is enabled, until the data channel is closed.  Must be called
+// before the data channel is used, as it sets the OnClose function (calling any OnClose function already set).
+func (r *sessionRegistry) add(c *datachannel.SsmDataChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.enabled {
+		return
+	}
+	r.channels[c] = struct{}{}
+
+	onClose := c.OnClose
+	c.OnClose = func() {
+		r.remove(c)
+		if onClose != nil {
+			onClose()
+		}
+	}
+}
+
+func (r *sessionRegistry) remove(c *datachannel.SsmDataChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.channels, c)
+}
+
+// stats returns the statistics of the open data channels, ordered by target and session ID.  Closed data channels
+// are removed from the registry.
+func (r *sessionRegistry) stats() []datachannel.Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make([]datachannel.Stats, 0, len(r.channels))
+	for c := range r.channels {
+		st := c.Stats()
+		if st.Closed {
+			delete(r.channels, c)
+			continue
+		}
+		all = append(all, st)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].TargetID != all[j].TargetID {
+			return all[i].TargetID < all[j].TargetID
+		}
+		return all[i].SessionID < all[j].SessionID
+	})
+	return all
+}
+
+// StartMetricsServer serves the statistics of the sessions opened by this process in the Prometheus text format,
+// at the /metrics path of the listen address.  The server runs in the background until the process exits, the
+// error is returned if the address can not be listened on.
+func StartMetricsServer(addr string) error {
+	lsnr, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	sessions.enable()
+
+	srv := &http.Server{Handler: metricsHandler(sessions), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(lsnr); err != nil {
+			defaultLogger().Info("metrics server stopped", zap.Error(err))
+		}
+	}()
+
+	defaultLogger().Info("serving metrics", zap.String("url", "http://"+lsnr.Addr().String()+"/metrics"))
+	return nil
+}
+
+// metricsHandler serves the statistics of the data channels of the registry at the /metrics path.
+func metricsHandler(r *sessionRegistry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WriteMetrics(w, r.stats()); err != nil {
+			defaultLogger().Debug("metrics request failed", zap.Error(err))
+		}
+	})
+	return mux
+}
+
+// WriteMetrics writes the session statistics in the Prometheus text format, labelled by target and session ID.
+func WriteMetrics(w io.Writer, stats []datachannel.Stats) error {
+	mw := &metricsWriter{w: w}
+
+	mw.gauge("sessions", "Number of open sessions.", nil, float64(len(stats)))
+
+	counters := []struct {
+		name, help string
+		value      func(st *datachannel.Stats) float64
+	}{
+		{"messages_sent_total", "Messages sent to the agent, including acknowledgements and retransmissions.",
+			func(st *datachannel.Stats) float64 { return float64(st.MessagesSent) }},
+		{"messages_received_total", "Messages received from the agent.",
+			func(st *datachannel.Stats) float64 { return float64(st.MessagesReceived) }},
+		{"bytes_sent_total", "Session data bytes sent to the agent.",
+			func(st *datachannel.Stats) float64 { return float64(st.BytesSent) }},
+		{"bytes_received_total", "Session data bytes received from the agent.",
+			func(st *datachannel.Stats) float64 { return float64(st.BytesReceived) }},
+		{"retransmits_total", "Messages retransmitted because they were not acknowledged in time.",
+			func(st *datachannel.Stats) float64 { return float64(st.Retransmits) }},
+		{"reconnects_total", "Successful resumptions of the session after the connection was lost.",
+			func(st *datachannel.Stats) float64 { return float64(st.Reconnects) }},
+		{"pauses_total", "Times publication was paused by the agent.",
+			func(st *datachannel.Stats) float64 { return float64(st.Pauses) }},
+		{"paused_seconds_total", "Total time publication was paused by the agent.",
+			func(st *datachannel.Stats) float64 { return st.PausedTime.Seconds() }},
+	}
+
+	for _, m := range counters {
+		mw.header(m.name, m.help, "counter")
+		for i := range stats {
+			mw.sample(m.name, sessionLabels(&stats[i]), m.value(&stats[i]))
+		}
+	}
+
+	mw.header("unacknowledged_messages", "Messages sent to the agent and not yet acknowledged.", "gauge")
+	for i := range stats {
+		mw.sample("unacknowledged_messages", sessionLabels(&stats[i]), float64(stats[i].Unacknowledged))
+	}
+
+	mw.header("smoothed_rtt_seconds", "Smoothed round trip time of acknowledged messages.", "gauge")
+	for i := range stats {
+		mw.sample("smoothed_rtt_seconds", sessionLabels(&stats[i]), stats[i].SmoothedRTT.Seconds())
+	}
+
+	mw.header("ack_latency_seconds", "Time from sending a message to its acknowledgement by the agent.", "histogram")
+	for i := range stats {
+		mw.histogram("ack_latency_seconds", sessionLabels(&stats[i]), &stats[i].AckLatency)
+	}
+
+	mw.header("pause_duration_seconds", "Duration of the pauses of publication by the agent.", "histogram")
+	for i := range stats {
+		mw.histogram("pause_duration_seconds", sessionLabels(&stats[i]), &stats[i].PauseDuration)
+	}
+
+	return mw.err
+}
+
+func sessionLabels(st *datachannel.Stats) [][2]string {
+	return [][2]string{{"target", st.TargetID}, {"session_id", st.SessionID}}
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format, keeping the first write error.
+// REF: https://prometheus.io/docs/instrumenting/exposition_formats/
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+func (mw *metricsWriter) header(name, help, typ string) {
+	mw.printf("# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, typ)
+}
+
+func (mw *metricsWriter) gauge(name, help string, labels [][2]string, v float64) {
+	mw.header(name, help, "gauge")
+	mw.sample(name, labels, v)
+}
+
+func (mw *metricsWriter) sample(name string, labels [][2]string, v float64) {
+	mw.printf("%s%s%s %s\n", metricsPrefix, name, formatLabels(labels), strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (mw *metricsWriter) histogram(name string, labels [][2]string, h *datachannel.Histogram) {
+	for i, bound := range h.Bounds {
+		le := append(labels[:len(labels):len(labels)], [2]string{"le", strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)})
+		mw.sample(name+"_bucket", le, float64(h.Counts[i]))
+	}
+
+	inf := append(labels[:len(labels):len(labels)], [2]string{"le", "+Inf"})
+	mw.sample(name+"_bucket", inf, float64(h.Count))
+	mw.sample(name+"_sum", labels, h.Sum.Seconds())
+	mw.sample(name+"_count", labels, float64(h.Count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels [][2]string) string {
+	if len(labels) < 1 {
+		return ""
+	}
+
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, l[0], labelEscaper.Replace(l[1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
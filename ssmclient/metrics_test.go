@@ -0,0 +1,133 @@
+package ssmclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/alexbacchin/ssm-session-client/datachannel/ssmtest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	r := &sessionRegistry{channels: make(map[*datachannel.SsmDataChannel]struct{})}
+
+	c := new(datachannel.SsmDataChannel)
+	r.add(c)
+	if len(r.channels) != 0 || c.OnClose != nil {
+		t.Fatal("data channel registered without the metrics server")
+	}
+
+	// the OnClose function already set is still called
+	var closed bool
+	c.OnClose = func() { closed = true }
+
+	r.enable()
+	r.add(c)
+	if len(r.channels) != 1 {
+		t.Fatal("data channel not registered")
+	}
+
+	_ = c.Close()
+	if len(r.channels) != 0 {
+		t.Error("data channel still registered after Close")
+	}
+	if !closed {
+		t.Error("the OnClose function of the data channel was not called")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	srv := ssmtest.NewServer(nil)
+	defer srv.Close()
+
+	r := &sessionRegistry{channels: make(map[*datachannel.SsmDataChannel]struct{})}
+	r.enable()
+
+	c := new(datachannel.SsmDataChannel)
+	r.add(c)
+	err := c.Open(srv.AWSConfig(), &ssm.StartSessionInput{Target: aws.String("i-0123456789abcdef0")},
+		&datachannel.SSMMessagesResover{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err = c.WaitForHandshakeCompleteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(readerFunc(func(p []byte) (int, error) { return c.ReadOutputContext(ctx, p) }), make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(metricsHandler(r))
+	defer ts.Close()
+
+	scrape := func() string {
+		t.Helper()
+
+		resp, err := http.Get(ts.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Fatalf("unexpected response %s %s", resp.Status, resp.Header.Get("Content-Type"))
+		}
+		return string(body)
+	}
+
+	labels := fmt.Sprintf(`{target="i-0123456789abcdef0",session_id=%q}`, c.SessionID())
+	body := scrape()
+	for _, want := range []string{
+		"ssm_session_client_sessions 1\n",
+		"# TYPE ssm_session_client_bytes_sent_total counter\n",
+		"ssm_session_client_bytes_sent_total" + labels + " 5\n",
+		"ssm_session_client_bytes_received_total" + labels + " 5\n",
+		"# TYPE ssm_session_client_ack_latency_seconds histogram\n",
+		`ssm_session_client_ack_latency_seconds_bucket{target="i-0123456789abcdef0",session_id="` + c.SessionID() + `",le="+Inf"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the metrics do not contain %q:\n%s", want, body)
+		}
+	}
+
+	// the closed data channel is no longer reported
+	_ = c.Close()
+	if body = scrape(); !strings.Contains(body, "ssm_session_client_sessions 0\n") || strings.Contains(body, c.SessionID()) {
+		t.Errorf("the closed session is reported:\n%s", body)
+	}
+
+	resp, err := http.Get(ts.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %s for another path", resp.Status)
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
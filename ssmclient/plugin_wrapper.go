@@ -13,6 +13,7 @@ import (
 	_ "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session/portsession"
 	_ "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session/shellsession"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
@@ -28,7 +29,7 @@ func PluginSession(cfg aws.Config, input *ssm.StartSessionInput) error {
 	}
 
 	if config.Flags().SSMMessagesVpcEndpoint != "" {
-		zap.S().Debugf("Using VPC endpoint for SSM messages: %s", config.Flags().SSMMessagesVpcEndpoint)
+		defaultLogger().Debug("using VPC endpoint for SSM messages", zap.String("endpoint", config.Flags().SSMMessagesVpcEndpoint))
 		parsedUrl, err := url.Parse(*out.StreamUrl)
 		if err != nil {
 			return err
@@ -36,8 +37,19 @@ func PluginSession(cfg aws.Config, input *ssm.StartSessionInput) error {
 		parsedUrl.Host = config.Flags().SSMMessagesVpcEndpoint
 		newStreamUrl := parsedUrl.String()
 		out.StreamUrl = &newStreamUrl
-		zap.S().Debugf("New stream URL: %s", *out.StreamUrl)
+		defaultLogger().Debug("new stream URL", zap.String("url", *out.StreamUrl))
 	}
+	dialer, err := pluginDialer()
+	if err != nil {
+		return err
+	}
+
+	// the plugin always dials with the gorilla websocket.DefaultDialer, so the configured copy replaces it for
+	// the duration of the session
+	saved := websocket.DefaultDialer
+	websocket.DefaultDialer = dialer
+	defer func() { websocket.DefaultDialer = saved }()
+
 	ssmSession := new(session.Session)
 	ssmSession.SessionId = *out.SessionId
 	ssmSession.StreamUrl = *out.StreamUrl
@@ -49,3 +61,24 @@ func PluginSession(cfg aws.Config, input *ssm.StartSessionInput) error {
 
 	return ssmSession.Execute(log.Logger(false, ssmSession.ClientId))
 }
+
+// pluginDialer returns a copy of the gorilla websocket.DefaultDialer with the TLS and proxy settings of the
+// configuration.  The proxy is not used with an SSM messages VPC endpoint.
+func pluginDialer() (*websocket.Dialer, error) {
+	dialer := *websocket.DefaultDialer
+
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer.TLSClientConfig = tlsConfig
+
+	if config.Flags().SSMMessagesVpcEndpoint == "" {
+		proxy, err := config.ProxyFunc()
+		if err != nil {
+			return nil, err
+		}
+		dialer.Proxy = proxy
+	}
+	return &dialer, nil
+}
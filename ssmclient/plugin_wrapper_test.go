@@ -0,0 +1,66 @@
+package ssmclient
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/gorilla/websocket"
+)
+
+func TestPluginDialer(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		vpcEndpoint string
+		wantProxy   string
+	}{
+		{"proxy", "", "http://proxy:3128"},
+		// the proxy of the environment, the default of the gorilla dialer
+		{"vpc endpoint", "vpce-0123456789abcdef0.ssmmessages.us-east-1.vpce.amazonaws.com", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flags := config.Flags()
+			saved := *flags
+			t.Cleanup(func() { *flags = saved })
+
+			flags.ProxyURL = "http://proxy:3128"
+			flags.TLSMinVersion = "1.3"
+			flags.SSMMessagesVpcEndpoint = tc.vpcEndpoint
+
+			dialer, err := pluginDialer()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if dialer == websocket.DefaultDialer || websocket.DefaultDialer.TLSClientConfig != nil {
+				t.Error("the websocket.DefaultDialer was modified")
+			}
+
+			if dialer.TLSClientConfig == nil || dialer.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+				t.Errorf("unexpected TLS config %+v", dialer.TLSClientConfig)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "https://ssmmessages.us-east-1.amazonaws.com/", http.NoBody)
+			u, err := dialer.Proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tc.wantProxy
+			if want == "" {
+				if env, _ := http.ProxyFromEnvironment(req); env != nil {
+					want = env.String()
+				}
+			}
+
+			var got string
+			if u != nil {
+				got = u.String()
+			}
+			if got != want {
+				t.Errorf("got proxy %q, want %q", got, want)
+			}
+		})
+	}
+}
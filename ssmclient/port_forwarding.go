@@ -1,38 +1,111 @@
 package ssmclient
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 
-	"github.com/alexbacchin/ssm-session-client/config"
 	"github.com/alexbacchin/ssm-session-client/datachannel"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"go.uber.org/zap"
-	"golang.org/x/net/netutil"
 )
 
+// ErrRemoteConnect is the error passed to the PortForwardingInput ConnectErrorHandler when the agent fails to
+// connect to the remote port.
+var ErrRemoteConnect = errors.New("agent failed to connect to the remote port")
+
 // PortForwardingInput configures the port forwarding session parameters.
 // Target is the EC2 instance ID to establish the session with.
-// RemotePort is the port on the EC2 instance to connect to.
+// RemotePort is the port on the EC2 instance to connect to, or on the Host if set.
+// Host is a host reachable from the EC2 instance (such as an RDS endpoint) to forward to, through the instance.
 // LocalPort is the port on the local host to listen to.  If not provided, a random port will be used.
+// BindAddress is the local address to listen on, localhost if not set.
+// ConnectErrorHandler is called (with an error wrapping ErrRemoteConnect) each time the agent fails to connect to
+// the remote port, the session continues to serve new connections.
+// ListeningHandler is called once the local port is listening, with the listen address and the data channel of the
+// session (for example, to report its statistics).
+// DocumentName and Parameters override the session document and add to (or replace) its parameters, they are
+// validated against the document before the session is started.  The parameters set from RemotePort and Host are
+// dropped if the document does not declare them.
+// Logger receives the log of the session, if not set the Logger from SetLogger is used.
 type PortForwardingInput struct {
-	Target     string
-	RemotePort int
-	LocalPort  int
-	Host       string // optional
+	Target              string
+	RemotePort          int
+	LocalPort           int
+	BindAddress         string // optional
+	Host                string // optional
+	DocumentName        string // optional
+	Parameters          map[string][]string
+	ConnectErrorHandler func(error)
+	ListeningHandler    func(net.Addr, *datachannel.SsmDataChannel)
+	Logger              *zap.Logger
+}
+
+func (in *PortForwardingInput) logger() *zap.Logger {
+	if in.Logger != nil {
+		return in.Logger
+	}
+	return defaultLogger()
+}
+
+// sessionInput builds the StartSessionInput with the default document and parameters of the session type,
+// overridden by the DocumentName and Parameters of the input.
+func (in *PortForwardingInput) sessionInput(cfg aws.Config, defaultDocument string, defaults map[string][]string) (*ssm.StartSessionInput, error) {
+	return sessionInput(cfg, in.Target, in.DocumentName, in.Parameters, defaultDocument, defaults)
+}
+
+// portSessionInput builds the StartSessionInput of a port forwarding session, forwarding to the Host through the
+// target if set, otherwise to the target itself.
+func (in *PortForwardingInput) portSessionInput(cfg aws.Config) (*ssm.StartSessionInput, error) {
+	documentName := "AWS-StartPortForwardingSession"
+	parameters := map[string][]string{
+		"localPortNumber": {strconv.Itoa(in.LocalPort)},
+		"portNumber":      {strconv.Itoa(in.RemotePort)},
+	}
+
+	if in.Host != "" {
+		parameters["host"] = []string{in.Host}
+		documentName = "AWS-StartPortForwardingSessionToRemoteHost"
+	}
+
+	return in.sessionInput(cfg, documentName, parameters)
+}
+
+// remoteAddr describes the remote end of the forwarded connections, for messages.
+func (in *PortForwardingInput) remoteAddr() string {
+	if in.Host != "" {
+		return fmt.Sprintf("%s through %s", net.JoinHostPort(in.Host, strconv.Itoa(in.RemotePort)), in.Target)
+	}
+	return fmt.Sprintf("%d on %s", in.RemotePort, in.Target)
 }
 
 // PortForwardingSession starts a port forwarding session using the PortForwardingInput parameters to
 // configure the session.  The aws.Config parameter will be used to call the AWS SSM StartSession
-// API, which is used as part of establishing the websocket communication channel.
-//
-//nolint:funlen,gocognit // it's long, but not overly hard to read despite what the gocognit says
+// API, which is used as part of establishing the websocket communication channel.  If the remote
+// Host is set, connections are forwarded to the host through the target.  If the remote
+// agent supports it, connections are multiplexed over the session so many can be served concurrently,
+// otherwise connections are served one at a time.  If the connection with the service is lost (and can not
+// be resumed), the session ends with the data channel error, such as datachannel.ErrConnectionStale.
 func PortForwardingSession(cfg aws.Config, opts *PortForwardingInput) error {
+	return portForwardingSession(context.Background(), cfg, opts, true)
+}
+
+// PortForwardingSessionContext is PortForwardingSession, ending the session when the context is done instead of
+// when the process receives an interrupt or termination signal.  The session is terminated, and nil is returned,
+// once the context is done.  This allows an application to run several sessions, and shut them down together.
+func PortForwardingSessionContext(ctx context.Context, cfg aws.Config, opts *PortForwardingInput) error {
+	return portForwardingSession(ctx, cfg, opts, false)
+}
+
+func portForwardingSession(ctx context.Context, cfg aws.Config, opts *PortForwardingInput, handleSignals bool) error {
 	c, err := openDataChannel(cfg, opts)
 	if err != nil {
 		return err
@@ -43,24 +116,157 @@ func PortForwardingSession(cfg aws.Config, opts *PortForwardingInput) error {
 		_ = c.Close()
 	}()
 
+	log := opts.logger().With(zap.String(datachannel.LogKeyTarget, opts.Target),
+		zap.String(datachannel.LogKeySessionID, c.SessionID()))
+
 	// use a signal handler vs. defer since defer operates after an escape from the outer loop
 	// and we can't trust the data channel connection state at that point.  Intercepting signals
 	// means we're probably trying to shutdown somewhere in the outer loop, and there's a good
 	// possibility that the data channel is still valid
-	installSignalHandler(c)
+	if handleSignals {
+		installSignalHandler(c, log, exitSuccess)
+	}
+
+	// likewise, the session is terminated as soon as the context is done, closing the data channel (and the
+	// listener) ends the forwarding loops
+	stopCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		<-stopCtx.Done()
+		if ctx.Err() != nil {
+			log.Info("shutting down", zap.Error(ctx.Err()))
+			_ = c.TerminateSession()
+			_ = c.Close()
+		}
+	}()
+
+	err = forwardPorts(stopCtx, c, opts, log)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// forwardPorts serves the connections to the local port over the data channel, until the data channel is closed
+// or the context is done.
+func forwardPorts(ctx context.Context, c *datachannel.SsmDataChannel, opts *PortForwardingInput, log *zap.Logger) error {
+	connErrCh := make(chan struct{}, 1)
+	c.ConnectToPortErrorHandler = func() {
+		err := fmt.Errorf("%w %s", ErrRemoteConnect, opts.remoteAddr())
+		log.Warn("check the SSM agent logs on the target", zap.Error(err))
+		if opts.ConnectErrorHandler != nil {
+			opts.ConnectErrorHandler(err)
+		}
+
+		select {
+		case connErrCh <- struct{}{}:
+		default:
+		}
+	}
 
-	if err = c.WaitForHandshakeComplete(); err != nil {
+	if err := c.WaitForHandshakeComplete(); err != nil {
 		return err
 	}
 
-	lsnr, err := createListener(opts.LocalPort)
+	lsnr, err := createListener(opts.BindAddress, opts.LocalPort)
 	if err != nil {
 		return err
 	}
 	defer lsnr.Close()
-	zap.S().Infof("listening on %s", lsnr.Addr())
+	go func() {
+		<-ctx.Done()
+		_ = lsnr.Close()
+	}()
+	log.Info("listening", zap.Stringer("addr", lsnr.Addr()), zap.String("remote", opts.remoteAddr()))
+	if opts.ListeningHandler != nil {
+		opts.ListeningHandler(lsnr.Addr(), c)
+	}
+
+	if c.SupportsMultiplexing() {
+		return muxPortForwarding(c, lsnr, log)
+	}
+	log.Warn("connections are served one at a time", zap.Error(c.RequireFeature(datachannel.FeatureMultiplexing)))
 
-	doneCh := make(chan bool)
+	// without muxing, the agent can only carry a single connection at a time, basicPortForwarding only accepts
+	// the next connection once the current one is finished
+	// REF: https://github.com/aws/amazon-ssm-agent/blob/master/agent/session/plugins/port/port_mux.go
+	return basicPortForwarding(c, lsnr, connErrCh, log)
+}
+
+// muxPortForwarding serves each accepted connection as a separate smux stream over the data channel, allowing
+// multiple concurrent connections to the remote port.  Returns when the mux session with the agent is closed,
+// with the data channel error if the session closed because the data channel failed.
+//
+// There is no connection to reset on a ConnectToPortError here.  The agent reports a failed connection to the
+// remote port by closing the stream, which closes the local connection, and the flag (only sent by agents
+// without multiplexing) does not identify a stream.
+func muxPortForwarding(c *datachannel.SsmDataChannel, lsnr net.Listener, log *zap.Logger) error {
+	session, err := c.NewMuxSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	go func() {
+		// unblock Accept() once the agent side of the session goes away
+		<-session.CloseChan()
+		_ = lsnr.Close()
+	}()
+
+	for {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			if session.IsClosed() {
+				return c.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			// not fatal, just wait for next
+			log.Info("accept failed", zap.Error(err))
+			continue
+		}
+
+		stream, err := session.OpenStream()
+		if err != nil {
+			log.Info("unable to open stream", zap.Error(err))
+			_ = conn.Close()
+			continue
+		}
+		log.Debug("accepted connection", zap.Stringer("remoteAddr", conn.RemoteAddr()), zap.Uint32("stream", stream.ID()))
+
+		go handleDataTransfer(stream, conn)
+	}
+}
+
+// handleDataTransfer copies data in both directions between the two connections, closing each side when
+// the copy towards it completes.
+func handleDataTransfer(dst, src io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		_ = dst.Close()
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(src, dst)
+		_ = src.Close()
+	}()
+
+	wg.Wait()
+}
+
+// basicPortForwarding serves one connection at a time over the data channel, signalling the agent with
+// DisconnectPort as each connection finishes.  A receive on connErrCh (the agent failed to connect to the remote
+// port) resets the current connection.  A stale connection with the service ends the session.
+//
+//nolint:gocognit // it's long, but not overly hard to read despite what the gocognit says
+func basicPortForwarding(c *datachannel.SsmDataChannel, lsnr net.Listener, connErrCh <-chan struct{}, log *zap.Logger) error {
+	var err error
 	errCh := make(chan error)
 	inCh := messageChannel(c, errCh)
 
@@ -68,28 +274,50 @@ outer:
 	for {
 		var conn net.Conn
 		conn, err = lsnr.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			// not fatal, just wait for next (maybe unless lsnr is dead?)
-			zap.S().Info(err)
+			log.Info("accept failed", zap.Error(err))
 			continue
 		}
 
+		// a ConnectToPortError received between connections applies to the previous connection
+		select {
+		case <-connErrCh:
+		default:
+		}
+
+		doneCh := make(chan error, 1)
 		go func() {
-			// handle incoming messages from AWS in the background
-			if _, e := io.Copy(c, conn); e != nil {
-				errCh <- e
-			}
-			doneCh <- true
+			// send the local connection data to AWS in the background
+			_, e := io.Copy(c, conn)
+			doneCh <- e
 		}()
 
 	inner:
 		for {
 			select {
-			case <-doneCh:
+			case e := <-doneCh:
+				if e != nil {
+					log.Info("local connection copy failed", zap.Error(e))
+				}
+
+				if errors.Is(e, datachannel.ErrConnectionStale) {
+					// there's no point waiting for another local connection
+					_ = conn.Close()
+					return e
+				}
+
 				// basic (non-muxing) connections support DisconnectPort to signal to the remote agent that
 				// we are shutting down this particular connection on our end, and possibly expect a new one.
 				_ = c.DisconnectPort()
 				break inner
+			case <-connErrCh:
+				// the agent has no connection to forward to, reset the local connection.  The copy
+				// goroutine exits, and the DisconnectPort prepares the agent for the next connection.
+				resetConn(conn)
 			case data, ok := <-inCh:
 				if !ok {
 					// incoming websocket channel is closed, which is fatal
@@ -98,20 +326,24 @@ outer:
 				}
 
 				if _, err = conn.Write(data); err != nil {
-					zap.S().Info(err)
+					log.Info("local connection write failed", zap.Error(err))
 				}
 			case er, ok := <-errCh:
 				if !ok {
 					// I can't think of a good reason why we'd ever end up here, but if we do
 					// we should stop the world
-					zap.S().Info("errCh closed")
+					log.Info("errCh closed")
 					_ = conn.Close()
 					break outer
 				}
 
-				// any write to errCh means at least 1 of the goroutines has exited
-				zap.S().Info(er)
-				break inner
+				// any write to errCh means the goroutine reading the data channel has exited
+				log.Info("data channel read failed", zap.Error(er))
+				_ = conn.Close()
+				if errors.Is(er, datachannel.ErrConnectionStale) {
+					return er
+				}
+				break outer
 			}
 		}
 
@@ -120,67 +352,51 @@ outer:
 	return nil
 }
 
+// resetConn closes the connection, with a TCP reset if possible so the client sees the connection was refused
+// rather than a normal end of data.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	_ = conn.Close()
+}
+
 // PortPluginSession delegates the execution of the SSM port forwarding to the AWS-managed session manager plugin code,
 // bypassing this libraries internal websocket code and connection management.
 func PortPluginSession(cfg aws.Config, opts *PortForwardingInput) error {
-	documentName := "AWS-StartPortForwardingSession"
-	parameters := map[string][]string{
-		"localPortNumber": {strconv.Itoa(opts.LocalPort)},
-		"portNumber":      {strconv.Itoa(opts.RemotePort)},
-	}
-
-	if opts.Host != "" {
-		parameters["host"] = []string{opts.Host}
-		documentName = "AWS-StartPortForwardingSessionToRemoteHost"
-	}
-
-	in := &ssm.StartSessionInput{
-		DocumentName: aws.String(documentName),
-		Target:       aws.String(opts.Target),
-		Parameters:   parameters,
-		Reason:       aws.String("ssm-session-client"),
+	in, err := opts.portSessionInput(cfg)
+	if err != nil {
+		return err
 	}
+	in.Reason = aws.String("ssm-session-client")
 
 	return PluginSession(cfg, in)
 }
 
 func openDataChannel(cfg aws.Config, opts *PortForwardingInput) (*datachannel.SsmDataChannel, error) {
-	in := &ssm.StartSessionInput{
-		DocumentName: aws.String("AWS-StartPortForwardingSession"),
-		Target:       aws.String(opts.Target),
-		Parameters: map[string][]string{
-			"localPortNumber": {strconv.Itoa(opts.LocalPort)},
-			"portNumber":      {strconv.Itoa(opts.RemotePort)},
-		},
-	}
-
-	c := new(datachannel.SsmDataChannel)
-	if err := c.Open(cfg, in, &datachannel.SSMMessagesResover{
-		Endpoint: config.Flags().SSMMessagesVpcEndpoint,
-	}); err != nil {
+	in, err := opts.portSessionInput(cfg)
+	if err != nil {
 		return nil, err
 	}
-	return c, nil
+
+	return openSession(cfg, in, opts.logger())
 }
 
 // read messages from websocket and write payload to the returned channel.
 func messageChannel(c datachannel.DataChannel, errCh chan error) chan []byte {
 	inCh := make(chan []byte)
 
-	buf := make([]byte, 4096)
-	var payload []byte
-
 	go func() {
 		defer close(inCh)
 
 		for {
-			nr, err := c.Read(buf)
+			m, err := c.ReadMessage()
 			if err != nil {
 				errCh <- err
 				return
 			}
 
-			payload, err = c.HandleMsg(buf[:nr])
+			payload, err := c.HandleMessage(m)
 			if err != nil {
 				errCh <- err
 				return
@@ -195,28 +411,44 @@ func messageChannel(c datachannel.DataChannel, errCh chan error) chan []byte {
 	return inCh
 }
 
-func createListener(port int) (net.Listener, error) {
-	l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+func createListener(addr string, port int) (net.Listener, error) {
+	if addr == "" {
+		addr = "localhost"
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
 	if err != nil {
 		return nil, err
 	}
 
-	// use limit listener for now, eventually maybe we'll add muxing
-	// REF: https://github.com/aws/amazon-ssm-agent/blob/master/agent/session/plugins/port/port_mux.go
-	return netutil.LimitListener(l, 1), nil
+	return l, nil
 }
 
-// shared with ssh.go.
-func installSignalHandler(c datachannel.DataChannel) {
+// shared with ssh.go and exec.go.  exitCode returns the exit code of the process for the signal ending the session.
+func installSignalHandler(c datachannel.DataChannel, log *zap.Logger, exitCode func(os.Signal) int) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigCh
-		zap.S().Infof("Got signal: %s, shutting down", sig.String())
+		log.Info("shutting down", zap.Stringer("signal", sig))
 
 		_ = c.TerminateSession()
 		_ = c.Close()
 
-		os.Exit(0)
+		os.Exit(exitCode(sig))
 	}()
 }
+
+// exitSuccess is the exit code of sessions which are normally ended by a signal, such as port forwarding.
+func exitSuccess(os.Signal) int {
+	return 0
+}
+
+// signalExitCode is the conventional exit code of a process ended by the signal, 128 plus the signal number
+// (130 for an interrupt).
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
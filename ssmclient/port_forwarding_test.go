@@ -0,0 +1,178 @@
+package ssmclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/alexbacchin/ssm-session-client/datachannel/ssmtest"
+)
+
+func TestPortForwardingSession(t *testing.T) {
+	for _, mode := range []struct {
+		name         string
+		agentVersion string
+	}{
+		{"mux", ssmtest.DefaultAgentVersion},
+		// agents without multiplexing serve one connection at a time
+		{"basic", "3.0.100.0"},
+	} {
+		for _, tc := range testFaults {
+			t.Run(mode.name+"/"+tc.name, func(t *testing.T) {
+				srv := ssmtest.NewServer(&ssmtest.Options{AgentVersion: mode.agentVersion, Faults: tc.faults})
+				defer srv.Close()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				addrCh := make(chan net.Addr, 1)
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- PortForwardingSessionContext(ctx, srv.AWSConfig(), &PortForwardingInput{
+						Target:     "i-0123456789abcdef0",
+						RemotePort: 5432,
+						ListeningHandler: func(addr net.Addr, _ *datachannel.SsmDataChannel) {
+							addrCh <- addr
+						},
+					})
+				}()
+
+				var addr net.Addr
+				select {
+				case addr = <-addrCh:
+				case err := <-errCh:
+					t.Fatal(err)
+				case <-time.After(10 * time.Second):
+					t.Fatal("the local port is not listening")
+				}
+
+				// connections one after the other, which are served by both modes
+				for i := 0; i < 2; i++ {
+					echo(t, addr, bytes.Repeat([]byte{byte('a' + i)}, 32*1024))
+				}
+
+				params := srv.LastSession().Input().Parameters
+				if params["portNumber"][0] != "5432" {
+					t.Errorf("unexpected session parameters %v", params)
+				}
+
+				cancel()
+				select {
+				case err := <-errCh:
+					if err != nil {
+						t.Fatal(err)
+					}
+				case <-time.After(10 * time.Second):
+					t.Fatal("the session did not end with the context")
+				}
+
+				// the TerminateSession flag is handled by the agent after the session ended on the client, it is not
+				// re-sent once the data channel is closed
+				if tc.faults.Drop == 0 {
+					waitFor(t, 5*time.Second, srv.LastSession().Terminated)
+				}
+			})
+		}
+	}
+}
+
+func TestPortForwardingConnectToPortError(t *testing.T) {
+	// the ConnectToPortError flag is sent by agents without multiplexing
+	srv := ssmtest.NewServer(&ssmtest.Options{AgentVersion: "3.0.100.0"})
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addrCh := make(chan net.Addr, 1)
+	connErrCh := make(chan error, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- PortForwardingSessionContext(ctx, srv.AWSConfig(), &PortForwardingInput{
+			Target:     "i-0123456789abcdef0",
+			RemotePort: 5432,
+			ListeningHandler: func(addr net.Addr, _ *datachannel.SsmDataChannel) {
+				addrCh <- addr
+			},
+			ConnectErrorHandler: func(err error) {
+				connErrCh <- err
+			},
+		})
+	}()
+
+	var addr net.Addr
+	select {
+	case addr = <-addrCh:
+	case err := <-errCh:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the local port is not listening")
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// the connection is served, then the agent reports it could not connect to the remote port
+	if _, err = conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	flag := make([]byte, 4)
+	binary.BigEndian.PutUint32(flag, uint32(datachannel.ConnectToPortError))
+	srv.LastSession().SendPayload(datachannel.Flag, flag)
+
+	select {
+	case err = <-connErrCh:
+		if !errors.Is(err, ErrRemoteConnect) {
+			t.Errorf("expected ErrRemoteConnect, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the ConnectErrorHandler was not called")
+	}
+
+	// the local connection is reset, rather than closed normally
+	if _, err = conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected a connection reset, got %v", err)
+	}
+
+	// the next connection is served
+	echo(t, addr, []byte("hello"))
+}
+
+// echo sends the data over a connection to the forwarded port, and checks it is echoed back.
+func echo(t *testing.T, addr net.Addr, data []byte) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("the echoed data does not match the data sent")
+	}
+}
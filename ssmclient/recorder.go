@@ -0,0 +1,215 @@
+package ssmclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	asciicastVersion = 2
+
+	// asciicast v2 event codes
+	eventOutput = "o"
+	eventInput  = "i"
+	eventResize = "r"
+
+	// terminal size recorded in the header if the session never reports a size
+	defaultRecordCols = 80
+	defaultRecordRows = 24
+)
+
+// ErrRecorderClosed is the error returned when writing to a Recorder which has been closed.
+var ErrRecorderClosed = errors.New("recorder closed")
+
+// asciicastHeader is the first line of an asciicast v2 recording.
+// REF: https://docs.asciinema.org/manual/asciicast/v2/
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes a shell session recording in asciicast v2 format.  The header is written with the first
+// terminal size reported by Resize (or the first event, using a default size), each following line is an
+// output, input or resize event timed relative to the creation of the Recorder.  Input is only recorded if
+// requested, since it may contain sensitive data (like passwords typed at a prompt).
+type Recorder struct {
+	mu          sync.Mutex
+	w           io.Writer
+	start       time.Time
+	recordInput bool
+	header      bool
+	closed      bool
+	rows        uint32
+	cols        uint32
+	partial     map[string][]byte
+}
+
+// NewRecorder creates a Recorder writing to w.  If w is an io.Closer, it is closed by Recorder.Close().
+func NewRecorder(w io.Writer, recordInput bool) *Recorder {
+	return &Recorder{
+		w:           w,
+		start:       time.Now(),
+		recordInput: recordInput,
+		partial:     make(map[string][]byte),
+	}
+}
+
+// Output returns an io.Writer which records the data written to it as output events.
+func (r *Recorder) Output() io.Writer {
+	return &recorderStream{r: r, code: eventOutput}
+}
+
+// Input returns an io.Writer which records the data written to it as input events, or discards the data if
+// input recording is disabled.
+func (r *Recorder) Input() io.Writer {
+	if !r.recordInput {
+		return io.Discard
+	}
+	return &recorderStream{r: r, code: eventInput}
+}
+
+// Resize records a change of the terminal size, a size equal to the last recorded size is ignored.
+func (r *Recorder) Resize(rows, cols uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.header && rows == r.rows && cols == r.cols {
+		return nil
+	}
+
+	if !r.header {
+		r.rows, r.cols = rows, cols
+		return r.writeHeader()
+	}
+
+	r.rows, r.cols = rows, cols
+	return r.writeEvent(eventResize, fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Close records any buffered partial UTF-8 data, and closes the underlying writer if it is an io.Closer.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	var err error
+	for _, code := range []string{eventOutput, eventInput} {
+		if p := r.partial[code]; len(p) > 0 {
+			delete(r.partial, code)
+			if e := r.writeEvent(code, string(p)); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	r.closed = true
+
+	if c, ok := r.w.(io.Closer); ok {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// record writes the data as an event, holding back any incomplete UTF-8 sequence at the end of the data
+// until the rest of the sequence is written.  Event data is a JSON string, so a split multibyte character
+// would otherwise be recorded as replacement characters.
+func (r *Recorder) record(code string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrRecorderClosed
+	}
+
+	buf := append(r.partial[code], data...)
+	n := completeUTF8(buf)
+	r.partial[code] = append([]byte(nil), buf[n:]...)
+
+	if n < 1 {
+		return nil
+	}
+	return r.writeEvent(code, string(buf[:n]))
+}
+
+// writeEvent writes a single event line, and the header if not already written.  Must be called with the
+// mutex held.
+func (r *Recorder) writeEvent(code, data string) error {
+	if r.closed {
+		return ErrRecorderClosed
+	}
+
+	if !r.header {
+		r.rows, r.cols = defaultRecordRows, defaultRecordCols
+		if err := r.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	elapsed := time.Since(r.start).Seconds()
+	return r.writeLine([]interface{}{elapsed, code, data})
+}
+
+func (r *Recorder) writeHeader() error {
+	h := &asciicastHeader{
+		Version:   asciicastVersion,
+		Width:     r.cols,
+		Height:    r.rows,
+		Timestamp: r.start.Unix(),
+	}
+
+	if term := os.Getenv("TERM"); term != "" {
+		h.Env = map[string]string{"TERM": term}
+	}
+
+	r.header = true
+	return r.writeLine(h)
+}
+
+func (r *Recorder) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.w.Write(append(line, '\n'))
+	return err
+}
+
+// completeUTF8 returns the length of the data without any incomplete UTF-8 sequence at the end.
+func completeUTF8(data []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return len(data) - i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+// recorderStream is the io.Writer for a single event type of a Recorder.
+type recorderStream struct {
+	r    *Recorder
+	code string
+}
+
+func (s *recorderStream) Write(data []byte) (int, error) {
+	if err := s.r.record(s.code, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -0,0 +1,159 @@
+package ssmclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordedEvents returns the header and the events of a recording.
+func recordedEvents(t *testing.T, data string) (*asciicastHeader, [][]interface{}) {
+	t.Helper()
+
+	lines := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	h := new(asciicastHeader)
+	if err := json.Unmarshal([]byte(lines[0]), h); err != nil {
+		t.Fatalf("invalid header %q: %v", lines[0], err)
+	}
+
+	var events [][]interface{}
+	for _, line := range lines[1:] {
+		var ev []interface{}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil || len(ev) != 3 {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		events = append(events, ev)
+	}
+	return h, events
+}
+
+func TestRecorderHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		resize     bool
+		rows, cols uint32
+	}{
+		{"resize", true, 45, 132},
+		{"default size", false, defaultRecordRows, defaultRecordCols},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("TERM", "xterm-256color")
+
+			buf := new(bytes.Buffer)
+			rec := NewRecorder(buf, false)
+			if tc.resize {
+				if err := rec.Resize(tc.rows, tc.cols); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := rec.Output().Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			h, events := recordedEvents(t, buf.String())
+			if h.Version != asciicastVersion || h.Height != tc.rows || h.Width != tc.cols {
+				t.Errorf("unexpected header %+v", h)
+			}
+
+			if h.Timestamp != rec.start.Unix() || h.Env["TERM"] != "xterm-256color" {
+				t.Errorf("unexpected header %+v", h)
+			}
+
+			if len(events) != 1 || events[0][1] != eventOutput || events[0][2] != "hello" {
+				t.Errorf("unexpected events %v", events)
+			}
+		})
+	}
+}
+
+func TestRecorderEvents(t *testing.T) {
+	buf := new(bytes.Buffer)
+	rec := NewRecorder(buf, true)
+	// the events are timed relative to the creation of the Recorder
+	rec.start = rec.start.Add(-time.Second)
+
+	if err := rec.Resize(24, 80); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = rec.Output().Write([]byte("$ "))
+	_, _ = rec.Input().Write([]byte("ls\r"))
+	_ = rec.Resize(24, 80) // unchanged, not recorded
+	_ = rec.Resize(50, 200)
+	_, _ = rec.Output().Write([]byte("file\r\n"))
+
+	_, events := recordedEvents(t, buf.String())
+	want := [][2]string{{eventOutput, "$ "}, {eventInput, "ls\r"}, {eventResize, "200x50"}, {eventOutput, "file\r\n"}}
+	if len(events) != len(want) {
+		t.Fatalf("got events %v", events)
+	}
+
+	last := 1.0
+	for i, ev := range events {
+		if ev[1] != want[i][0] || ev[2] != want[i][1] {
+			t.Errorf("event %d: got %v, want %v", i, ev, want[i])
+		}
+
+		// the time is in seconds, and never goes backwards
+		elapsed, ok := ev[0].(float64)
+		if !ok || elapsed < last || elapsed > 10 {
+			t.Errorf("event %d: unexpected time %v", i, ev[0])
+		}
+		last = elapsed
+	}
+}
+
+func TestRecorderInputDisabled(t *testing.T) {
+	buf := new(bytes.Buffer)
+	rec := NewRecorder(buf, false)
+
+	if _, err := rec.Input().Write([]byte("secret\r")); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("the input was recorded: %q", buf.String())
+	}
+}
+
+func TestRecorderSplitUTF8(t *testing.T) {
+	buf := new(bytes.Buffer)
+	rec := NewRecorder(buf, false)
+	w := rec.Output()
+
+	// "héllo €" with the multibyte characters split over writes
+	data := []byte("héllo €")
+	for _, chunk := range [][]byte{data[:2], data[2:4], data[4:8], data[8:9], data[9:]} {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an incomplete sequence at the end is recorded by Close
+	if _, err := w.Write([]byte{0xe2, 0x82}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, events := recordedEvents(t, buf.String())
+	var got []string
+	for _, ev := range events {
+		got = append(got, ev[2].(string))
+	}
+
+	want := []string{"h", "él", "lo ", "€", "��"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+
+	if _, err := w.Write([]byte("x")); !errors.Is(err, ErrRecorderClosed) {
+		t.Errorf("expected ErrRecorderClosed writing to a closed Recorder, got %v", err)
+	}
+}
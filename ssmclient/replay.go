@@ -0,0 +1,301 @@
+package ssmclient
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// replaySeekStep is the distance moved in the recording by the seek keys.
+const replaySeekStep = 5 * time.Second
+
+// ansiPattern matches the terminal escape sequences (CSI, OSC, charset selection and other ESC sequences), and
+// the control characters which are not part of a plain text transcript.
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()*+][0-9A-Za-z]|\x1b[@-Z\\-_=>78]|[\x00-\x08\x0b-\x1f\x7f]`)
+
+// RecordingEvent is a single event of an asciicast v2 recording.  Time is the offset of the event from the
+// start of the recording, Code is the asciicast event code ("o" output, "i" input, "r" resize).
+type RecordingEvent struct {
+	Time time.Duration
+	Code string
+	Data string
+}
+
+// Recording is an asciicast v2 recording, as written by a Recorder.
+type Recording struct {
+	Width     uint32
+	Height    uint32
+	Timestamp time.Time
+	Events    []RecordingEvent
+}
+
+// ReplayOptions configures the playback of a Recording.  Speed is the playback speed multiplier (values
+// less than or equal to 0 play at the original speed).  If IdleTimeLimit is set, pauses between events are
+// shortened to at most this duration.
+type ReplayOptions struct {
+	Speed         float64
+	IdleTimeLimit time.Duration
+}
+
+// ReadRecording parses an asciicast v2 recording.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !sc.Scan() {
+		if sc.Err() != nil {
+			return nil, sc.Err()
+		}
+		return nil, errors.New("empty recording")
+	}
+
+	h := new(asciicastHeader)
+	if err := json.Unmarshal(sc.Bytes(), h); err != nil {
+		return nil, fmt.Errorf("invalid recording header: %w", err)
+	}
+
+	if h.Version != asciicastVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", h.Version)
+	}
+
+	rec := &Recording{
+		Width:     h.Width,
+		Height:    h.Height,
+		Timestamp: time.Unix(h.Timestamp, 0),
+	}
+
+	for line := 2; sc.Scan(); line++ {
+		if len(strings.TrimSpace(sc.Text())) < 1 {
+			continue
+		}
+
+		var ev []interface{}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("invalid event at line %d: %w", line, err)
+		}
+
+		if len(ev) != 3 {
+			return nil, fmt.Errorf("invalid event at line %d", line)
+		}
+
+		t, ok1 := ev[0].(float64)
+		code, ok2 := ev[1].(string)
+		data, ok3 := ev[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("invalid event at line %d", line)
+		}
+
+		rec.Events = append(rec.Events, RecordingEvent{
+			Time: time.Duration(t * float64(time.Second)),
+			Code: code,
+			Data: data,
+		})
+	}
+	return rec, sc.Err()
+}
+
+// DumpRecording writes the output of the recording to w as plain text, with the terminal escape sequences
+// and control characters removed.
+func DumpRecording(rec *Recording, w io.Writer) error {
+	var sb strings.Builder
+	for _, ev := range rec.Events {
+		if ev.Code == eventOutput {
+			sb.WriteString(ev.Data)
+		}
+	}
+
+	text := strings.ReplaceAll(sb.String(), "\r\n", "\n")
+	_, err := io.WriteString(w, ansiPattern.ReplaceAllString(text, ""))
+	return err
+}
+
+// ReplayRecording plays the recording output on the terminal, with the original timing adjusted by the
+// ReplayOptions.  While playing, space pauses and resumes the playback, the left and right arrow keys seek
+// backwards and forwards, '.' steps to the next event while paused, and 'q' or Ctrl-C stops the playback.
+func ReplayRecording(rec *Recording, opts ReplayOptions) error {
+	keys := make(chan byte, 16)
+	if err := configureStdin(); err != nil {
+		defaultLogger().Info("unable to configure terminal, playback controls disabled", zap.Error(err))
+	} else {
+		defer cleanup() //nolint:errcheck
+		go readReplayKeys(os.Stdin, keys)
+	}
+
+	p := newPlayer(rec, opts, os.Stdout)
+	return p.play(keys)
+}
+
+// player keys, the arrow keys are translated from their escape sequences to values outside the ASCII range.
+const (
+	keyPause = ' '
+	keyStep  = '.'
+	keyQuit  = 'q'
+	keyCtrlC = 0x03
+	keyLeft  = 0x80
+	keyRight = 0x81
+)
+
+// readReplayKeys sends the playback control keys read from r.
+func readReplayKeys(r io.Reader, keys chan<- byte) {
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			if buf[i] == 0x1b && i+2 < n && buf[i+1] == '[' {
+				switch buf[i+2] {
+				case 'C':
+					keys <- keyRight
+				case 'D':
+					keys <- keyLeft
+				}
+				i += 2
+				continue
+			}
+			keys <- buf[i]
+		}
+	}
+}
+
+// player keeps the playback position of a recording.  The event times are adjusted for the idle time limit
+// when the player is created, the playback speed is applied while playing.
+type player struct {
+	events []RecordingEvent
+	out    io.Writer
+	speed  float64
+	pos    time.Duration
+	next   int
+	paused bool
+}
+
+func newPlayer(rec *Recording, opts ReplayOptions, out io.Writer) *player {
+	p := &player{out: out, speed: opts.Speed}
+	if p.speed <= 0 {
+		p.speed = 1
+	}
+
+	var last, adjusted time.Duration
+	for _, ev := range rec.Events {
+		if ev.Code != eventOutput {
+			// input is echoed in the output, and the local terminal can't be resized
+			continue
+		}
+
+		gap := ev.Time - last
+		if opts.IdleTimeLimit > 0 && gap > opts.IdleTimeLimit {
+			gap = opts.IdleTimeLimit
+		}
+		last = ev.Time
+		adjusted += gap
+
+		p.events = append(p.events, RecordingEvent{Time: adjusted, Code: ev.Code, Data: ev.Data})
+	}
+	return p
+}
+
+func (p *player) play(keys <-chan byte) error {
+	for p.next < len(p.events) {
+		if p.paused {
+			k, ok := <-keys
+			if !ok {
+				p.paused = false
+				continue
+			}
+
+			if done, err := p.handleKey(k); done || err != nil {
+				return err
+			}
+			continue
+		}
+
+		wait := time.Duration(float64(p.events[p.next].Time-p.pos) / p.speed)
+		start := time.Now()
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+			if err := p.emit(); err != nil {
+				return err
+			}
+		case k, ok := <-keys:
+			timer.Stop()
+			p.pos += time.Duration(float64(time.Since(start)) * p.speed)
+			if !ok {
+				// stdin closed, keep playing without controls
+				keys = nil
+				continue
+			}
+
+			if done, err := p.handleKey(k); done || err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleKey acts on a playback control key, returning true if the playback should stop.
+func (p *player) handleKey(k byte) (bool, error) {
+	switch k {
+	case keyQuit, keyCtrlC:
+		return true, nil
+	case keyPause:
+		p.paused = !p.paused
+	case keyStep:
+		if p.paused {
+			return false, p.emit()
+		}
+	case keyRight:
+		return false, p.seek(p.pos + replaySeekStep)
+	case keyLeft:
+		return false, p.seek(p.pos - replaySeekStep)
+	}
+	return false, nil
+}
+
+// emit writes the next event and moves the playback position to it.
+func (p *player) emit() error {
+	ev := p.events[p.next]
+	p.pos = ev.Time
+	p.next++
+
+	_, err := io.WriteString(p.out, ev.Data)
+	return err
+}
+
+// seek moves the playback position.  Seeking backwards resets the terminal and re-draws the output from the
+// start of the recording, since terminal output can't be undone.
+func (p *player) seek(to time.Duration) error {
+	if to < 0 {
+		to = 0
+	}
+
+	if to < p.pos {
+		if _, err := io.WriteString(p.out, "\x1bc"); err != nil {
+			return err
+		}
+		p.next = 0
+	}
+
+	var sb strings.Builder
+	for p.next < len(p.events) && p.events[p.next].Time <= to {
+		sb.WriteString(p.events[p.next].Data)
+		p.next++
+	}
+	p.pos = to
+
+	_, err := io.WriteString(p.out, sb.String())
+	return err
+}
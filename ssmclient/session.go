@@ -0,0 +1,127 @@
+package ssmclient
+
+import (
+	"os"
+	"sync"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/alexbacchin/ssm-session-client/datachannel"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+var (
+	traceOnce   sync.Once
+	traceWriter *datachannel.Tracer
+	traceErr    error
+)
+
+// openSession creates a data channel and starts the session described by the StartSessionInput.  The SSM messages
+// endpoint override, proxy, reconnect, keepalive and protocol trace settings are taken from the application config.
+// The stderr output of the session, and the handshake banner, are written to os.Stderr.  The data channel is
+// reported by the metrics server (if it runs) until it is closed, and logs to the provided Logger.
+func openSession(cfg aws.Config, in *ssm.StartSessionInput, log *zap.Logger) (*datachannel.SsmDataChannel, error) {
+	dialer, err := websocketDialer()
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := sessionTracer()
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(datachannel.SsmDataChannel)
+	c.Dialer = dialer
+	c.ReconnectPolicy = reconnectPolicy()
+	c.KeepAlivePolicy = keepAlivePolicy()
+	c.Tracer = tracer
+	c.Stderr = os.Stderr
+	c.Logger = log
+
+	if err := c.Open(cfg, in, &datachannel.SSMMessagesResover{
+		Endpoint: config.Flags().SSMMessagesVpcEndpoint,
+	}); err != nil {
+		return nil, err
+	}
+
+	sessions.add(c)
+	return c, nil
+}
+
+// websocketDialer builds the dialer for the SSM messages websocket connection, using the same proxy and TLS settings
+// as the AWS SDK clients.  Like the SDK clients, the proxy-url flag is not used if the SSM messages endpoint is set.
+func websocketDialer() (*websocket.Dialer, error) {
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	d := *websocket.DefaultDialer
+	d.TLSClientConfig = tlsConfig
+	if config.Flags().SSMMessagesVpcEndpoint != "" {
+		return &d, nil
+	}
+
+	proxy, err := config.ProxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	d.Proxy = proxy
+	return &d, nil
+}
+
+// reconnectPolicy builds the data channel ReconnectPolicy from the application config, a nil value (reconnect
+// disabled) is returned if no reconnect attempts are configured.
+func reconnectPolicy() *datachannel.ReconnectPolicy {
+	if config.Flags().ReconnectAttempts < 1 {
+		return nil
+	}
+
+	p := datachannel.DefaultReconnectPolicy
+	p.MaxAttempts = config.Flags().ReconnectAttempts
+	if config.Flags().ReconnectBackoff > 0 {
+		p.Backoff = config.Flags().ReconnectBackoff
+	}
+	return &p
+}
+
+// keepAlivePolicy builds the data channel KeepAlivePolicy from the application config, a nil value (keepalive
+// disabled) is returned if no keepalive interval is configured.
+func keepAlivePolicy() *datachannel.KeepAlivePolicy {
+	if config.Flags().KeepAliveInterval <= 0 {
+		return nil
+	}
+
+	p := datachannel.DefaultKeepAlivePolicy
+	p.Interval = config.Flags().KeepAliveInterval
+	if config.Flags().KeepAliveTimeout > 0 {
+		p.Timeout = config.Flags().KeepAliveTimeout
+	}
+	return &p
+}
+
+// sessionTracer returns the protocol Tracer for the trace file in the application config, or nil if tracing is
+// disabled.  The Tracer is shared by all sessions of the process (port forwarding may open several), records are
+// appended to the file and identified by the session ID.
+func sessionTracer() (*datachannel.Tracer, error) {
+	if config.Flags().TraceFile == "" {
+		return nil, nil
+	}
+
+	traceOnce.Do(func() {
+		var f *os.File
+		f, traceErr = os.OpenFile(config.Flags().TraceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if traceErr != nil {
+			return
+		}
+
+		traceWriter = datachannel.NewTracer(f, datachannel.TraceOptions{
+			PayloadLimit: config.Flags().TracePayloadLimit,
+			IncludeData:  config.Flags().TraceIncludeData,
+		})
+	})
+	return traceWriter, traceErr
+}
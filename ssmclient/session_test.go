@@ -0,0 +1,80 @@
+package ssmclient
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexbacchin/ssm-session-client/config"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketDialerTLS(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			_ = conn.Close()
+		}
+	}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "wss" + strings.TrimPrefix(srv.URL, "https")
+	for _, tc := range []struct {
+		name       string
+		caBundle   string
+		minVersion string
+		err        string
+	}{
+		{name: "system roots", err: "certificate signed by unknown authority"},
+		{name: "ca bundle", caBundle: bundle},
+		{name: "min version", caBundle: bundle, minVersion: "1.3", err: "protocol version"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			saved := *config.Flags()
+			defer func() { *config.Flags() = saved }()
+			config.Flags().CABundle = tc.caBundle
+			config.Flags().TLSMinVersion = tc.minVersion
+
+			d, err := websocketDialer()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, _, err := d.Dial(url, nil)
+			if err == nil {
+				_ = conn.Close()
+			}
+
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestWebsocketDialerClientCertAndKey(t *testing.T) {
+	saved := *config.Flags()
+	defer func() { *config.Flags() = saved }()
+	config.Flags().ClientCert = "client.crt"
+
+	if _, err := websocketDialer(); err == nil || !strings.Contains(err.Error(), "client-key") {
+		t.Errorf("expected the client-cert and client-key error, got %v", err)
+	}
+}
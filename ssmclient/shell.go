@@ -4,11 +4,10 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sync/atomic"
 
-	"github.com/alexbacchin/ssm-session-client/config"
 	"github.com/alexbacchin/ssm-session-client/datachannel"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"go.uber.org/zap"
 )
 
@@ -17,23 +16,92 @@ import (
 // websocket communication channel.  A vararg slice of io.Readers can be provided to send data to the
 // instance before handing control of the terminal to the user.
 func ShellSession(cfg aws.Config, target string, initCmd ...io.Reader) error {
-	c := new(datachannel.SsmDataChannel)
-	if err := c.Open(cfg, &ssm.StartSessionInput{Target: aws.String(target)}, &datachannel.SSMMessagesResover{
-		Endpoint: config.Flags().SSMMessagesVpcEndpoint,
-	}); err != nil {
+	return ShellSessionWithRecorder(cfg, target, nil, initCmd...)
+}
+
+// ShellSessionWithRecorder is ShellSession, recording the session with the provided Recorder.  The output,
+// terminal size changes and (if enabled in the Recorder) input of the session are recorded.  A nil Recorder
+// disables recording.  The Recorder is not closed when the session ends.  An error writing the recording is
+// logged and stops the recording, without ending the session.
+func ShellSessionWithRecorder(cfg aws.Config, target string, rec *Recorder, initCmd ...io.Reader) error {
+	return ShellSessionWithInput(cfg, &ShellInput{Target: target, Recorder: rec}, initCmd...)
+}
+
+// ShellInput configures a shell session.
+// Target is the EC2 instance ID to establish the session with.
+// DocumentName is the session document, the shell document of the SSM service if not set.  If DocumentName or
+// Parameters are set, the parameters are validated against the document before the session is started.
+// Recorder, if set, records the session like ShellSessionWithRecorder.
+// Stdin, Stdout and Stderr are the input and output of the session, os.Stdin, os.Stdout and os.Stderr if not set.
+// The terminal (raw mode, size updates and signals) is only handled when Stdin is not set.
+// Logger receives the log of the session, if not set the Logger from SetLogger is used.
+type ShellInput struct {
+	Target       string
+	DocumentName string
+	Parameters   map[string][]string
+	Recorder     *Recorder
+	Stdin        io.Reader
+	Stdout       io.Writer
+	Stderr       io.Writer
+	Logger       *zap.Logger
+}
+
+func (in *ShellInput) logger() *zap.Logger {
+	if in.Logger != nil {
+		return in.Logger
+	}
+	return defaultLogger()
+}
+
+// ShellSessionWithInput is ShellSession, using the ShellInput parameters to configure the session.
+func ShellSessionWithInput(cfg aws.Config, in *ShellInput, initCmd ...io.Reader) error {
+	ssi, err := sessionInput(cfg, in.Target, in.DocumentName, in.Parameters, "", nil)
+	if err != nil {
+		return err
+	}
+
+	c, err := openSession(cfg, ssi, in.logger())
+	if err != nil {
 		return err
 	}
+	rec := in.Recorder
 	defer c.Close()
 
+	var dc datachannel.DataChannel = c
+	var stdin io.Reader = os.Stdin
+	var stdout io.Writer = os.Stdout
+	var stderr io.Writer = os.Stderr
+	if in.Stdin != nil {
+		stdin = in.Stdin
+	}
+	if in.Stdout != nil {
+		stdout = in.Stdout
+	}
+	if in.Stderr != nil {
+		stderr = in.Stderr
+	}
+
+	c.Stderr = stderr
+	if rec != nil {
+		// a recording error must not end the session, the recording is stopped instead
+		sr := &sessionRecorder{rec: rec, logger: in.logger()}
+		dc = &recordingChannel{DataChannel: c, rec: sr}
+		stdin = io.TeeReader(stdin, sr.writer(rec.Input()))
+		stdout = io.MultiWriter(stdout, sr.writer(rec.Output()))
+		c.Stderr = io.MultiWriter(stderr, sr.writer(rec.Output()))
+	}
+
 	// do platform-specific setup ... signal handling, stdin modification, etc...
-	if err := initialize(c); err != nil {
-		return err
+	if in.Stdin == nil {
+		if err = initialize(dc); err != nil {
+			return err
+		}
+		defer cleanup() //nolint:errcheck // platform-specific cleanup, not called if terminated by a signal
 	}
-	defer cleanup() //nolint:errcheck // platform-specific cleanup, not called if terminated by a signal
 
 	errCh := make(chan error, 5)
 	go func() {
-		if _, err := io.Copy(c, os.Stdin); err != nil {
+		if _, err := io.Copy(c, stdin); err != nil {
 			errCh <- err
 		}
 	}()
@@ -42,14 +110,23 @@ func ShellSession(cfg aws.Config, target string, initCmd ...io.Reader) error {
 		_, _ = io.Copy(c, cmd)
 	}
 
-	if _, err := io.Copy(os.Stdout, c); err != nil {
+	if _, err := io.Copy(stdout, c); err != nil {
+		if errors.Is(err, datachannel.ErrConnectionStale) {
+			c.Logger.Warn("connection to the session was lost", zap.String(datachannel.LogKeySessionID, c.SessionID()))
+		}
+
 		if !errors.Is(err, io.EOF) {
 			errCh <- err
 		}
 	}
-	close(errCh)
 
-	return <-errCh
+	// the input goroutine may still fail once the session has ended, errCh is not closed
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
 }
 
 func updateTermSize(c datachannel.DataChannel) error {
@@ -58,14 +135,79 @@ func updateTermSize(c datachannel.DataChannel) error {
 		// make sure we set some default terminal size with contrived values
 		cols = 132
 		rows = 45
-		zap.S().Infof("Could not get size of the terminal: %s, using width %d height %d\n", err, cols, rows)
+		defaultLogger().Info("could not get the size of the terminal, using the default size",
+			zap.Error(err), zap.Uint32("cols", cols), zap.Uint32("rows", rows))
 	}
 
 	return c.SetTerminalSize(rows, cols)
 }
 
+// recordingChannel records the terminal size changes sent over the data channel.
+type recordingChannel struct {
+	datachannel.DataChannel
+	rec *sessionRecorder
+}
+
+func (c *recordingChannel) SetTerminalSize(rows, cols uint32) error {
+	if err := c.DataChannel.SetTerminalSize(rows, cols); err != nil {
+		return err
+	}
+	c.rec.resize(rows, cols)
+	return nil
+}
+
+// sessionRecorder records a session with a Recorder, without failing the session if the recording fails.  The
+// first error is logged, and nothing is recorded after it.
+type sessionRecorder struct {
+	rec    *Recorder
+	logger *zap.Logger
+	failed atomic.Bool
+}
+
+// writer returns an io.Writer which writes to the Recorder stream w, and never fails.
+func (r *sessionRecorder) writer(w io.Writer) io.Writer {
+	return &sessionRecorderWriter{r: r, w: w}
+}
+
+func (r *sessionRecorder) resize(rows, cols uint32) {
+	if !r.failed.Load() {
+		r.check(r.rec.Resize(rows, cols))
+	}
+}
+
+// check disables the recording if err is not nil, logging the first error.
+func (r *sessionRecorder) check(err error) {
+	if err != nil && r.failed.CompareAndSwap(false, true) {
+		r.logger.Warn("unable to record the session, the recording is stopped", zap.Error(err))
+	}
+}
+
+type sessionRecorderWriter struct {
+	r *sessionRecorder
+	w io.Writer
+}
+
+func (w *sessionRecorderWriter) Write(data []byte) (int, error) {
+	if !w.r.failed.Load() {
+		_, err := w.w.Write(data)
+		w.r.check(err)
+	}
+	return len(data), nil
+}
+
 // ShellPluginSession delegates the execution of the SSM shell session to the AWS-managed session manager plugin code,
 // bypassing this libraries internal websocket code and session management.
 func ShellPluginSession(cfg aws.Config, target string) error {
-	return PluginSession(cfg, &ssm.StartSessionInput{Target: aws.String(target)})
+	return ShellPluginSessionWithInput(cfg, &ShellInput{Target: target})
+}
+
+// ShellPluginSessionWithInput is ShellPluginSession, using the document and parameters of the ShellInput.  The
+// Recorder and Logger are not used by the plugin.
+func ShellPluginSessionWithInput(cfg aws.Config, in *ShellInput) error {
+	ssi, err := sessionInput(cfg, in.Target, in.DocumentName, in.Parameters, "", nil)
+	if err != nil {
+		return err
+	}
+
+	return PluginSession(cfg, ssi)
 }
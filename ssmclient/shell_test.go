@@ -0,0 +1,167 @@
+package ssmclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexbacchin/ssm-session-client/datachannel/ssmtest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testFaults are the faults injected in the sessions of the tests.
+var testFaults = []struct {
+	name   string
+	faults ssmtest.Faults
+}{
+	{"none", ssmtest.Faults{}},
+	{"drop", ssmtest.Faults{Drop: 0.1, Seed: 1}},
+	{"reorder", ssmtest.Faults{Reorder: 0.2, Seed: 2}},
+	{"duplicate", ssmtest.Faults{Duplicate: 0.2, Seed: 3}},
+}
+
+// waitFor polls the condition until it is true, failing the test after the timeout.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestShellSession(t *testing.T) {
+	for _, tc := range testFaults {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := ssmtest.NewServer(&ssmtest.Options{Faults: tc.faults})
+			defer srv.Close()
+
+			stdin, input := io.Pipe()
+			defer input.Close()
+			stdout := new(syncBuffer)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- ShellSessionWithInput(srv.AWSConfig(), &ShellInput{
+					Target: "i-0123456789abcdef0",
+					Stdin:  stdin,
+					Stdout: stdout,
+					Stderr: io.Discard,
+				})
+			}()
+
+			// the input is written as soon as the session is open, without waiting for the handshake
+			lines := make([]string, 20)
+			for i := range lines {
+				lines[i] = strings.Repeat(string(rune('a'+i)), 100)
+				if _, err := io.WriteString(input, lines[i]+"\n"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := strings.Join(lines, "\n") + "\n"
+			waitFor(t, 10*time.Second, func() bool { return stdout.String() == want })
+
+			srv.LastSession().CloseChannel("")
+			select {
+			case err := <-errCh:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the session did not end when the channel was closed")
+			}
+		})
+	}
+}
+
+// failingWriter fails every write after the first n.
+type failingWriter struct {
+	mu     sync.Mutex
+	n      int
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.writes++; w.writes > w.n {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func TestShellSessionRecorderError(t *testing.T) {
+	srv := ssmtest.NewServer(nil)
+	defer srv.Close()
+
+	stdin, input := io.Pipe()
+	defer input.Close()
+	stdout := new(syncBuffer)
+
+	// the recording fails after the header and the first event
+	rec := NewRecorder(&failingWriter{n: 2}, true)
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ShellSessionWithInput(srv.AWSConfig(), &ShellInput{
+			Target:   "i-0123456789abcdef0",
+			Recorder: rec,
+			Stdin:    stdin,
+			Stdout:   stdout,
+			Stderr:   io.Discard,
+			Logger:   zap.New(core),
+		})
+	}()
+
+	// the session continues once the recording has failed
+	var want string
+	for i := 0; i < 5; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		if _, err := io.WriteString(input, line); err != nil {
+			t.Fatal(err)
+		}
+		want += line
+		waitFor(t, 10*time.Second, func() bool { return stdout.String() == want })
+	}
+
+	srv.LastSession().CloseChannel("")
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the session did not end when the channel was closed")
+	}
+
+	if n := logs.FilterMessage("unable to record the session, the recording is stopped").Len(); n != 1 {
+		t.Errorf("the recording error was logged %d times", n)
+	}
+}
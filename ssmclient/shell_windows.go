@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/alexbacchin/ssm-session-client/datachannel"
-	"go.uber.org/zap"
 	"golang.org/x/sys/windows"
 )
 
@@ -17,6 +16,9 @@ const (
 	ResizeSleepInterval = time.Millisecond * 500
 )
 
+// origStdinMode and origStdoutMode hold the console modes replaced by configureStdin, restored by cleanup.
+var origStdinMode, origStdoutMode *uint32
+
 func initialize(c datachannel.DataChannel) error {
 	// todo
 	//  - interrogate terminal size and call updateTermSize()
@@ -29,7 +31,47 @@ func initialize(c datachannel.DataChannel) error {
 }
 
 func cleanup() error {
-	// todo - reset stdin to original settings
+	var err error
+	if origStdoutMode != nil {
+		err = windows.SetConsoleMode(windows.Handle(os.Stdout.Fd()), *origStdoutMode)
+		origStdoutMode = nil
+	}
+
+	if origStdinMode != nil {
+		// reset Stdin to original settings
+		if e := windows.SetConsoleMode(windows.Handle(os.Stdin.Fd()), *origStdinMode); e != nil {
+			err = e
+		}
+		origStdinMode = nil
+	}
+	return err
+}
+
+// configureStdin puts the console in raw mode.  Input is read without line buffering and echo, Ctrl-C is read
+// as input instead of raising a signal, and the arrow keys are read as the same escape sequences a posix terminal
+// sends.  Escape sequences written to stdout are processed by the console.
+func configureStdin() error {
+	in := windows.Handle(os.Stdin.Fd())
+
+	var mode uint32
+	if err := windows.GetConsoleMode(in, &mode); err != nil {
+		return err
+	}
+
+	raw := mode &^ (windows.ENABLE_ECHO_INPUT | windows.ENABLE_LINE_INPUT | windows.ENABLE_PROCESSED_INPUT)
+	if err := windows.SetConsoleMode(in, raw|windows.ENABLE_VIRTUAL_TERMINAL_INPUT); err != nil {
+		return err
+	}
+	origStdinMode = &mode
+
+	// the console of older Windows versions can't process escape sequences, the output is written as is
+	out := windows.Handle(os.Stdout.Fd())
+	var outMode uint32
+	if err := windows.GetConsoleMode(out, &outMode); err == nil {
+		if windows.SetConsoleMode(out, outMode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING) == nil {
+			origStdoutMode = &outMode
+		}
+	}
 	return nil
 }
 
@@ -57,7 +99,7 @@ func installSignalHandlers(c datachannel.DataChannel) chan os.Signal {
 	go func() {
 		switch <-sigCh {
 		case os.Interrupt:
-			zap.S().Info("exiting")
+			defaultLogger().Info("exiting")
 			_ = cleanup()
 			_ = c.Close()
 			os.Exit(0)
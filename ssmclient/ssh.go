@@ -6,10 +6,8 @@ import (
 	"os"
 	"strconv"
 
-	"github.com/alexbacchin/ssm-session-client/config"
 	"github.com/alexbacchin/ssm-session-client/datachannel"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"go.uber.org/zap"
 )
 
@@ -24,18 +22,13 @@ func SSHSession(cfg aws.Config, opts *PortForwardingInput) error {
 		port = strconv.Itoa(opts.RemotePort)
 	}
 
-	in := &ssm.StartSessionInput{
-		DocumentName: aws.String("AWS-StartSSHSession"),
-		Target:       aws.String(opts.Target),
-		Parameters: map[string][]string{
-			"portNumber": {port},
-		},
+	in, err := opts.sessionInput(cfg, "AWS-StartSSHSession", map[string][]string{"portNumber": {port}})
+	if err != nil {
+		return err
 	}
 
-	c := new(datachannel.SsmDataChannel)
-	if err := c.Open(cfg, in, &datachannel.SSMMessagesResover{
-		Endpoint: config.Flags().SSMMessagesVpcEndpoint,
-	}); err != nil {
+	c, err := openSession(cfg, in, opts.logger())
+	if err != nil {
 		return err
 	}
 	defer func() {
@@ -43,29 +36,31 @@ func SSHSession(cfg aws.Config, opts *PortForwardingInput) error {
 		_ = c.Close()
 	}()
 
-	installSignalHandler(c)
+	log := opts.logger().With(zap.String(datachannel.LogKeyTarget, opts.Target),
+		zap.String(datachannel.LogKeySessionID, c.SessionID()))
+	installSignalHandler(c, log, exitSuccess)
 
-	zap.S().Info("waiting for handshake")
-	if err := c.WaitForHandshakeComplete(); err != nil {
+	log.Info("waiting for handshake")
+	if err = c.WaitForHandshakeComplete(); err != nil {
 		return err
 	}
-	zap.S().Info("handshake complete")
+	log.Info("handshake complete")
 
 	errCh := make(chan error, 5)
 	go func() {
 		if _, err := io.Copy(c, os.Stdin); err != nil {
-			zap.S().Infof("error copying from stdin to websocket: %v", err)
+			log.Info("error copying from stdin to websocket", zap.Error(err))
 			errCh <- err
 		}
-		zap.S().Info("copy from stdin to websocket finished")
+		log.Info("copy from stdin to websocket finished")
 	}()
 
 	if _, err := io.Copy(os.Stdout, c); err != nil {
 		if !errors.Is(err, io.EOF) {
-			zap.S().Infof("error copying from websocket to stdout: %v", err)
+			log.Info("error copying from websocket to stdout", zap.Error(err))
 			errCh <- err
 		}
-		zap.S().Info("EOF received from websocket -> stdout copy")
+		log.Info("EOF received from websocket -> stdout copy")
 	}
 	close(errCh)
 
@@ -80,14 +75,11 @@ func SSHPluginSession(cfg aws.Config, opts *PortForwardingInput) error {
 		port = strconv.Itoa(opts.RemotePort)
 	}
 
-	in := &ssm.StartSessionInput{
-		DocumentName: aws.String("AWS-StartSSHSession"),
-		Target:       aws.String(opts.Target),
-		Parameters: map[string][]string{
-			"portNumber": {port},
-		},
-		Reason: aws.String("ssm-session-client"),
+	in, err := opts.sessionInput(cfg, "AWS-StartSSHSession", map[string][]string{"portNumber": {port}})
+	if err != nil {
+		return err
 	}
+	in.Reason = aws.String("ssm-session-client")
 
 	return PluginSession(cfg, in)
 }
@@ -11,7 +11,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	"go.uber.org/zap"
 )
 
 var (
@@ -221,7 +220,7 @@ func (r *EC2Resolver) Resolve(filter ...types.Filter) (string, error) {
 	for _, res := range o.Reservations {
 		if len(res.Instances) > 0 {
 			if len(res.Instances) > 1 {
-				zap.S().Info("WARNING: more than 1 instance found, using 1st value")
+				defaultLogger().Warn("more than 1 instance found, using 1st value")
 			}
 			return *res.Instances[0].InstanceId, nil
 		}